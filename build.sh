@@ -11,5 +11,11 @@ echo "building the core..."
 CGO_ENABLED=0 GOOS=linux go build -ldflags "-X main.Version=$VERSION" -a -installsuffix cgo -o bin/autobus-core core/cmd/autobus-core
 echo "building the platform..."
 CGO_ENABLED=0 GOOS=linux go build -ldflags "-X main.Version=$VERSION" -a -installsuffix cgo -o bin/autobus-platform platform/cmd/autobus-platform
+echo "building the tap..."
+CGO_ENABLED=0 GOOS=linux go build -ldflags "-X main.Version=$VERSION" -a -installsuffix cgo -o bin/autobus-tap core/cmd/autobus-tap
+echo "building the replay..."
+CGO_ENABLED=0 GOOS=linux go build -ldflags "-X main.Version=$VERSION" -a -installsuffix cgo -o bin/autobus-replay core/cmd/autobus-replay
+echo "building the simulator..."
+CGO_ENABLED=0 GOOS=linux go build -ldflags "-X main.Version=$VERSION" -a -installsuffix cgo -o bin/autobus-sim core/cmd/autobus-sim
 echo "building the web API..."
 CGO_ENABLED=0 GOOS=linux go build -ldflags "-X main.Version=$VERSION" -a -installsuffix cgo -o bin/autobus-web web/cmd/autobus-web
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"web"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+)
+
+// NewAdminServer returns the HTTP server operators use to inspect the hub,
+// and the NATS protocol behind it.
+func NewAdminServer(addr string, h *hub, np *NatsProtocol, m *metrics) *http.Server {
+	mux := httprouter.New()
+	mux.GET("/sessions", handleGetSessions(h.Sessions()))
+	mux.GET("/sessions/:deviceID", handleGetSession(h.Sessions()))
+	mux.GET("/disconnects", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		web.OK(w, h.Disconnects())
+	})
+	mux.GET("/spool", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		stats, ok := np.SpoolStats()
+		if !ok {
+			web.ErrorResponse(w, errors.New("the spool is disabled"), http.StatusNotFound)
+			return
+		}
+		web.OK(w, stats)
+	})
+	mux.GET("/metrics", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := writeMetrics(w, m, h, np); err != nil {
+			h.Println("Could not write the metrics to", r.RemoteAddr, "reason:", err)
+		}
+	})
+	mux.GET("/version", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		w.Write([]byte(Version))
+	})
+	return &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+}
+
+func handleGetSessions(sessions *sessionRegistry) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		web.OK(w, sessions.All())
+	}
+}
+
+func handleGetSession(sessions *sessionRegistry) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		deviceID := params.ByName("deviceID")
+		s, ok := sessions.Lookup(deviceID)
+		if !ok {
+			web.ErrorResponse(w, errors.Errorf("device %s is not connected", deviceID), http.StatusNotFound)
+			return
+		}
+		web.OK(w, s.Info())
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+const (
+	maxConnectionsDefault = 10000
+
+	// the connection would go over MaxConnections
+	rejectMaxConnections = "max_connections"
+	// the connection would go over MaxConnectionsPerIP
+	rejectMaxConnectionsPerIP = "max_connections_per_ip"
+)
+
+// admission decides which of the connections accepted are served,
+// so that there are never more than max connections at once,
+// nor more than maxPerIP from the same IP address. Zero means no limit.
+type admission struct {
+	max, maxPerIP int
+
+	mu    sync.Mutex
+	total int
+	byIP  map[string]int
+}
+
+// Admit counts the connection from addr in, and returns "" when it is
+// within the limits, or else the reason it is rejected for.
+// Each connection admitted must be released once closed.
+func (a *admission) Admit(addr net.Addr) (reason string) {
+	ip := addrIP(addr)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.max > 0 && a.total >= a.max {
+		return rejectMaxConnections
+	}
+	if a.maxPerIP > 0 && a.byIP[ip] >= a.maxPerIP {
+		return rejectMaxConnectionsPerIP
+	}
+	if a.byIP == nil {
+		a.byIP = make(map[string]int)
+	}
+	a.total++
+	a.byIP[ip]++
+	return ""
+}
+
+// Release counts the connection from addr out.
+func (a *admission) Release(addr net.Addr) {
+	ip := addrIP(addr)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.total--
+	if a.byIP[ip]--; a.byIP[ip] <= 0 {
+		delete(a.byIP, ip)
+	}
+}
+
+// Connected returns how many connections are admitted right now.
+func (a *admission) Connected() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.total
+}
+
+// addrIP returns the IP address of addr, without the port.
+func addrIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
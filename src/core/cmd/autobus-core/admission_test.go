@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAdmission(t *testing.T) {
+	a := admission{max: 3, maxPerIP: 2}
+	first := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	second := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1001}
+	other := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}
+
+	steps := []struct {
+		admit  net.Addr
+		reason string
+	}{
+		{first, ""},
+		{second, ""},
+		{first, rejectMaxConnectionsPerIP},
+		{other, ""},
+		{other, rejectMaxConnections},
+	}
+	for i, step := range steps {
+		if reason := a.Admit(step.admit); reason != step.reason {
+			t.Fatalf("Step %d: expected %q admitting %s, got %q", i, step.reason, step.admit, reason)
+		}
+	}
+
+	a.Release(second)
+	if reason := a.Admit(first); reason != "" {
+		t.Error("Should admit again once released, got", reason)
+	}
+	a.Release(other)
+	if _, ok := a.byIP["10.0.0.2"]; ok {
+		t.Error("Should forget the IPs without connections")
+	}
+}
+
+func TestHubRejectsConnectionsOverTheLimit(t *testing.T) {
+	received := make(chan []byte, 1)
+	p := ProtocolFunc(func(msg []byte, _ *session) ([]byte, error) {
+		received <- msg
+		return nil, nil
+	})
+	h := startTestHub(t, p, MaxConnections(1))
+	defer h.Stop(context.Background())
+	addr := h.listeners[0].ln.Addr().String()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("Should connect to the hub:", err)
+	}
+	conn.Write([]byte(testFrame))
+	<-received
+
+	rejected, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("Should connect to the hub:", err)
+	}
+	defer rejected.Close()
+	rejected.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := rejected.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Should have closed the connection over the limit")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("Should have closed the connection over the limit right away")
+	}
+	counts := h.Disconnects()
+	if len(counts) != 1 || counts[0].Reason != rejectMaxConnections {
+		t.Errorf("Should count the rejection, got %+v", counts)
+	}
+
+	conn.Close()
+	deadline := time.Now().Add(time.Second)
+	for h.admission.Connected() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	accepted, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("Should connect to the hub:", err)
+	}
+	defer accepted.Close()
+	accepted.Write([]byte(testFrame))
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Error("Should accept connections again once there is room")
+	}
+}
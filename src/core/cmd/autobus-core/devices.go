@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// deviceRegistry is the allowlist of the devices allowed to connect to the
+// hub, loaded from a file with a device per line: its ID, and optionally the
+// secret it must present, e.g. "bus-42 s3cret". Blank lines and lines
+// starting with # are skipped.
+//
+// It can be reloaded while the hub is serving: the devices identified from
+// then on are checked against the new file.
+type deviceRegistry struct {
+	path string
+
+	mu      sync.RWMutex
+	secrets map[string]string
+}
+
+func loadDeviceRegistry(path string) (*deviceRegistry, error) {
+	r := &deviceRegistry{path: path}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the file again. If it is invalid, the previous devices are kept.
+func (r *deviceRegistry) Reload() error {
+	f, err := os.Open(r.path)
+	if err != nil {
+		return errors.Wrapf(err, "error loading the devices %s", r.path)
+	}
+	defer f.Close()
+
+	secrets := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 2 {
+			return errors.Errorf("%s:%d: expected a device ID and its secret, got %q", r.path, line, scanner.Text())
+		}
+		secret := ""
+		if len(fields) == 2 {
+			secret = fields[1]
+		}
+		secrets[deviceIDReplacer.Replace(fields[0])] = secret
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrapf(err, "error loading the devices %s", r.path)
+	}
+
+	r.mu.Lock()
+	r.secrets = secrets
+	r.mu.Unlock()
+	return nil
+}
+
+// Authorize fails with a rejection when the device is unknown, or when it
+// has a secret which it did not present, unless its certificate vouches for it.
+func (r *deviceRegistry) Authorize(deviceID, secret string, certified bool) error {
+	r.mu.RLock()
+	expected, ok := r.secrets[deviceID]
+	r.mu.RUnlock()
+	if !ok {
+		return rejection{disconnectUnknownDevice, errors.Errorf("device %s is unknown", deviceID)}
+	}
+	if expected == "" || certified {
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(expected)) != 1 {
+		return rejection{disconnectUnauthenticated, errors.Errorf("device %s did not present its secret", deviceID)}
+	}
+	return nil
+}
+
+// Len returns how many devices are allowed.
+func (r *deviceRegistry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.secrets)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestDevices(t *testing.T, dir, devices string) string {
+	path := filepath.Join(dir, "devices")
+	if err := ioutil.WriteFile(path, []byte(devices), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDeviceRegistry(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+	path := writeTestDevices(t, dir, "# the fleet\n1400046168\n\nbus.42 s3cret\n")
+	devices, err := loadDeviceRegistry(path)
+	if err != nil {
+		t.Fatal("Should load the devices:", err)
+	}
+
+	testCases := []struct {
+		deviceID, secret string
+		certified        bool
+		reason           string
+	}{
+		{"1400046168", "", false, ""},
+		{"1400046168", "whatever", false, ""},
+		{"bus-42", "s3cret", false, ""},
+		{"bus-42", "", true, ""},
+		{"bus-42", "", false, disconnectUnauthenticated},
+		{"bus-42", "s3cre", false, disconnectUnauthenticated},
+		{"666", "", false, disconnectUnknownDevice},
+	}
+	for _, tc := range testCases {
+		err := devices.Authorize(tc.deviceID, tc.secret, tc.certified)
+		reason := ""
+		if r, ok := err.(rejection); ok {
+			reason = r.reason
+		}
+		if reason != tc.reason {
+			t.Errorf("Expected %q authorizing %s with %q, got %v", tc.reason, tc.deviceID, tc.secret, err)
+		}
+	}
+
+	writeTestDevices(t, dir, "1400046168 too many fields\n")
+	if err := devices.Reload(); err == nil {
+		t.Error("Should not reload an invalid file")
+	}
+	if devices.Len() != 2 {
+		t.Error("Should keep the previous devices, has", devices.Len())
+	}
+}
+
+func TestHubAuthorizesDevices(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+	path := writeTestDevices(t, dir, "1400046168\n1400046169\nbus-42 s3cret\n")
+
+	handled := make(chan string, 10)
+	h := startTestHub(t, ProtocolFunc(func(msg []byte, from *session) ([]byte, error) {
+		handled <- from.DeviceID() + " " + strings.TrimSpace(string(msg[:4]))
+		return nil, nil
+	}), Devices(path), Listen(
+		listenerSpec{Network: "tcp", Addr: "127.0.0.1:0", Codec: "h02"},
+		listenerSpec{Network: "tcp", Addr: "127.0.0.1:0", Codec: "nmea", Banner: "ID:"},
+	))
+	defer h.Stop(context.Background())
+
+	rmc := "$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*6A\r\n"
+	other := strings.Replace(testFrame, "1400046168", "1400046169", 1)
+	unknown := strings.Replace(testFrame, "1400046168", "666", 1)
+	testCases := []struct {
+		listener int
+		stream   string
+		handled  []string
+		reason   string
+	}{
+		{0, testFrame, []string{"1400046168 *HQ,"}, disconnectEOF},
+		{0, unknown, nil, disconnectUnknownDevice},
+		{0, testFrame + other, []string{"1400046168 *HQ,"}, disconnectSwitchedDevice},
+		{1, "ID:bus-42 s3cret\r\n" + rmc, []string{"bus-42 $GPR"}, disconnectEOF},
+		{1, "ID:bus-42 s3cre\r\n" + rmc, nil, disconnectUnauthenticated},
+		{1, rmc, nil, disconnectUnknownDevice},
+	}
+	disconnects := func(reason string) (n uint64) {
+		for _, count := range h.Disconnects() {
+			if count.Reason == reason {
+				n = count.Count
+			}
+		}
+		return n
+	}
+	for i, tc := range testCases {
+		before := disconnects(tc.reason)
+		conn, err := net.Dial("tcp", h.listeners[tc.listener].ln.Addr().String())
+		if err != nil {
+			t.Fatal("Should connect to the hub:", err)
+		}
+		conn.Write([]byte(tc.stream))
+		if tc.reason == disconnectEOF {
+			conn.(*net.TCPConn).CloseWrite()
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		ioutil.ReadAll(conn)
+		conn.Close()
+
+		deadline := time.Now().Add(time.Second)
+		for h.admission.Connected() > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		for _, expected := range tc.handled {
+			select {
+			case got := <-handled:
+				if got != expected {
+					t.Errorf("%d: expected %q to be handled, got %q", i, expected, got)
+				}
+			default:
+				t.Errorf("%d: expected %q to be handled", i, expected)
+			}
+		}
+		select {
+		case got := <-handled:
+			t.Errorf("%d: should not have handled %q", i, got)
+		default:
+		}
+		if disconnects(tc.reason) != before+1 {
+			t.Errorf("%d: should have counted a disconnect for %s, got %+v", i, tc.reason, h.Disconnects())
+		}
+	}
+}
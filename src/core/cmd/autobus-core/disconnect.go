@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Why sessions end.
+const (
+	// the client closed the connection
+	disconnectEOF = "eof"
+	// reading or writing failed
+	disconnectError = "error"
+	// the client failed the TLS handshake
+	disconnectHandshake = "handshake"
+	// the PROXY header was missing or invalid (see listenerSpec.Proxy)
+	disconnectProxyHeader = "proxy_header"
+	// the client sent nothing for too long (see ReadTimeout)
+	disconnectReadTimeout = "read_timeout"
+	// the client sent no frames for too long (see IdleTimeout)
+	disconnectIdle = "idle"
+	// the session lasted too long (see MaxSessionLifetime)
+	disconnectLifetime = "lifetime"
+	// the device is not in the registry (see Devices)
+	disconnectUnknownDevice = "unknown_device"
+	// the device did not present its secret, or presented a wrong one
+	disconnectUnauthenticated = "unauthenticated"
+	// the client sent frames of another device than the one it identified as
+	disconnectSwitchedDevice = "switched_device"
+	// the device connected again, through another session
+	disconnectReplaced = "replaced"
+	// the hub is stopping
+	disconnectShutdown = "shutdown"
+	// handling the session panicked (see panicked)
+	disconnectPanic = "panic"
+)
+
+// forcedDisconnects are the reasons the hub closes sessions on its own,
+// which are always logged.
+var forcedDisconnects = map[string]bool{
+	disconnectProxyHeader:     true,
+	disconnectReadTimeout:     true,
+	disconnectIdle:            true,
+	disconnectLifetime:        true,
+	disconnectUnknownDevice:   true,
+	disconnectUnauthenticated: true,
+	disconnectSwitchedDevice:  true,
+	disconnectPanic:           true,
+}
+
+// timeouts bound how long sessions last.
+// Zero durations don't bound anything.
+type timeouts struct {
+	// Read is how long a client may send nothing.
+	Read time.Duration
+	// Idle is how long a client may send no frames, e.g. a half-open
+	// connection, or a client sending garbage.
+	Idle time.Duration
+	// Lifetime is how long a session may last, however active it is.
+	Lifetime time.Duration
+}
+
+// deadline returns when the next read from a session must be done by,
+// and the reason it is disconnected for if it isn't, or a zero time.
+func (t timeouts) deadline(now, lastSeen, connectedAt time.Time) (deadline time.Time, reason string) {
+	earliest := func(d time.Time, r string) {
+		if deadline.IsZero() || d.Before(deadline) {
+			deadline, reason = d, r
+		}
+	}
+	if t.Read > 0 {
+		earliest(now.Add(t.Read), disconnectReadTimeout)
+	}
+	if t.Idle > 0 {
+		earliest(lastSeen.Add(t.Idle), disconnectIdle)
+	}
+	if t.Lifetime > 0 {
+		earliest(connectedAt.Add(t.Lifetime), disconnectLifetime)
+	}
+	return deadline, reason
+}
+
+// rejection is the error of a client sending a frame it is not allowed to,
+// for the reason given.
+type rejection struct {
+	reason string
+	error
+}
+
+// panicked is the error of a session whose handling panicked, e.g. on a bug
+// decoding what its client sent: the session is closed, the others go on.
+type panicked struct {
+	value interface{}
+	stack []byte
+}
+
+func (p panicked) Error() string {
+	return fmt.Sprintf("panic: %v\n%s", p.value, p.stack)
+}
+
+// disconnectReason tells why reading from or writing to the session failed.
+func (h *hub) disconnectReason(s *session, err error) string {
+	if reason := s.closeReason(); reason != "" {
+		return reason
+	}
+	if h.stopping() {
+		return disconnectShutdown
+	}
+	err = errors.Cause(err)
+	switch err := err.(type) {
+	case rejection:
+		return err.reason
+	case panicked:
+		return disconnectPanic
+	case net.Error:
+		if err.Timeout() {
+			if reason := s.deadlineReason(); reason != "" {
+				return reason
+			}
+			return disconnectReadTimeout
+		}
+	}
+	if err == io.EOF {
+		return disconnectEOF
+	}
+	return disconnectError
+}
+
+// disconnected counts the end of a session,
+// and logs it when the hub ended it on its own.
+func (h *hub) disconnected(s *session, reason string, err error) {
+	h.disconnects.Add(reason)
+	if _, ok := errors.Cause(err).(rejection); ok {
+		h.metrics.Rejected(s.Listener, reason)
+	}
+	switch {
+	case forcedDisconnects[reason]:
+		h.Println("Closing connection from", s.RemoteAddr, "reason:", reason, err)
+	case reason == disconnectError:
+		h.report(err)
+	default:
+		h.logDebug("Connection from", s.RemoteAddr, "closed, reason:", reason)
+	}
+}
+
+// disconnectCounter counts the sessions that ended, by reason.
+type disconnectCounter struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+func (c *disconnectCounter) Add(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[string]uint64)
+	}
+	c.counts[reason]++
+}
+
+// disconnectCount is how many sessions ended for the reason.
+type disconnectCount struct {
+	Reason string `json:"reason"`
+	Count  uint64 `json:"count"`
+}
+
+// Counts returns the counts of every reason seen so far, sorted by reason.
+func (c *disconnectCounter) Counts() []disconnectCount {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make([]disconnectCount, 0, len(c.counts))
+	for reason, count := range c.counts {
+		counts = append(counts, disconnectCount{reason, count})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		return counts[i].Reason < counts[j].Reason
+	})
+	return counts
+}
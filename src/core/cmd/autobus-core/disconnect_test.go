@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTimeoutsDeadline(t *testing.T) {
+	now := time.Date(2017, 4, 10, 12, 0, 0, 0, time.UTC)
+	lastSeen := now.Add(-time.Minute)
+	connectedAt := now.Add(-time.Hour)
+	testCases := []struct {
+		timeouts timeouts
+		deadline time.Time
+		reason   string
+	}{
+		{timeouts{}, time.Time{}, ""},
+		{timeouts{Read: time.Minute}, now.Add(time.Minute), disconnectReadTimeout},
+		{timeouts{Idle: 10 * time.Minute}, now.Add(9 * time.Minute), disconnectIdle},
+		{timeouts{Read: 5 * time.Minute, Idle: 2 * time.Minute}, now.Add(time.Minute), disconnectIdle},
+		{timeouts{Idle: 10 * time.Minute, Lifetime: 65 * time.Minute}, now.Add(5 * time.Minute), disconnectLifetime},
+		{timeouts{Lifetime: 30 * time.Minute}, now.Add(-30 * time.Minute), disconnectLifetime},
+	}
+	for _, tc := range testCases {
+		deadline, reason := tc.timeouts.deadline(now, lastSeen, connectedAt)
+		if !deadline.Equal(tc.deadline) || reason != tc.reason {
+			t.Errorf("%+v: expected %v (%s), got %v (%s)", tc.timeouts, tc.deadline, tc.reason, deadline, reason)
+		}
+	}
+}
+
+func TestHubDisconnectsByReason(t *testing.T) {
+	testCases := []struct {
+		name     string
+		option   hubOption
+		interval time.Duration
+		reason   string
+	}{
+		{"silent client", IdleTimeout(100 * time.Millisecond), 0, disconnectIdle},
+		{"chatty client", MaxSessionLifetime(150 * time.Millisecond), 20 * time.Millisecond, disconnectLifetime},
+	}
+	for _, tc := range testCases {
+		p := ProtocolFunc(func([]byte, *session) ([]byte, error) {
+			return nil, nil
+		})
+		h := startTestHub(t, p, IdleTimeout(0), tc.option)
+
+		conn, err := net.Dial("tcp", h.listeners[0].ln.Addr().String())
+		if err != nil {
+			t.Fatal("Should connect to the hub:", err)
+		}
+		conn.Write([]byte(testFrame))
+		done := make(chan struct{})
+		if tc.interval > 0 {
+			go func() {
+				for {
+					select {
+					case <-done:
+						return
+					case <-time.After(tc.interval):
+						conn.Write([]byte(testFrame))
+					}
+				}
+			}()
+		}
+
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Errorf("%s: should have been disconnected", tc.name)
+		} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.Errorf("%s: should have been disconnected in time", tc.name)
+		}
+		close(done)
+		conn.Close()
+
+		h.Stop(context.Background())
+		counts := h.Disconnects()
+		if len(counts) != 1 || counts[0].Reason != tc.reason || counts[0].Count != 1 {
+			t.Errorf("%s: expected one disconnect for %s, got %+v", tc.name, tc.reason, counts)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"io"
+)
+
+const (
+	maxFrameSizeDefault = 1024
+
+	// initial size of the per-connection buffer.
+	// Most frames fit here, so it rarely grows.
+	frameBufferSize = 256
+)
+
+// framer reassembles the byte stream of a single connection into frames.
+//
+// TCP gives no guarantee about message boundaries: a frame can arrive split
+// across several reads, or several frames may arrive in a single one.
+// The framer buffers what was read so far and only hands out whole frames,
+// as delimited by the split function of the protocol being spoken.
+type framer struct {
+	scanner *bufio.Scanner
+	split   bufio.SplitFunc
+	maxSize int
+
+	// Discarded is called with the number of bytes thrown away
+	// whenever pending data grows past maxSize without forming a frame.
+	Discarded func(n int)
+}
+
+func newFramer(r io.Reader, split bufio.SplitFunc, maxSize int) *framer {
+	f := &framer{
+		scanner: bufio.NewScanner(r),
+		split:   split,
+		maxSize: maxSize,
+	}
+	// leave enough room for the scanner to never reach its own limit:
+	// we'll give up on the pending data before that.
+	f.scanner.Buffer(make([]byte, frameBufferSize), 2*maxSize+1)
+	f.scanner.Split(f.limit)
+	return f
+}
+
+// limit wraps the split function, enforcing the maximum frame size.
+func (f *framer) limit(data []byte, atEOF bool) (int, []byte, error) {
+	advance, token, err := f.split(data, atEOF)
+	if err != nil {
+		return advance, token, err
+	}
+	if token != nil && len(token) > f.maxSize {
+		f.discard(len(token))
+		return advance, nil, nil
+	}
+	if advance == 0 && token == nil && len(data) > f.maxSize {
+		f.discard(len(data))
+		return len(data), nil, nil
+	}
+	return advance, token, nil
+}
+
+func (f *framer) discard(n int) {
+	if f.Discarded != nil {
+		f.Discarded(n)
+	}
+}
+
+// Next blocks until a whole frame is available and returns it.
+// The returned slice is owned by the caller.
+// When the underlying reader is exhausted, io.EOF is returned.
+func (f *framer) Next() ([]byte, error) {
+	if !f.scanner.Scan() {
+		if err := f.scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	frame := make([]byte, len(f.scanner.Bytes()))
+	copy(frame, f.scanner.Bytes())
+	return frame, nil
+}
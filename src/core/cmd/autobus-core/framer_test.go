@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"domain"
+)
+
+const testFrame = "*HQ,1400046168,V1,055600,A,2234.3066,N,11351.6829,E,000.0,000,080813,FFFFFBFF#"
+
+func TestFramerReassemblesSegments(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		// one frame split across writes, followed by two frames in a single write
+		client.Write([]byte(testFrame[:10]))
+		client.Write([]byte(testFrame[10:]))
+		client.Write([]byte(testFrame + testFrame))
+		client.Close()
+	}()
+
+	frames := newFramer(server, domain.SplitH02, maxFrameSizeDefault)
+	for i := 0; i < 3; i++ {
+		frame, err := frames.Next()
+		if err != nil {
+			t.Fatal("Should read a whole frame:", err)
+		}
+		if string(frame) != testFrame {
+			t.Errorf("Unexpected frame %d: %q", i, frame)
+		}
+	}
+	if _, err := frames.Next(); err != io.EOF {
+		t.Error("Should end with io.EOF, has:", err)
+	}
+}
+
+func TestFramerDiscardsOversizedFrames(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		client.Write([]byte("*HQ,"))
+		for i := 0; i < 10; i++ {
+			client.Write(make([]byte, 100))
+		}
+		client.Write([]byte("#" + testFrame))
+		client.Close()
+	}()
+
+	var discarded int
+	frames := newFramer(server, domain.SplitH02, 256)
+	frames.Discarded = func(n int) {
+		discarded += n
+	}
+	frame, err := frames.Next()
+	if err != nil {
+		t.Fatal("Should recover after an oversized frame:", err)
+	}
+	if string(frame) != testFrame {
+		t.Errorf("Unexpected frame: %q", frame)
+	}
+	if discarded == 0 {
+		t.Error("Should have reported discarded bytes")
+	}
+}
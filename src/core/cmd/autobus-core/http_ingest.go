@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"domain"
+	"web"
+
+	"github.com/pkg/errors"
+)
+
+// the parameter phones present the secret of their device in (see Devices)
+const osmandSecretParam = "key"
+
+// requestAddr is the address of the client of an HTTP request.
+type requestAddr string
+
+func (a requestAddr) Network() string { return "http" }
+func (a requestAddr) String() string  { return string(a) }
+
+// serve serves HTTP through the listener.
+func (h *hub) serve(l *listener) {
+	srv := &http.Server{
+		Addr:        l.ln.Addr().String(),
+		Handler:     h.ingest(l),
+		ReadTimeout: h.timeouts.Read,
+		IdleTimeout: h.timeouts.Idle,
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				h.metrics.Accepted(l.Addr)
+			}
+		},
+	}
+	h.servers = append(h.servers, srv)
+	go func() {
+		if err := srv.Serve(l.ln); err != http.ErrServerClosed {
+			h.report(errors.Wrapf(err, "error serving %s", l.listenerSpec))
+		}
+	}()
+}
+
+// shutdownServers stops the HTTP listeners, waiting for the requests
+// in flight until ctx is done. A nil ctx closes them right away.
+func (h *hub) shutdownServers(ctx context.Context) {
+	for _, srv := range h.servers {
+		if ctx == nil {
+			srv.Close()
+			continue
+		}
+		if err := srv.Shutdown(ctx); err != nil {
+			h.Println("Closing the HTTP listener @", srv.Addr, "reason:", err)
+			srv.Close()
+		}
+	}
+}
+
+// ingest returns the handler of an HTTP listener. Each request, of the
+// OsmAnd protocol, is turned into a frame and handed to the Protocol,
+// the way the frames sent by the clients of the other listeners are.
+//
+// The status codes tell the phones whether to retry: the requests failing
+// with 400 never will, but the ones failing with 503 might.
+func (h *hub) ingest(l *listener) http.Handler {
+	spec := l.listenerSpec
+	codec, _ := domain.LookupCodec(spec.Codec)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			w.Header().Set("Allow", "GET, POST")
+			web.ErrorResponse(w, errors.Errorf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, int64(h.maxFrameSize))
+		values, err := requestValues(r)
+		if err != nil {
+			web.ErrorResponse(w, err, http.StatusBadRequest)
+			return
+		}
+		// the secret of the device is kept to ourselves
+		secret := values.Get(osmandSecretParam)
+		values.Del(osmandSecretParam)
+		if values.Get("timestamp") == "" {
+			values.Set("timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+		}
+		frame := []byte(values.Encode())
+		h.metrics.Received(spec.Addr, codec.Name())
+		packet, err := codec.Decode(frame)
+		if err != nil {
+			h.metrics.ParseError(parseUndecodable)
+			web.ErrorResponse(w, err, http.StatusBadRequest)
+			return
+		}
+
+		deviceID := deviceIDReplacer.Replace(packet.Device())
+		certified := ""
+		if r.TLS != nil {
+			certified = certifiedDevice(*r.TLS)
+		}
+		if certified != "" && certified != deviceID {
+			h.reject(w, r, spec, rejection{disconnectSwitchedDevice, errors.Errorf("device %s is not allowed with the certificate of %s", packet.Device(), certified)})
+			return
+		}
+		if h.devices != nil {
+			if err := h.devices.Authorize(deviceID, secret, certified != ""); err != nil {
+				h.reject(w, r, spec, err.(rejection))
+				return
+			}
+		}
+
+		now := time.Now()
+		s := &session{
+			RemoteAddr:  requestAddr(r.RemoteAddr),
+			ConnectedAt: now,
+			Listener:    spec.Addr,
+			codec:       codec.Name(),
+			deviceID:    deviceID,
+			lastSeen:    now,
+			packet:      packet,
+		}
+		if _, err := l.protocol.HandleMessage(frame, s); err != nil {
+			h.logDebug("Could not handle the request from", r.RemoteAddr, "reason:", err)
+			web.ErrorResponse(w, errors.New("the position could not be handled, try again later"), http.StatusServiceUnavailable)
+			return
+		}
+		web.OK(w, nil)
+	})
+}
+
+// reject answers the request with a 403, counting and logging the rejection.
+func (h *hub) reject(w http.ResponseWriter, r *http.Request, spec listenerSpec, rejected rejection) {
+	h.disconnects.Add(rejected.reason)
+	h.metrics.Rejected(spec.Addr, rejected.reason)
+	h.Println("Rejecting request from", r.RemoteAddr, "reason:", rejected.reason, rejected.error)
+	web.ErrorResponse(w, rejected.error, http.StatusForbidden)
+}
+
+// requestValues returns the parameters of the request: the ones in
+// the query, or in the body, in either its JSON or form encoded variant.
+func requestValues(r *http.Request) (url.Values, error) {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading the request")
+		}
+		return domain.OsmAndJSON(body)
+	}
+	if err := r.ParseForm(); err != nil {
+		return nil, errors.Wrap(err, "error parsing the request")
+	}
+	return r.Form, nil
+}
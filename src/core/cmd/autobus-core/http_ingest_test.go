@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHubIngestsOsmAnd(t *testing.T) {
+	frames := make(chan string, 1)
+	var failing int32
+	h := startTestHub(t, ProtocolFunc(func(msg []byte, from *session) ([]byte, error) {
+		if atomic.LoadInt32(&failing) == 1 {
+			return nil, errors.New("nats is down")
+		}
+		if from.Codec() != "osmand" || from.DeviceID() != "123456" {
+			t.Errorf("Unexpected session: %+v", from.Info())
+		}
+		frames <- string(msg)
+		return nil, nil
+	}), Listen(listenerSpec{Network: "http", Addr: "127.0.0.1:0", Codec: codecOsmAnd}))
+	defer h.Stop(context.Background())
+	url := "http://" + h.servers[0].Addr + "/"
+
+	resp, err := http.Post(url+"?id=123456&lat=-23.5&lon=-46.6&timestamp=1491822906&speed=10.5&bearing=90", "", nil)
+	if err != nil {
+		t.Fatal("Should post the position:", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Error("Should accept the position, status:", resp.StatusCode)
+	}
+	if expected := "bearing=90&id=123456&lat=-23.5&lon=-46.6&speed=10.5&timestamp=1491822906"; <-frames != expected {
+		t.Error("Should have published the canonical query")
+	}
+
+	body := `{"device_id": "123456", "location": {"timestamp": "2017-04-10T11:15:06Z", "coords": {"latitude": -23.5, "longitude": -46.6}}}`
+	resp, err = http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal("Should post the position:", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Error("Should accept the JSON position, status:", resp.StatusCode)
+	}
+	if expected := "id=123456&lat=-23.5&lon=-46.6&timestamp=2017-04-10T11%3A15%3A06Z"; <-frames != expected {
+		t.Error("Should have published the canonical query of the JSON")
+	}
+
+	resp, err = http.Get(url + "?id=123456&lat=-23.5")
+	if err != nil {
+		t.Fatal("Should get a response:", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Error("Should reject incomplete positions, status:", resp.StatusCode)
+	}
+
+	atomic.StoreInt32(&failing, 1)
+	resp, err = http.Get(url + "?id=123456&lat=-23.5&lon=-46.6")
+	if err != nil {
+		t.Fatal("Should get a response:", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Error("Should ask the phone to retry when the position can't be published, status:", resp.StatusCode)
+	}
+}
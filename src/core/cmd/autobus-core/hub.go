@@ -1,39 +1,79 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"runtime/debug"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
+
+	"domain"
+
+	"github.com/pkg/errors"
 )
 
 const (
-	acceptGoroutinesDefault  = 1024
-	handlerGoroutinesDefault = 2048
+	acceptGoroutinesDefault = 1024
+	idleTimeoutDefault      = 10 * time.Minute
 )
 
 type hub struct {
 	*log.Logger
-	listener net.Listener
-	conns    chan net.Conn
-	err      chan error
-	debug    bool
-	*sync.WaitGroup
-
-	addr                                string
-	acceptGoroutines, handlerGoroutines int
+	listeners []*listener
+	servers   []*http.Server
+	// of the TLS listeners, to be reloaded
+	certificates []*certificates
+	err          chan error
+	debug        bool
+
+	// closed when the hub is stopping
+	quit                chan struct{}
+	accepting, handling sync.WaitGroup
+	interceptingDone    chan struct{}
+
+	sessions *sessionRegistry
+
+	specs            []listenerSpec
+	acceptGoroutines int
+	admission        admission
+	maxFrameSize     int
+	timeouts         timeouts
+	keepAlive        time.Duration
+	disconnects      disconnectCounter
+	devices          *deviceRegistry
+	onAlarm          func(domain.Alarm)
+	metrics          *metrics
+	// the pipeline of the listeners which have none of their own
+	pipeline []stage
+	// the files the stages write to, by path (see pipelineEnv)
+	files map[string]io.Closer
 	Protocol
 }
 
+// accepted is a connection accepted by one of the listeners.
+type accepted struct {
+	net.Conn
+	*listener
+}
+
 type hubOption func(*hub) error
 
 func NewHub(logger *log.Logger, options ...hubOption) (*hub, error) {
 	h := &hub{
-		Logger: logger,
-		err:    make(chan error),
-		conns:  make(chan net.Conn),
+		Logger:       logger,
+		err:          make(chan error),
+		quit:         make(chan struct{}),
+		files:        make(map[string]io.Closer),
+		sessions:     newSessionRegistry(),
+		admission:    admission{max: maxConnectionsDefault},
+		maxFrameSize: maxFrameSizeDefault,
 	}
 	for _, opt := range options {
 		if err := opt(h); err != nil {
@@ -49,7 +89,7 @@ func ListenOn(addr string) hubOption {
 			h.Println("[WARNING] the connection hub will start at the default port (9009), which may not be what you expect.")
 			addr = "0.0.0.0:9009"
 		}
-		h.addr = addr
+		h.specs = []listenerSpec{{Network: "tcp", Addr: addr, Codec: "h02"}}
 		return nil
 	}
 }
@@ -58,6 +98,33 @@ func ListenFromEnv(envVar string) hubOption {
 	return ListenOn(os.Getenv(envVar))
 }
 
+// Listen makes the hub listen on each of the given listeners.
+func Listen(specs ...listenerSpec) hubOption {
+	return func(h *hub) error {
+		if len(specs) == 0 {
+			return errors.New("the connection hub needs at least one listener")
+		}
+		h.specs = specs
+		return nil
+	}
+}
+
+// ListenersFromEnv makes the hub listen on the listeners in envVar (see parseListenerSpecs).
+// If envVar is not set, the hub listens for h02 on the address in fallbackEnvVar.
+func ListenersFromEnv(envVar, fallbackEnvVar string) hubOption {
+	raw, exists := os.LookupEnv(envVar)
+	if !exists {
+		return ListenFromEnv(fallbackEnvVar)
+	}
+	specs, err := parseListenerSpecs(raw)
+	if err != nil {
+		return func(*hub) error {
+			return err
+		}
+	}
+	return Listen(specs...)
+}
+
 func Debug(debug bool) hubOption {
 	return func(h *hub) error {
 		if debug {
@@ -76,6 +143,14 @@ func DebugFromEnv(envVar string) hubOption {
 	return Debug(b)
 }
 
+func parseDurationFromEnv(env string, defaultValue time.Duration) (time.Duration, error) {
+	d, exists := os.LookupEnv(env)
+	if !exists {
+		return defaultValue, nil
+	}
+	return time.ParseDuration(d)
+}
+
 func parseIntFromEnv(env string, defaultValue int) (r int, err error) {
 	n, exists := os.LookupEnv(env)
 	if !exists {
@@ -92,9 +167,26 @@ func AcceptGoroutines(count int) hubOption {
 	}
 }
 
-func HandlerGoroutines(count int) hubOption {
+// MaxConnections is how many clients can be connected at once.
+// The connections over it are closed as soon as they are accepted.
+func MaxConnections(count int) hubOption {
 	return func(h *hub) error {
-		h.handlerGoroutines = count
+		if count <= 0 {
+			return errors.Errorf("the maximum number of connections must be positive, it is %d", count)
+		}
+		h.admission.max = count
+		return nil
+	}
+}
+
+// MaxConnectionsPerIP is how many clients can be connected at once from
+// the same IP address, or 0 for as many as MaxConnections allows.
+func MaxConnectionsPerIP(count int) hubOption {
+	return func(h *hub) error {
+		if count < 0 {
+			return errors.Errorf("the maximum number of connections per IP must not be negative, it is %d", count)
+		}
+		h.admission.maxPerIP = count
 		return nil
 	}
 }
@@ -107,12 +199,170 @@ func AcceptGoroutinesFromEnv(env string) hubOption {
 	return AcceptGoroutines(count)
 }
 
-func HandlerGoroutinesFromEnv(env string) hubOption {
-	count, err := parseIntFromEnv(env, handlerGoroutinesDefault)
+// MaxConnectionsFromEnv sets MaxConnections from env, or else from
+// fallbackEnv, which is what the limit used to be set by.
+func MaxConnectionsFromEnv(env, fallbackEnv string) hubOption {
+	if _, exists := os.LookupEnv(env); !exists {
+		env = fallbackEnv
+	}
+	count, err := parseIntFromEnv(env, maxConnectionsDefault)
+	if err != nil {
+		panic(err)
+	}
+	return MaxConnections(count)
+}
+
+func MaxConnectionsPerIPFromEnv(env string) hubOption {
+	count, err := parseIntFromEnv(env, 0)
+	if err != nil {
+		panic(err)
+	}
+	return MaxConnectionsPerIP(count)
+}
+
+func MaxFrameSize(size int) hubOption {
+	return func(h *hub) error {
+		if size <= 0 {
+			return errors.Errorf("the maximum frame size must be positive, it is %d", size)
+		}
+		h.maxFrameSize = size
+		return nil
+	}
+}
+
+func MaxFrameSizeFromEnv(env string) hubOption {
+	size, err := parseIntFromEnv(env, maxFrameSizeDefault)
 	if err != nil {
 		panic(err)
 	}
-	return HandlerGoroutines(count)
+	return MaxFrameSize(size)
+}
+
+// ReadTimeout disconnects the clients that send nothing for the given duration.
+func ReadTimeout(d time.Duration) hubOption {
+	return func(h *hub) error {
+		h.timeouts.Read = d
+		return nil
+	}
+}
+
+// IdleTimeout disconnects the clients that send no frames for the given duration,
+// such as the ones behind half-open connections.
+func IdleTimeout(d time.Duration) hubOption {
+	return func(h *hub) error {
+		h.timeouts.Idle = d
+		return nil
+	}
+}
+
+// MaxSessionLifetime disconnects the clients connected for longer than the given duration.
+func MaxSessionLifetime(d time.Duration) hubOption {
+	return func(h *hub) error {
+		h.timeouts.Lifetime = d
+		return nil
+	}
+}
+
+// KeepAlive sets the period of the TCP keepalive probes sent to the clients.
+// A negative period disables them, and zero leaves the system default.
+func KeepAlive(period time.Duration) hubOption {
+	return func(h *hub) error {
+		h.keepAlive = period
+		return nil
+	}
+}
+
+func ReadTimeoutFromEnv(env string) hubOption {
+	d, err := parseDurationFromEnv(env, 0)
+	if err != nil {
+		panic(err)
+	}
+	return ReadTimeout(d)
+}
+
+func IdleTimeoutFromEnv(env string) hubOption {
+	d, err := parseDurationFromEnv(env, idleTimeoutDefault)
+	if err != nil {
+		panic(err)
+	}
+	return IdleTimeout(d)
+}
+
+func MaxSessionLifetimeFromEnv(env string) hubOption {
+	d, err := parseDurationFromEnv(env, 0)
+	if err != nil {
+		panic(err)
+	}
+	return MaxSessionLifetime(d)
+}
+
+func KeepAliveFromEnv(env string) hubOption {
+	d, err := parseDurationFromEnv(env, 0)
+	if err != nil {
+		panic(err)
+	}
+	return KeepAlive(d)
+}
+
+// Devices makes the hub only take the devices in the registry at path
+// (see deviceRegistry), disconnecting the others as soon as they identify.
+func Devices(path string) hubOption {
+	return func(h *hub) error {
+		devices, err := loadDeviceRegistry(path)
+		if err != nil {
+			return err
+		}
+		h.devices = devices
+		return nil
+	}
+}
+
+// DevicesFromEnv makes the hub take the devices in the registry at the path
+// in env, or any device if it is not set.
+func DevicesFromEnv(env string) hubOption {
+	path := os.Getenv(env)
+	if path == "" {
+		return func(*hub) error {
+			return nil
+		}
+	}
+	return Devices(path)
+}
+
+// OnAlarm makes the hub call f whenever an alarm of a device goes on or off.
+// f is called from the goroutine handling the device, so it should not block.
+func OnAlarm(f func(domain.Alarm)) hubOption {
+	return func(h *hub) error {
+		h.onAlarm = f
+		return nil
+	}
+}
+
+// WithMetrics makes the hub measure its connections into m
+// (see metrics, and Instrument for the frames).
+func WithMetrics(m *metrics) hubOption {
+	return func(h *hub) error {
+		h.metrics = m
+		return nil
+	}
+}
+
+// Pipeline makes the frames go through the stages of pipeline (see
+// parsePipeline) before reaching the Protocol, unless their listener
+// has a pipeline of its own (see listenerSpec.Pipeline).
+func Pipeline(pipeline string) hubOption {
+	return func(h *hub) error {
+		stages, err := parsePipeline(pipeline)
+		if err != nil {
+			return err
+		}
+		h.pipeline = stages
+		return nil
+	}
+}
+
+func PipelineFromEnv(env string) hubOption {
+	return Pipeline(os.Getenv(env))
 }
 
 func WithProtocol(p Protocol) hubOption {
@@ -123,70 +373,371 @@ func WithProtocol(p Protocol) hubOption {
 }
 
 func (h *hub) Start() error {
-	h.Println("Starting connection hub @", h.addr)
-	ln, err := net.Listen("tcp", h.addr)
-	if err != nil {
-		return err
+	for _, spec := range h.specs {
+		h.Println("Starting connection hub @", spec)
+		l, err := listen(spec, h.keepAlive)
+		if err != nil {
+			h.closeListeners()
+			h.shutdownServers(nil)
+			return err
+		}
+		if l.certs != nil {
+			h.certificates = append(h.certificates, l.certs)
+		}
+		if l.protocol, l.recorders, err = h.pipelineFor(spec); err != nil {
+			l.Close()
+			h.closeListeners()
+			h.shutdownServers(nil)
+			return err
+		}
+		if spec.Network == "http" {
+			h.serve(l)
+			continue
+		}
+		h.listeners = append(h.listeners, l)
+	}
+
+	for _, l := range h.listeners {
+		if l.pc != nil {
+			h.accepting.Add(1)
+			go h.serveDatagrams(l)
+			continue
+		}
+		h.accepting.Add(h.acceptGoroutines)
+		for i := 0; i < h.acceptGoroutines; i++ {
+			go h.accept(l)
+		}
 	}
-	h.listener = ln
 
-	h.WaitGroup = new(sync.WaitGroup)
-	// accept + handlers + the intercept goroutine
-	h.WaitGroup.Add(h.acceptGoroutines + h.handlerGoroutines + 1)
+	h.interceptingDone = make(chan struct{})
+	go h.interceptErrors()
+	return nil
+}
+
+// Stop gracefully shuts the hub down.
+//
+// It stops accepting new connections right away, but lets the connected
+// clients keep sending messages, and the HTTP requests in flight finish,
+// until ctx is done. Then, their connections are closed, and Stop waits
+// for the messages being handled at that moment.
+// At last, if the Protocol is an io.Closer, it is closed as well, so it
+// gets a chance to deliver whatever it still holds.
+func (h *hub) Stop(ctx context.Context) error {
+	h.Println("Stopping connection hub")
+	close(h.quit)
+	h.closeListeners()
+	h.shutdownServers(ctx)
+	h.accepting.Wait()
 
-	for i := 0; i < h.acceptGoroutines; i++ {
-		go h.accept()
+	handled := make(chan struct{})
+	go func() {
+		h.handling.Wait()
+		close(handled)
+	}()
+	select {
+	case <-handled:
+	case <-ctx.Done():
+		h.Println("Closing", h.sessions.CloseAll(), "remaining connections")
+		<-handled
 	}
 
-	for i := 0; i < h.handlerGoroutines; i++ {
-		go h.openHandlers()
+	close(h.err)
+	<-h.interceptingDone
+
+	for path, f := range h.files {
+		if err := f.Close(); err != nil {
+			h.Println("[ERROR] error while closing", path, "reason:", err)
+		}
 	}
+	if c, ok := h.Protocol.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
 
-	go h.interceptErrors()
+// pipelineFor returns the Protocol behind the pipeline of the listener,
+// and the recorders of its sessions.
+func (h *hub) pipelineFor(spec listenerSpec) (Protocol, []*recorder, error) {
+	pipeline := h.pipeline
+	if spec.Pipeline != "" {
+		// validated when parsing the listener
+		pipeline, _ = parsePipeline(spec.Pipeline)
+	}
+	env := &pipelineEnv{
+		logger:   h.Logger,
+		metrics:  h.metrics,
+		listener: spec.Addr,
+		network:  spec.Network,
+		files:    h.files,
+	}
+	p, err := buildPipeline(h.Protocol, pipeline, env)
+	return p, env.recorders, err
+}
+
+// ReloadCertificates reloads the certificates of the TLS listeners.
+// The connections already established are not affected.
+func (h *hub) ReloadCertificates() error {
+	for _, certs := range h.certificates {
+		if err := certs.Reload(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (h *hub) accept() {
-	for {
-		conn, err := h.listener.Accept()
-		if err != nil {
-			h.err <- err
-			break
+// ReloadDevices reloads the registry of the devices allowed, if any.
+// The devices already identified are not affected.
+func (h *hub) ReloadDevices() error {
+	if h.devices == nil {
+		return nil
+	}
+	return h.devices.Reload()
+}
+
+func (h *hub) closeListeners() {
+	for _, l := range h.listeners {
+		if err := l.Close(); err != nil {
+			h.Println("Got error closing the listener @", l.listenerSpec, ":", err)
 		}
-		h.conns <- conn
 	}
-	h.WaitGroup.Done()
 }
 
-func (h *hub) openHandlers() {
-	for conn := range h.conns {
-		for {
-			msg := make([]byte, 256)
-			var n int
-			var err error
-			if n, err = conn.Read(msg); err != nil {
+func (h *hub) stopping() bool {
+	select {
+	case <-h.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (h *hub) accept(l *listener) {
+	defer h.accepting.Done()
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			if !h.stopping() {
 				h.err <- err
-				conn.Close()
-				break
-			}
-			ret, err := h.Protocol.HandleMessage(msg[:n])
-			if err != nil {
-				h.logDebug("Dropping this message. Reason:", err)
-				continue
-			}
-			if ret == nil {
-				// if we return a nil buffer,
-				// don't even bother.
-				continue
 			}
-			if _, err := conn.Write(ret); err != nil {
-				h.err <- err
-				conn.Close()
-				break
+			return
+		}
+		h.handling.Add(1)
+		go func(a accepted) {
+			defer h.handling.Done()
+			// behind a PROXY balancer, the header is read first, so
+			// the address is the client's (see proxyConn)
+			remote := a.Conn.RemoteAddr()
+			if reason := h.admission.Admit(remote); reason != "" {
+				h.disconnects.Add(reason)
+				h.metrics.Rejected(a.listener.Addr, reason)
+				h.Println("Rejecting connection from", remote, "@", a.listener.listenerSpec, "reason:", reason)
+				a.Conn.Close()
+				return
 			}
+			defer h.admission.Release(remote)
+			h.metrics.Accepted(a.listener.Addr)
+			h.handle(a)
+		}(accepted{conn, l})
+	}
+}
+
+// Disconnects returns how many sessions ended so far, by reason.
+func (h *hub) Disconnects() []disconnectCount {
+	return h.disconnects.Counts()
+}
+
+// Sessions returns the registry of the clients connected to the hub.
+func (h *hub) Sessions() *sessionRegistry {
+	return h.sessions
+}
+
+func (h *hub) handle(a accepted) {
+	certified, err := handshake(a.Conn)
+	if err != nil {
+		// the PROXY header, if any, comes before the handshake
+		if rejected, ok := errors.Cause(err).(rejection); ok {
+			h.disconnects.Add(rejected.reason)
+			h.metrics.Rejected(a.listener.Addr, rejected.reason)
+			h.Println("Closing connection from", a.Conn.RemoteAddr(), "@", a.listener.listenerSpec, "reason:", rejected.reason, rejected.error)
+		} else {
+			h.disconnects.Add(disconnectHandshake)
+			h.logDebug("Closing connection from", a.Conn.RemoteAddr(), "@", a.listener.listenerSpec, "reason:", err)
 		}
+		a.Conn.Close()
+		return
+	}
+	s := h.sessions.Open(a.Conn, a.listener.Addr, a.listener.recorders...)
+	defer h.sessions.Close(s)
+	defer h.recoverSession(s)
+	s.timeouts = h.timeouts
+	if certified != "" {
+		s.Certify()
+		if err := h.identify(s, certified, ""); err != nil {
+			h.disconnected(s, h.disconnectReason(s, err), err)
+			return
+		}
+	}
+
+	r := bufio.NewReaderSize(s, frameBufferSize)
+	codec, err := a.listener.codecFor(r)
+	if err != nil {
+		h.metrics.ParseError(parseUnknownCodec)
+		h.disconnected(s, h.disconnectReason(s, err), err)
+		return
+	}
+	s.SetCodec(codec.Name())
+
+	frames := newFramer(r, codec.Split, h.maxFrameSize)
+	frames.Discarded = func(n int) {
+		h.metrics.ParseError(parseOversize)
+		h.logDebug("Discarding", n, "bytes from", s.RemoteAddr, "exceeding the maximum frame size")
+	}
+	for {
+		msg, err := frames.Next()
+		if err == nil {
+			err = h.handleFrame(s, codec, a.listener, msg)
+		}
+		if err != nil {
+			h.disconnected(s, h.disconnectReason(s, err), err)
+			return
+		}
+	}
+}
+
+// handleFrame handles a frame sent by the client of the session: it is
+// inspected, handed to the Protocol, and then whatever the Protocol
+// returns is written back, along with the acknowledgement the codec
+// expects, if any. It fails when the session should be closed.
+func (h *hub) handleFrame(s *session, codec domain.Codec, l *listener, msg []byte) error {
+	s.Seen(time.Now())
+	h.metrics.Received(l.Addr, codec.Name())
+	secret := ""
+	if authenticator, ok := codec.(domain.Authenticator); ok {
+		secret = authenticator.Secret(msg, l.Banner)
+	}
+	if identifier, anonymous := codec.(domain.Identifier); anonymous && s.DeviceID() == "" {
+		if err := h.identify(s, identifier.Identify(msg, l.Banner), secret); err != nil {
+			return err
+		}
+	}
+	packet, err := codec.Decode(msg)
+	s.packet, s.decodeErr = packet, err
+	if err != nil {
+		h.metrics.ParseError(parseUndecodable)
+		h.logDebug("Could not decode the message from", s.RemoteAddr, "reason:", err)
+	} else if err := h.inspect(s, packet, msg, secret); err != nil {
+		return err
+	}
+
+	var ret []byte
+	// the frames with secrets are kept to ourselves
+	if secret == "" {
+		ret, err = l.protocol.HandleMessage(msg, s)
+		if err != nil {
+			h.logDebug("Dropping this message. Reason:", err)
+			return nil
+		}
+	}
+	if ack, ok := codec.(domain.Acknowledger); ok && packet != nil {
+		ret = append(ack.Ack(msg), ret...)
+	}
+	if len(ret) == 0 {
+		// if we return a nil buffer,
+		// don't even bother.
+		return nil
+	}
+	_, err = s.Write(ret)
+	return err
+}
+
+// recoverSession ends the session whose handling panicked, e.g. on a bug
+// decoding what its client sent, instead of the whole hub.
+func (h *hub) recoverSession(s *session) {
+	if v := recover(); v != nil {
+		h.disconnected(s, disconnectPanic, panicked{v, debug.Stack()})
+	}
+}
+
+// deviceIDReplacer makes device IDs taken from addresses or banners
+// safe to be used as tokens of NATS subjects.
+var deviceIDReplacer = strings.NewReplacer(".", "-", ":", "-", "*", "-", ">", "-", " ", "-", "\t", "-")
+
+// identify identifies the session as the device, once the device is
+// authorized (see Devices) with the secret it presented, if any.
+//
+// The devices speaking a codec that doesn't say which device it is are
+// identified by the ID in their banner or, if they sent none, by their
+// address (e.g. "10-0-0-5" for 10.0.0.5).
+func (h *hub) identify(s *session, deviceID, secret string) error {
+	if deviceID == "" {
+		deviceID = s.RemoteAddr.String()
+		if host, _, err := net.SplitHostPort(deviceID); err == nil {
+			deviceID = host
+		}
+	}
+	deviceID = deviceIDReplacer.Replace(deviceID)
+	if h.devices != nil {
+		if err := h.devices.Authorize(deviceID, secret, s.Certified()); err != nil {
+			return err
+		}
+	}
+	h.logDebug("Device", deviceID, "connected from", s.RemoteAddr)
+	if stale := h.sessions.Identify(s, deviceID); stale != nil {
+		h.Println("Device", deviceID, "reconnected from", s.RemoteAddr, "closing its previous connection from", stale.RemoteAddr)
+	}
+	return nil
+}
+
+// inspect learns which device is on the other end of the session,
+// whether the frame is the reply to a command someone is waiting for,
+// and whether any of the device's alarms went on or off.
+// It fails when the device is not allowed, or is not the one
+// the session identified as before.
+func (h *hub) inspect(s *session, packet domain.Packet, frame []byte, secret string) error {
+	deviceID := deviceIDReplacer.Replace(packet.Device())
+	if s.DeviceID() == "" && deviceID != "" {
+		if err := h.identify(s, deviceID, secret); err != nil {
+			return err
+		}
+	}
+	if deviceID != "" && deviceID != s.DeviceID() {
+		if s.Certified() {
+			return rejection{disconnectSwitchedDevice, errors.Errorf("device %s is not allowed with the certificate of %s", packet.Device(), s.DeviceID())}
+		}
+		return rejection{disconnectSwitchedDevice, errors.Errorf("device %s sent a frame of %s", s.DeviceID(), packet.Device())}
+	}
+
+	if reply, ok := packet.(domain.Reply); ok {
+		if !s.Resolve(reply.ReplyTo(), frame) {
+			h.logDebug("Device", reply.Device(), "replied to", reply.ReplyTo(), "but no one was waiting for it")
+		}
+	}
+
+	if p, ok := packet.(*domain.Position); ok && p.State != nil {
+		previous := s.SetState(p.State)
+		if h.onAlarm == nil {
+			return nil
+		}
+		for _, change := range p.State.AlarmChanges(previous) {
+			h.onAlarm(domain.Alarm{
+				DeviceID: s.DeviceID(),
+				Codec:    p.Codec,
+				Name:     change.Name,
+				Active:   change.Active,
+				DateTime: p.DateTime,
+				Loc:      p.Loc,
+			})
+		}
+	}
+	return nil
+}
+
+// report forwards a connection error to be logged,
+// unless it was caused by the hub closing the connection itself.
+func (h *hub) report(err error) {
+	if !h.stopping() {
+		h.err <- err
 	}
-	h.WaitGroup.Done()
 }
 
 func (h *hub) interceptErrors() {
@@ -195,7 +746,7 @@ func (h *hub) interceptErrors() {
 			h.Println("Got error:", err)
 		}
 	}
-	h.WaitGroup.Done()
+	close(h.interceptingDone)
 }
 
 func (h *hub) logDebug(args ...interface{}) {
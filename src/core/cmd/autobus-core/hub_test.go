@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"domain"
+)
+
+func startTestHub(t testing.TB, p Protocol, options ...hubOption) *hub {
+	options = append([]hubOption{
+		ListenOn("127.0.0.1:0"),
+		AcceptGoroutines(1),
+		WithProtocol(p),
+	}, options...)
+	h, err := NewHub(log.New(ioutil.Discard, "", 0), options...)
+	if err != nil {
+		t.Fatal("Should create the hub:", err)
+	}
+	if err := h.Start(); err != nil {
+		t.Fatal("Should start the hub:", err)
+	}
+	return h
+}
+
+func TestHubStopClosesConnectionsAfterDeadline(t *testing.T) {
+	received := make(chan []byte, 1)
+	closed := make(chan struct{})
+	p := struct {
+		ProtocolFunc
+		closerFunc
+	}{
+		ProtocolFunc(func(msg []byte, _ *session) ([]byte, error) {
+			received <- msg
+			return nil, nil
+		}),
+		closerFunc(func() error {
+			close(closed)
+			return nil
+		}),
+	}
+	h := startTestHub(t, p)
+
+	conn, err := net.Dial("tcp", h.listeners[0].ln.Addr().String())
+	if err != nil {
+		t.Fatal("Should connect to the hub:", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(testFrame))
+	<-received
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := h.Stop(ctx); err != nil {
+		t.Error("Should stop cleanly:", err)
+	}
+
+	select {
+	case <-closed:
+	default:
+		t.Error("Should have closed the protocol")
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Should have closed the client connection")
+	}
+	if _, err := net.Dial("tcp", h.listeners[0].ln.Addr().String()); err == nil {
+		t.Error("Should not accept connections anymore")
+	}
+}
+
+func TestHubRecoversFromPanics(t *testing.T) {
+	received := make(chan []byte, 1)
+	panics := 1
+	h := startTestHub(t, ProtocolFunc(func(msg []byte, _ *session) ([]byte, error) {
+		if panics > 0 {
+			panics--
+			panic("bug")
+		}
+		received <- msg
+		return nil, nil
+	}))
+	defer h.Stop(context.Background())
+
+	conn, err := net.Dial("tcp", h.listeners[0].ln.Addr().String())
+	if err != nil {
+		t.Fatal("Should connect to the hub:", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(testFrame))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Should have closed the session which panicked")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Error("Should have closed the session which panicked in time")
+	}
+
+	// the others go on
+	other, err := net.Dial("tcp", h.listeners[0].ln.Addr().String())
+	if err != nil {
+		t.Fatal("Should still accept connections:", err)
+	}
+	defer other.Close()
+	other.Write([]byte(testFrame))
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("Should still handle frames")
+	}
+	counts := h.Disconnects()
+	if len(counts) != 1 || counts[0].Reason != disconnectPanic || counts[0].Count != 1 {
+		t.Errorf("Expected one disconnect for %s, got %+v", disconnectPanic, counts)
+	}
+	if sessions := h.Sessions().All(); len(sessions) != 1 {
+		t.Errorf("Expected a single session left, got %+v", sessions)
+	}
+}
+
+type closerFunc func() error
+
+func (cf closerFunc) Close() error {
+	return cf()
+}
+
+func TestHubSniffsCodec(t *testing.T) {
+	codecs := make(chan string, 1)
+	h := startTestHub(t, ProtocolFunc(func(msg []byte, from *session) ([]byte, error) {
+		codecs <- from.Codec()
+		return nil, nil
+	}), Listen(listenerSpec{Network: "tcp", Addr: "127.0.0.1:0", Codec: codecAuto}))
+	defer h.Stop(context.Background())
+
+	conn, err := net.Dial("tcp", h.listeners[0].ln.Addr().String())
+	if err != nil {
+		t.Fatal("Should connect to the hub:", err)
+	}
+	conn.Write([]byte(testFrame))
+	conn.Close()
+
+	if codec := <-codecs; codec != "h02" {
+		t.Error("Should have detected h02, has:", codec)
+	}
+}
+
+func TestHubAcknowledgesGT06Login(t *testing.T) {
+	h := startTestHub(t, ProtocolFunc(func([]byte, *session) ([]byte, error) {
+		return nil, nil
+	}), Listen(listenerSpec{Network: "tcp", Addr: "127.0.0.1:0", Codec: "gt06"}))
+	defer h.Stop(context.Background())
+
+	conn, err := net.Dial("tcp", h.listeners[0].ln.Addr().String())
+	if err != nil {
+		t.Fatal("Should connect to the hub:", err)
+	}
+	defer conn.Close()
+	login, _ := hex.DecodeString("78780D01012345678901234500018CDD0D0A")
+	conn.Write(login)
+
+	ack := make([]byte, 10)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		t.Fatal("Should acknowledge the login:", err)
+	}
+	if expected, _ := hex.DecodeString("787805010001D9DC0D0A"); !bytes.Equal(ack, expected) {
+		t.Errorf("Unexpected ack: wanted %X, have %X", expected, ack)
+	}
+	if _, ok := h.Sessions().Lookup("123456789012345"); !ok {
+		t.Error("Should have identified the device")
+	}
+}
+
+func TestHubRaisesAlarms(t *testing.T) {
+	alarms := make(chan domain.Alarm, 4)
+	h := startTestHub(t, ProtocolFunc(func([]byte, *session) ([]byte, error) {
+		return nil, nil
+	}), OnAlarm(func(alarm domain.Alarm) {
+		alarms <- alarm
+	}))
+	defer h.Stop(context.Background())
+
+	conn, err := net.Dial("tcp", h.listeners[0].ln.Addr().String())
+	if err != nil {
+		t.Fatal("Should connect to the hub:", err)
+	}
+	defer conn.Close()
+	// idle, SOS pressed, still pressed, released
+	for _, status := range []string{"FFFFFBFF", "FFFFFBFD", "FFFFFBFD", "FFFFFBFF"} {
+		conn.Write([]byte(strings.Replace(testFrame, "FFFFFBFF", status, 1)))
+	}
+
+	for _, active := range []bool{true, false} {
+		select {
+		case alarm := <-alarms:
+			if alarm.Name != "sos" || alarm.Active != active || alarm.DeviceID != "1400046168" {
+				t.Errorf("Unexpected alarm: %+v", alarm)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Should have raised the alarm")
+		}
+	}
+	select {
+	case alarm := <-alarms:
+		t.Errorf("Should not raise alarms that did not change: %+v", alarm)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestHubIdentifiesNMEADevices(t *testing.T) {
+	devices := make(chan string, 2)
+	h := startTestHub(t, ProtocolFunc(func(msg []byte, from *session) ([]byte, error) {
+		devices <- from.DeviceID()
+		return nil, nil
+	}), Listen(
+		listenerSpec{Network: "tcp", Addr: "127.0.0.1:0", Codec: "nmea", Banner: "ID:"},
+		listenerSpec{Network: "tcp", Addr: "127.0.0.1:0", Codec: "nmea"},
+	))
+	defer h.Stop(context.Background())
+
+	rmc := "$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*6A\r\n"
+	for i, test := range []struct {
+		stream, want string
+		frames       int
+	}{
+		{"ID:bus.42\r\n" + rmc, "bus-42", 2},
+		{rmc, "127-0-0-1", 1},
+	} {
+		conn, err := net.Dial("tcp", h.listeners[i].ln.Addr().String())
+		if err != nil {
+			t.Fatal("Should connect to the hub:", err)
+		}
+		conn.Write([]byte(test.stream))
+		conn.Close()
+		for n := 0; n < test.frames; n++ {
+			select {
+			case device := <-devices:
+				if device != test.want {
+					t.Errorf("Should have identified %s, identified %s", test.want, device)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Should have handled frame", n)
+			}
+		}
+	}
+}
+
+const (
+	idleConnections = 50000
+	// what each idle connection may take, including the client end
+	idleConnectionBudget = 16 << 10
+)
+
+// BenchmarkHubIdleConnections holds 50k idle connections to the hub,
+// reporting the memory each one takes.
+// It needs twice as many file descriptors: see `ulimit -n`.
+func BenchmarkHubIdleConnections(b *testing.B) {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err == nil && limit.Cur < limit.Max {
+		limit.Cur = limit.Max
+		syscall.Setrlimit(syscall.RLIMIT_NOFILE, &limit)
+	}
+	if limit.Cur < 2*idleConnections+100 {
+		b.Skipf("Needs %d file descriptors, the limit is %d", 2*idleConnections+100, limit.Cur)
+	}
+
+	for i := 0; i < b.N; i++ {
+		p := ProtocolFunc(func([]byte, *session) ([]byte, error) {
+			return nil, nil
+		})
+		h := startTestHub(b, p, MaxConnections(idleConnections))
+		addr := h.listeners[0].ln.Addr().(*net.TCPAddr)
+
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+
+		conns := make([]net.Conn, 0, idleConnections)
+		for j := 0; j < idleConnections; j++ {
+			// spread over the loopback addresses, there aren't enough ports in one
+			dialer := net.Dialer{
+				LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, byte(j/10000), 1+byte(j%10000/5000))},
+			}
+			conn, err := dialer.Dial("tcp", addr.String())
+			if err != nil {
+				b.Fatal("Should connect to the hub:", err)
+			}
+			conns = append(conns, conn)
+		}
+		deadline := time.Now().Add(time.Minute)
+		for h.admission.Connected() < idleConnections && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if connected := h.admission.Connected(); connected < idleConnections {
+			b.Fatal("Should hold every connection, holds", connected)
+		}
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		perConn := float64(after.HeapInuse+after.StackInuse-before.HeapInuse-before.StackInuse) / idleConnections
+		b.ReportMetric(perConn, "B/conn")
+		if perConn > idleConnectionBudget {
+			b.Errorf("Each idle connection takes %.0f bytes, over the budget of %d", perConn, idleConnectionBudget)
+		}
+
+		for _, conn := range conns {
+			conn.Close()
+		}
+		h.Stop(context.Background())
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"domain"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// codecAuto makes the listener find out the codec of each
+	// connection, by sniffing the first bytes the client sends.
+	codecAuto = "auto"
+
+	// how many bytes are needed to tell codecs apart
+	sniffLength = 4
+
+	// codecOsmAnd is the codec of the http listeners.
+	codecOsmAnd = "osmand"
+)
+
+// listenerSpec describes a listener of the hub, e.g. "tcp://0.0.0.0:9009?codec=h02".
+// When no codec is given, the listener speaks h02.
+// Listeners of the http network, e.g. "http://0.0.0.0:5055", speak osmand.
+// Listeners of the udp network take each datagram as one or more frames.
+type listenerSpec struct {
+	Network string
+	Addr    string
+	Codec   string
+	// Banner is the prefix of the first line sent by devices identifying
+	// themselves, for codecs whose frames don't (see domain.Identifier),
+	// e.g. "ID:" for devices sending "ID:bus-42" when connecting.
+	Banner string
+	// Cert and Key are the paths of the certificate and key of the listener,
+	// which speaks TLS when they are given. CA is the path of the certificates
+	// clients must present one signed by: the common name of the client
+	// certificate is the only device allowed through the connection.
+	Cert, Key, CA string
+	// Proxy tells whether the connections start with the PROXY header of
+	// the load balancer in front of the listener, giving the address of
+	// the client behind it: "optional" or "strict" (where connections
+	// without one are refused). Empty when there's no balancer speaking it.
+	Proxy string
+	// Pipeline is the pipeline the frames received by the listener go
+	// through before reaching the Protocol (see parsePipeline), instead
+	// of the one of the hub (see Pipeline).
+	Pipeline string
+}
+
+func (ls listenerSpec) String() string {
+	s := ls.Network + "://" + ls.Addr + "?codec=" + ls.Codec
+	if ls.Banner != "" {
+		s += "&banner=" + url.QueryEscape(ls.Banner)
+	}
+	if ls.Cert != "" {
+		s += "&cert=" + url.QueryEscape(ls.Cert) + "&key=" + url.QueryEscape(ls.Key)
+	}
+	if ls.CA != "" {
+		s += "&ca=" + url.QueryEscape(ls.CA)
+	}
+	if ls.Proxy != "" {
+		s += "&proxy=" + ls.Proxy
+	}
+	if ls.Pipeline != "" {
+		s += "&pipeline=" + url.QueryEscape(ls.Pipeline)
+	}
+	return s
+}
+
+func parseListenerSpec(spec string) (ls listenerSpec, err error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return ls, errors.Wrapf(err, "error parsing listener (raw: %s)", spec)
+	}
+	if u.Scheme != "tcp" && u.Scheme != "udp" && u.Scheme != "http" {
+		return ls, errors.Errorf("unsupported listener network %q (raw: %s)", u.Scheme, spec)
+	}
+	if u.Host == "" {
+		return ls, errors.Errorf("missing listener address (raw: %s)", spec)
+	}
+	ls = listenerSpec{
+		Network:  u.Scheme,
+		Addr:     u.Host,
+		Codec:    u.Query().Get("codec"),
+		Banner:   u.Query().Get("banner"),
+		Cert:     u.Query().Get("cert"),
+		Key:      u.Query().Get("key"),
+		CA:       u.Query().Get("ca"),
+		Proxy:    u.Query().Get("proxy"),
+		Pipeline: u.Query().Get("pipeline"),
+	}
+	if (ls.Cert == "") != (ls.Key == "") {
+		return ls, errors.Errorf("TLS listeners need both a certificate and a key (raw: %s)", spec)
+	}
+	if ls.CA != "" && ls.Cert == "" {
+		return ls, errors.Errorf("verifying client certificates needs TLS, a certificate and a key (raw: %s)", spec)
+	}
+	if ls.Network == "udp" && ls.Cert != "" {
+		return ls, errors.Errorf("udp listeners can't speak TLS (raw: %s)", spec)
+	}
+	if ls.Proxy != "" && ls.Proxy != proxyOptional && ls.Proxy != proxyStrict {
+		return ls, errors.Errorf("unknown proxy mode %q, expected %s or %s (raw: %s)", ls.Proxy, proxyOptional, proxyStrict, spec)
+	}
+	if _, err := parsePipeline(ls.Pipeline); err != nil {
+		return ls, errors.Wrapf(err, "invalid listener (raw: %s)", spec)
+	}
+	if ls.Network == "udp" && ls.Proxy != "" {
+		return ls, errors.Errorf("udp listeners can't take PROXY headers (raw: %s)", spec)
+	}
+	if ls.Network == "http" {
+		// the only codec spoken over HTTP
+		if ls.Codec != "" && ls.Codec != codecOsmAnd {
+			return ls, errors.Errorf("http listeners only speak %s (raw: %s)", codecOsmAnd, spec)
+		}
+		ls.Codec = codecOsmAnd
+	}
+	if ls.Codec == "" {
+		ls.Codec = "h02"
+	}
+	if _, ok := domain.LookupCodec(ls.Codec); !ok && ls.Codec != codecAuto {
+		return ls, errors.Errorf("unknown codec %q (raw: %s)", ls.Codec, spec)
+	}
+	return ls, nil
+}
+
+// parseListenerSpecs parses a whitespace separated list of listeners.
+func parseListenerSpecs(specs string) ([]listenerSpec, error) {
+	var all []listenerSpec
+	for _, spec := range strings.Fields(specs) {
+		ls, err := parseListenerSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, ls)
+	}
+	return all, nil
+}
+
+// listener is a listener of the hub, bound to its codec.
+type listener struct {
+	listenerSpec
+	ln    net.Listener
+	certs *certificates
+	// protocol is the Protocol of the hub, behind the pipeline of the listener.
+	protocol Protocol
+	// recorders record the traffic of the sessions of the listener,
+	// as its pipeline says (see the record stage)
+	recorders []*recorder
+	// pc is the connection of udp listeners, which have no ln.
+	pc net.PacketConn
+}
+
+// listen starts listening as described by the spec.
+// The TCP keepalive probes of the connections accepted are sent every
+// keepAlive, or never if it is negative, or as the system sets if it is zero.
+func listen(spec listenerSpec, keepAlive time.Duration) (*listener, error) {
+	l := &listener{listenerSpec: spec}
+	if spec.Network == "udp" {
+		pc, err := net.ListenPacket(spec.Network, spec.Addr)
+		if err != nil {
+			return nil, err
+		}
+		l.pc = pc
+		return l, nil
+	}
+	network := spec.Network
+	if network == "http" {
+		network = "tcp"
+	}
+	ln, err := net.Listen(network, spec.Addr)
+	if err != nil {
+		return nil, err
+	}
+	l.ln = ln
+	if tl, ok := ln.(*net.TCPListener); ok && keepAlive != 0 {
+		l.ln = keepAliveListener{tl, keepAlive}
+	}
+	if spec.Proxy != "" {
+		// the header comes before the TLS handshake
+		l.ln = proxyListener{l.ln, spec.Proxy == proxyStrict}
+	}
+	if spec.Cert != "" {
+		if l.certs, err = loadCertificates(spec.Cert, spec.Key, spec.CA); err != nil {
+			ln.Close()
+			return nil, err
+		}
+		l.ln = tls.NewListener(l.ln, l.certs.Config())
+	}
+	return l, nil
+}
+
+// keepAliveListener sets the TCP keepalive of the connections it accepts.
+type keepAliveListener struct {
+	*net.TCPListener
+	period time.Duration
+}
+
+func (l keepAliveListener) Accept() (net.Conn, error) {
+	conn, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	if l.period < 0 {
+		conn.SetKeepAlive(false)
+		return conn, nil
+	}
+	conn.SetKeepAlive(true)
+	conn.SetKeepAlivePeriod(l.period)
+	return conn, nil
+}
+
+// Close stops listening.
+func (l *listener) Close() error {
+	if l.pc != nil {
+		return l.pc.Close()
+	}
+	return l.ln.Close()
+}
+
+// codecFor returns the codec spoken by the client on the other end of r.
+// If the listener sniffs codecs, the first bytes sent by the client are peeked,
+// but remain available to be read from r.
+func (l *listener) codecFor(r *bufio.Reader) (domain.Codec, error) {
+	if l.Codec != codecAuto {
+		c, _ := domain.LookupCodec(l.Codec)
+		return c, nil
+	}
+	prefix, err := r.Peek(sniffLength)
+	if err != nil {
+		return nil, errors.Wrap(err, "error sniffing codec")
+	}
+	return l.codecForPrefix(prefix)
+}
+
+// codecForPrefix returns the codec of the client that sent prefix first.
+func (l *listener) codecForPrefix(prefix []byte) (domain.Codec, error) {
+	if l.Codec != codecAuto {
+		c, _ := domain.LookupCodec(l.Codec)
+		return c, nil
+	}
+	c, ok := domain.DetectCodec(prefix)
+	if !ok {
+		return nil, errors.Errorf("could not detect codec (prefix: %q)", prefix)
+	}
+	return c, nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestParseListenerSpecs(t *testing.T) {
+	specs, err := parseListenerSpecs("tcp://0.0.0.0:9009  tcp://0.0.0.0:9100?codec=auto\ntcp://0.0.0.0:9200?codec=nmea&banner=ID%3A http://0.0.0.0:5055 udp://0.0.0.0:9009 tcp://0.0.0.0:9300?proxy=strict")
+	if err != nil {
+		t.Fatal("Should not fail with valid listeners:", err)
+	}
+	expected := []listenerSpec{
+		{Network: "tcp", Addr: "0.0.0.0:9009", Codec: "h02"},
+		{Network: "tcp", Addr: "0.0.0.0:9100", Codec: codecAuto},
+		{Network: "tcp", Addr: "0.0.0.0:9200", Codec: "nmea", Banner: "ID:"},
+		{Network: "http", Addr: "0.0.0.0:5055", Codec: codecOsmAnd},
+		{Network: "udp", Addr: "0.0.0.0:9009", Codec: "h02"},
+		{Network: "tcp", Addr: "0.0.0.0:9300", Codec: "h02", Proxy: proxyStrict},
+	}
+	if len(specs) != len(expected) {
+		t.Fatalf("Should have %d listeners, has %d", len(expected), len(specs))
+	}
+	for i := range specs {
+		if specs[i] != expected[i] {
+			t.Errorf("Unexpected listener %d: wanted %v, have %v", i, expected[i], specs[i])
+		}
+	}
+
+	for _, invalid := range []string{"0.0.0.0:9009", "sctp://0.0.0.0:9009", "tcp://0.0.0.0:9009?codec=nope", "http://0.0.0.0:5055?codec=h02", "tcp://0.0.0.0:9443?cert=server.pem", "tcp://0.0.0.0:9443?ca=ca.pem", "udp://0.0.0.0:9443?cert=server.pem&key=server-key.pem", "tcp://0.0.0.0:9009?proxy=yes", "udp://0.0.0.0:9009?proxy=strict"} {
+		if _, err := parseListenerSpecs(invalid); err == nil {
+			t.Error("Should fail with an invalid listener:", invalid)
+		}
+	}
+}
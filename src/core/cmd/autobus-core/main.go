@@ -1,27 +1,82 @@
 package main
 
 import (
+	"context"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"domain"
+)
+
+const (
+	shutdownTimeoutDefault = 5 * time.Second
+	// the admin interface is served locally unless told otherwise,
+	// so that the metrics can always be scraped
+	adminAddrDefault = "127.0.0.1:9010"
 )
 
 var Version string
 
 func main() {
 	hubLogger := log.New(os.Stdout, "hub ", log.LstdFlags)
-	np, err := NewNatsProtocol(os.Getenv("AUTOBUS_CORE_NATS_URL"))
+	instanceID := os.Getenv("AUTOBUS_CORE_INSTANCE_ID")
+	if instanceID == "" {
+		instanceID, _ = os.Hostname()
+	}
+	np, err := NewNatsProtocol(os.Getenv("AUTOBUS_CORE_NATS_URL"), instanceID)
 	if err != nil {
 		panic(err)
 	}
 
 	hubLogger.Println("Version:", Version)
 
+	if dir := os.Getenv("AUTOBUS_CORE_SPOOL_DIR"); dir != "" {
+		maxSize, err := parseIntFromEnv("AUTOBUS_CORE_SPOOL_MAX_SIZE", spoolMaxSizeDefault)
+		if err != nil {
+			panic(err)
+		}
+		if err := np.SpoolTo(dir, int64(maxSize)); err != nil {
+			panic(err)
+		}
+		stats, _ := np.SpoolStats()
+		hubLogger.Println("Spooling to", dir, "holding", stats.Depth, "messages")
+	}
+
+	shutdownTimeout, err := parseDurationFromEnv("AUTOBUS_CORE_SHUTDOWN_TIMEOUT", shutdownTimeoutDefault)
+	if err != nil {
+		panic(err)
+	}
+	commandTimeout, err := parseDurationFromEnv("AUTOBUS_CORE_COMMAND_TIMEOUT", commandTimeoutDefault)
+	if err != nil {
+		panic(err)
+	}
+
+	m := newMetrics()
 	h, err := NewHub(hubLogger,
 		DebugFromEnv("AUTOBUS_CORE_DEBUG"),
-		ListenFromEnv("AUTOBUS_CORE_TCP_HOST"),
+		ListenersFromEnv("AUTOBUS_CORE_LISTENERS", "AUTOBUS_CORE_TCP_HOST"),
 		AcceptGoroutinesFromEnv("AUTOBUS_CORE_ACCEPT"),
-		HandlerGoroutinesFromEnv("AUTOBUS_CORE_HANDLERS"),
-		WithProtocol(np),
+		MaxConnectionsFromEnv("AUTOBUS_CORE_MAX_CONNECTIONS", "AUTOBUS_CORE_HANDLERS"),
+		MaxConnectionsPerIPFromEnv("AUTOBUS_CORE_MAX_CONNECTIONS_PER_IP"),
+		MaxFrameSizeFromEnv("AUTOBUS_CORE_MAX_FRAME_SIZE"),
+		ReadTimeoutFromEnv("AUTOBUS_CORE_READ_TIMEOUT"),
+		IdleTimeoutFromEnv("AUTOBUS_CORE_IDLE_TIMEOUT"),
+		MaxSessionLifetimeFromEnv("AUTOBUS_CORE_MAX_SESSION_LIFETIME"),
+		KeepAliveFromEnv("AUTOBUS_CORE_KEEPALIVE"),
+		DevicesFromEnv("AUTOBUS_CORE_DEVICES"),
+		PipelineFromEnv("AUTOBUS_CORE_PIPELINE"),
+		OnAlarm(func(alarm domain.Alarm) {
+			hubLogger.Println("Device", alarm.DeviceID, "alarm", alarm.Name, "active:", alarm.Active)
+			if err := np.PublishAlarm(alarm); err != nil {
+				hubLogger.Println("[ERROR] error while publishing the alarm:", err)
+			}
+		}),
+		WithMetrics(m),
+		WithProtocol(Decorate(np, Instrument(m))),
 	)
 	if err != nil {
 		panic(err)
@@ -30,5 +85,48 @@ func main() {
 	if err := h.Start(); err != nil {
 		panic(err)
 	}
-	h.Wait()
+	if err := np.ServeCommands(h.Sessions(), commandTimeout); err != nil {
+		panic(err)
+	}
+
+	adminAddr, ok := os.LookupEnv("AUTOBUS_CORE_ADMIN_ADDR")
+	if !ok {
+		adminAddr = adminAddrDefault
+	}
+	var admin *http.Server
+	if adminAddr != "" {
+		admin = NewAdminServer(adminAddr, h, np, m)
+		go func() {
+			hubLogger.Println("Starting admin interface @", adminAddr)
+			if err := admin.ListenAndServe(); err != http.ErrServerClosed {
+				hubLogger.Println("[ERROR] admin interface stopped:", err)
+			}
+		}()
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for s := range sig {
+		if s != syscall.SIGHUP {
+			break
+		}
+		hubLogger.Println("reloading the TLS certificates...")
+		if err := h.ReloadCertificates(); err != nil {
+			hubLogger.Println("[ERROR] error while reloading the TLS certificates, keeping the previous ones:", err)
+		}
+		hubLogger.Println("reloading the devices...")
+		if err := h.ReloadDevices(); err != nil {
+			hubLogger.Println("[ERROR] error while reloading the devices, keeping the previous ones:", err)
+		}
+	}
+	hubLogger.Println("shutting autobus-core down...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := h.Stop(ctx); err != nil {
+		hubLogger.Println("[ERROR] error while stopping the hub:", err)
+	}
+	if admin != nil {
+		admin.Close()
+	}
 }
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Why frames could not be parsed.
+const (
+	// the frame exceeded the maximum frame size, and was discarded
+	parseOversize = "oversize"
+	// the codec of the client could not be sniffed (see codecAuto),
+	// and what it sent was discarded
+	parseUnknownCodec = "unknown_codec"
+	// the codec could not decode the frame, which is handled anyway
+	parseUndecodable = "undecodable"
+)
+
+// publishLatencyBuckets are the upper bounds, in seconds,
+// of the buckets of the publish latency histogram.
+var publishLatencyBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+
+// metrics are the measures of the hub, served in the text format of
+// Prometheus at GET /metrics of the admin interface (see writeMetrics).
+//
+// The publishing is measured by the Instrument decorator, the connections
+// and the frames by the hub (see WithMetrics). A nil *metrics measures nothing.
+type metrics struct {
+	// by listener
+	accepted counterVec
+	// by listener and reason
+	rejected counterVec
+	// by listener and codec
+	frames counterVec
+	// by reason
+	parseErrors counterVec
+	// by codec
+	publishErrors  counterVec
+	publishLatency histogram
+	// by listener, stage and outcome (see pipeline)
+	stages counterVec
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		publishLatency: histogram{buckets: publishLatencyBuckets},
+	}
+}
+
+// Accepted counts a connection accepted by the listener.
+func (m *metrics) Accepted(listener string) {
+	if m != nil {
+		m.accepted.Inc(labels{listener})
+	}
+}
+
+// Rejected counts a connection, or an HTTP request, the listener refused.
+func (m *metrics) Rejected(listener, reason string) {
+	if m != nil {
+		m.rejected.Inc(labels{listener, reason})
+	}
+}
+
+// Received counts a frame received by the listener, in the codec.
+func (m *metrics) Received(listener, codec string) {
+	if m != nil {
+		m.frames.Inc(labels{listener, codec})
+	}
+}
+
+// ParseError counts a frame which could not be parsed.
+func (m *metrics) ParseError(reason string) {
+	if m != nil {
+		m.parseErrors.Inc(labels{reason})
+	}
+}
+
+// Staged counts a frame going through a stage of the pipeline of the listener.
+func (m *metrics) Staged(listener, stage, outcome string) {
+	if m != nil {
+		m.stages.Inc(labels{listener, stage, outcome})
+	}
+}
+
+// Instrument measures the frames handled by the Protocol: how long it took
+// to publish them, and how many it failed to. Without metrics, the Protocol
+// is left as it is.
+func Instrument(m *metrics) Decorator {
+	return func(p Protocol) Protocol {
+		if m == nil {
+			return p
+		}
+		return ProtocolFunc(func(msg []byte, from *session) ([]byte, error) {
+			start := time.Now()
+			ret, err := p.HandleMessage(msg, from)
+			m.publishLatency.Observe(time.Since(start).Seconds())
+			if err != nil {
+				m.publishErrors.Inc(labels{from.Codec()})
+			}
+			return ret, err
+		})
+	}
+}
+
+// labels are the values of the labels of a sample, in the order of their names.
+type labels [3]string
+
+// counterVec counts by labels.
+type counterVec struct {
+	mu     sync.Mutex
+	counts map[labels]uint64
+}
+
+func (c *counterVec) Inc(l labels) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[labels]uint64)
+	}
+	c.counts[l]++
+}
+
+// Counts returns the counts, sorted by labels.
+func (c *counterVec) Counts() (all []labels, counts []uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for l := range c.counts {
+		all = append(all, l)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		for k := range all[i] {
+			if all[i][k] != all[j][k] {
+				return all[i][k] < all[j][k]
+			}
+		}
+		return false
+	})
+	for _, l := range all {
+		counts = append(counts, c.counts[l])
+	}
+	return all, counts
+}
+
+// histogram counts observations into buckets.
+type histogram struct {
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.counts == nil {
+		h.counts = make([]uint64, len(h.buckets))
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// snapshot returns the cumulative counts of the buckets, the count and the sum.
+func (h *histogram) snapshot() (cumulative []uint64, count uint64, sum float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	cumulative = make([]uint64, len(h.buckets))
+	var total uint64
+	for i := range h.buckets {
+		if h.counts != nil {
+			total += h.counts[i]
+		}
+		cumulative[i] = total
+	}
+	return cumulative, h.count, h.sum
+}
+
+// writeMetrics writes the metrics of the hub in the text format of Prometheus.
+// np may be nil.
+func writeMetrics(w io.Writer, m *metrics, h *hub, np *NatsProtocol) error {
+	mw := &metricsWriter{w: bufio.NewWriter(w)}
+
+	traffic := h.Sessions().Traffic()
+	mw.header("autobus_core_connections", "gauge", "Clients connected, by listener.")
+	for _, t := range traffic {
+		mw.sample("autobus_core_connections", []string{"listener"}, labels{t.Listener}, float64(t.Sessions))
+	}
+	mw.counterVec("autobus_core_connections_accepted_total", "Connections accepted, by listener.", []string{"listener"}, &m.accepted)
+	mw.counterVec("autobus_core_connections_rejected_total", "Connections and requests refused, by listener and reason.", []string{"listener", "reason"}, &m.rejected)
+	mw.header("autobus_core_disconnects_total", "counter", "Sessions ended, by reason.")
+	for _, count := range h.Disconnects() {
+		mw.sample("autobus_core_disconnects_total", []string{"reason"}, labels{count.Reason}, float64(count.Count))
+	}
+
+	mw.counterVec("autobus_core_frames_received_total", "Frames received, by listener and codec.", []string{"listener", "codec"}, &m.frames)
+	mw.counterVec("autobus_core_parse_errors_total", "Frames which could not be parsed, by reason.", []string{"reason"}, &m.parseErrors)
+	mw.header("autobus_core_received_bytes_total", "counter", "Bytes received from clients, by listener.")
+	for _, t := range traffic {
+		mw.sample("autobus_core_received_bytes_total", []string{"listener"}, labels{t.Listener}, float64(t.BytesIn))
+	}
+	mw.header("autobus_core_sent_bytes_total", "counter", "Bytes sent to clients, by listener.")
+	for _, t := range traffic {
+		mw.sample("autobus_core_sent_bytes_total", []string{"listener"}, labels{t.Listener}, float64(t.BytesOut))
+	}
+
+	mw.counterVec("autobus_core_pipeline_frames_total", "Frames through the stages of the pipelines, by listener, stage and outcome.", []string{"listener", "stage", "outcome"}, &m.stages)
+	mw.histogram("autobus_core_publish_duration_seconds", "How long publishing a frame took.", &m.publishLatency)
+	mw.counterVec("autobus_core_publish_errors_total", "Frames which could not be published, by codec.", []string{"codec"}, &m.publishErrors)
+	if np != nil {
+		if stats, ok := np.SpoolStats(); ok {
+			mw.header("autobus_core_spool_messages", "gauge", "Messages spooled while NATS is unreachable.")
+			mw.sample("autobus_core_spool_messages", nil, labels{}, float64(stats.Depth))
+			mw.header("autobus_core_spool_bytes", "gauge", "Bytes the spool takes on disk.")
+			mw.sample("autobus_core_spool_bytes", nil, labels{}, float64(stats.Bytes))
+			mw.header("autobus_core_spool_dropped_total", "counter", "Messages dropped because the spool was full.")
+			mw.sample("autobus_core_spool_dropped_total", nil, labels{}, float64(stats.Dropped))
+		}
+	}
+
+	mw.header("go_goroutines", "gauge", "Number of goroutines that currently exist.")
+	mw.sample("go_goroutines", nil, labels{}, float64(runtime.NumGoroutine()))
+	if mw.err != nil {
+		return mw.err
+	}
+	return mw.w.Flush()
+}
+
+// metricsWriter writes metrics in the text format of Prometheus,
+// keeping the first error.
+type metricsWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (mw *metricsWriter) printf(format string, args ...interface{}) {
+	if mw.err == nil {
+		_, mw.err = fmt.Fprintf(mw.w, format, args...)
+	}
+}
+
+func (mw *metricsWriter) header(name, kind, help string) {
+	mw.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (mw *metricsWriter) sample(name string, names []string, values labels, v float64) {
+	var pairs []string
+	for i, n := range names {
+		pairs = append(pairs, n+`="`+labelReplacer.Replace(values[i])+`"`)
+	}
+	if len(pairs) > 0 {
+		name += "{" + strings.Join(pairs, ",") + "}"
+	}
+	mw.printf("%s %s\n", name, formatSample(v))
+}
+
+func (mw *metricsWriter) counterVec(name, help string, names []string, c *counterVec) {
+	mw.header(name, "counter", help)
+	all, counts := c.Counts()
+	for i, l := range all {
+		mw.sample(name, names, l, float64(counts[i]))
+	}
+}
+
+func (mw *metricsWriter) histogram(name, help string, h *histogram) {
+	mw.header(name, "histogram", help)
+	cumulative, count, sum := h.snapshot()
+	for i, bound := range h.buckets {
+		mw.sample(name+"_bucket", []string{"le"}, labels{formatSample(bound)}, float64(cumulative[i]))
+	}
+	mw.sample(name+"_bucket", []string{"le"}, labels{"+Inf"}, float64(count))
+	mw.sample(name+"_sum", nil, labels{}, sum)
+	mw.sample(name+"_count", nil, labels{}, float64(count))
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatSample(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
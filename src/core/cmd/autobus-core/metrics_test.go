@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestHubMetrics(t *testing.T) {
+	m := newMetrics()
+	var failing int32
+	h := startTestHub(t, Decorate(ProtocolFunc(func(msg []byte, from *session) ([]byte, error) {
+		if atomic.LoadInt32(&failing) == 1 {
+			return nil, errors.New("NATS is down")
+		}
+		return nil, nil
+	}), Instrument(m)), WithMetrics(m), MaxFrameSize(len(testFrame)))
+	defer h.Stop(context.Background())
+	addr := h.listeners[0].ln.Addr().String()
+
+	send := func(stream string) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal("Should connect to the hub:", err)
+		}
+		conn.Write([]byte(stream))
+		conn.(*net.TCPConn).CloseWrite()
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		ioutil.ReadAll(conn)
+		conn.Close()
+	}
+	send(testFrame + "*HQ," + strings.Repeat("x", len(testFrame)) + "#" + testFrame)
+	atomic.StoreInt32(&failing, 1)
+	send(testFrame)
+	deadline := time.Now().Add(time.Second)
+	for h.admission.Connected() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var buf bytes.Buffer
+	if err := writeMetrics(&buf, m, h, nil); err != nil {
+		t.Fatal("Should write the metrics:", err)
+	}
+	for _, expected := range []string{
+		`autobus_core_connections{listener="127.0.0.1:0"} 0`,
+		`autobus_core_connections_accepted_total{listener="127.0.0.1:0"} 2`,
+		`autobus_core_disconnects_total{reason="eof"} 2`,
+		`autobus_core_frames_received_total{listener="127.0.0.1:0",codec="h02"} 3`,
+		`autobus_core_parse_errors_total{reason="oversize"} 1`,
+		`autobus_core_received_bytes_total{listener="127.0.0.1:0"} ` + strconv.Itoa(4*len(testFrame)+5),
+		`autobus_core_publish_duration_seconds_bucket{le="+Inf"} 3`,
+		`autobus_core_publish_duration_seconds_count 3`,
+		`autobus_core_publish_errors_total{codec="h02"} 1`,
+		"# TYPE autobus_core_publish_duration_seconds histogram",
+		"go_goroutines ",
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("Should have %q in the metrics:\n%s", expected, buf.String())
+		}
+	}
+}
+
+func TestDecorateKeepsCloser(t *testing.T) {
+	closed := false
+	p := struct {
+		ProtocolFunc
+		closerFunc
+	}{
+		ProtocolFunc(func(msg []byte, _ *session) ([]byte, error) { return nil, nil }),
+		closerFunc(func() error {
+			closed = true
+			return nil
+		}),
+	}
+	decorated := Decorate(p, Instrument(newMetrics()))
+	c, ok := decorated.(io.Closer)
+	if !ok {
+		t.Fatal("Should close the decorated protocol")
+	}
+	c.Close()
+	if !closed {
+		t.Error("Should have closed the decorated protocol")
+	}
+}
+
+func TestInstrumentWithoutMetrics(t *testing.T) {
+	p := ProtocolFunc(func(msg []byte, _ *session) ([]byte, error) {
+		return []byte("OK"), nil
+	})
+	conn, client := net.Pipe()
+	defer client.Close()
+	s := newSessionRegistry().Open(conn, "0.0.0.0:9009")
+	if ret, err := Decorate(p, Instrument(nil)).HandleMessage([]byte(testFrame), s); err != nil || string(ret) != "OK" {
+		t.Errorf("Should handle the frame as the protocol does, got %q, %v", ret, err)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"domain"
+	"web"
+
+	"github.com/nats-io/nats"
+	"github.com/pkg/errors"
+)
+
+const (
+	// commands are published to gps.command.<deviceID>
+	SubjectCommand string = "gps.command"
+
+	commandTimeoutDefault = 30 * time.Second
+)
+
+// commandRequest is the payload of the messages published on SubjectCommand.
+// e.g. {"command": "S71", "args": ["22", "60"]}
+type commandRequest struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+}
+
+// ServeCommands subscribes to the commands addressed to the devices,
+// and writes them to the devices' connections.
+//
+// If the command was sent as a request, the device's reply is sent back
+// as the response, or an error if the device is not connected or does
+// not reply before timeout. The devices speaking a codec whose replies
+// can't be told apart (see domain.Replier) are not waited for: the
+// response only says the command was written.
+func (np *NatsProtocol) ServeCommands(sessions *sessionRegistry, timeout time.Duration) error {
+	_, err := np.client.Subscribe(SubjectCommand+".*", func(m *nats.Msg) {
+		// waiting for the reply blocks, and we don't want a slow device
+		// to hold the commands sent to all the others
+		go np.deliverCommand(m, sessions, timeout)
+	})
+	return errors.Wrap(err, "error subscribing to commands")
+}
+
+func (np *NatsProtocol) deliverCommand(m *nats.Msg, sessions *sessionRegistry, timeout time.Duration) {
+	deviceID := strings.TrimPrefix(m.Subject, SubjectCommand+".")
+
+	var req commandRequest
+	if err := json.Unmarshal(m.Data, &req); err != nil {
+		np.respondError(m, errors.Wrap(err, "error decoding command"), http.StatusBadRequest)
+		return
+	}
+
+	s, ok := sessions.Lookup(deviceID)
+	if !ok {
+		np.respondError(m, errors.Errorf("device %s is not connected", deviceID), http.StatusNotFound)
+		return
+	}
+
+	name := s.Codec()
+	codec, ok := domain.LookupCodec(name)
+	if !ok {
+		np.respondError(m, errors.Errorf("device %s speaks an unknown codec %q", deviceID, name), http.StatusNotImplemented)
+		return
+	}
+	command := &domain.Command{
+		DeviceID: deviceID,
+		Name:     req.Command,
+		Args:     req.Args,
+		DateTime: time.Now(),
+	}
+	raw, err := codec.Encode(command)
+	if err != nil {
+		np.respondError(m, errors.Wrap(err, "error encoding command"), http.StatusBadRequest)
+		return
+	}
+
+	replier, ok := codec.(domain.Replier)
+	if !ok {
+		// there's no telling whether the device got it
+		if _, err := s.Write(raw); err != nil {
+			np.respondError(m, errors.Wrap(err, "error writing command to the device"), http.StatusBadGateway)
+			return
+		}
+		np.respond(m, web.Response{OK: true, Status: http.StatusAccepted})
+		return
+	}
+	reply, cancel := s.Await(replier.ReplyKey(command))
+	defer cancel()
+	if _, err := s.Write(raw); err != nil {
+		np.respondError(m, errors.Wrap(err, "error writing command to the device"), http.StatusBadGateway)
+		return
+	}
+
+	select {
+	case frame := <-reply:
+		data := string(frame)
+		if !utf8.Valid(frame) {
+			// the binary codecs, e.g. gt06
+			data = hex.EncodeToString(frame)
+		}
+		np.respond(m, web.Response{
+			OK:     true,
+			Status: http.StatusOK,
+			Data:   data,
+		})
+	case <-time.After(timeout):
+		np.respondError(m, errors.Errorf("device %s did not reply to %s in %s", deviceID, req.Command, timeout), http.StatusGatewayTimeout)
+	}
+}
+
+func (np *NatsProtocol) respondError(m *nats.Msg, err error, status int) {
+	np.respond(m, web.Response{
+		OK:      false,
+		Status:  status,
+		Message: err.Error(),
+	})
+}
+
+// respond replies to m, if it was sent as a request.
+func (np *NatsProtocol) respond(m *nats.Msg, r web.Response) {
+	if m.Reply == "" {
+		return
+	}
+	if r.Message == "" {
+		r.Message = http.StatusText(r.Status)
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	np.client.Publish(m.Reply, b)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"domain"
+	"web"
+
+	"github.com/nats-io/gnatsd/server"
+	"github.com/nats-io/gnatsd/test"
+	"github.com/nats-io/nats"
+)
+
+const testCommandReply = "*HQ,1400046168,V4,S71,22,60,130305,130307,A,2234.3066,N,11351.6829,E,000.0,000,080813,FFFFFBFF#"
+
+// startTestCommands serves the commands addressed to the devices connected
+// to h, through a NATS server of its own, and returns a client to send them.
+func startTestCommands(t *testing.T, h *hub, timeout time.Duration) (*nats.Conn, func()) {
+	srv := test.RunServer(&server.Options{Host: "127.0.0.1", Port: server.RANDOM_PORT, NoLog: true, NoSigs: true})
+	nc, err := nats.Connect("nats://" + srv.Addr().String())
+	if err != nil {
+		srv.Shutdown()
+		t.Fatal("Should connect to NATS:", err)
+	}
+	np := &NatsProtocol{client: nc}
+	if err := np.ServeCommands(h.Sessions(), timeout); err != nil {
+		t.Fatal("Should serve the commands:", err)
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatal("Should subscribe to the commands:", err)
+	}
+	return nc, func() {
+		nc.Close()
+		srv.Shutdown()
+	}
+}
+
+func sendTestCommand(t *testing.T, nc *nats.Conn, deviceID, command string) web.Response {
+	msg, err := nc.Request(SubjectCommand+"."+deviceID, []byte(`{"command": "`+command+`", "args": ["22", "60"]}`), 5*time.Second)
+	if err != nil {
+		t.Fatal("Should answer the command:", err)
+	}
+	var r web.Response
+	if err := json.Unmarshal(msg.Data, &r); err != nil {
+		t.Fatalf("Unexpected response %q: %v", msg.Data, err)
+	}
+	return r
+}
+
+func waitForDevice(t *testing.T, h *hub, deviceID string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := h.Sessions().Lookup(deviceID); ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Should have identified the device", deviceID)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCommandsDelivery(t *testing.T) {
+	h := startTestHub(t, ProtocolFunc(func([]byte, *session) ([]byte, error) {
+		return nil, nil
+	}))
+	defer h.Stop(context.Background())
+	nc, stop := startTestCommands(t, h, 200*time.Millisecond)
+	defer stop()
+
+	conn, err := net.Dial("tcp", h.listeners[0].ln.Addr().String())
+	if err != nil {
+		t.Fatal("Should connect to the hub:", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(testFrame))
+	waitForDevice(t, h, "1400046168")
+
+	// the device replies to S71 only
+	commands := make(chan string, 2)
+	go func() {
+		r := bufio.NewReader(conn)
+		for {
+			command, err := r.ReadString('#')
+			if err != nil {
+				close(commands)
+				return
+			}
+			commands <- command
+			if strings.HasPrefix(command, "*HQ,1400046168,S71,") {
+				conn.Write([]byte(testCommandReply))
+			}
+		}
+	}()
+
+	if r := sendTestCommand(t, nc, "1400046168", "S71"); !r.OK || r.Status != http.StatusOK || r.Data != testCommandReply {
+		t.Errorf("Should respond with the reply of the device, has %+v", r)
+	}
+	if command := <-commands; !strings.HasSuffix(command, ",22,60#") {
+		t.Errorf("Unexpected command written to the device: %q", command)
+	}
+
+	if r := sendTestCommand(t, nc, "1400046168", "S20"); r.OK || r.Status != http.StatusGatewayTimeout {
+		t.Errorf("Should time out waiting for a reply, has %+v", r)
+	}
+	if command := <-commands; !strings.HasPrefix(command, "*HQ,1400046168,S20,") {
+		t.Errorf("Unexpected command written to the device: %q", command)
+	}
+
+	if r := sendTestCommand(t, nc, "1400046169", "S71"); r.OK || r.Status != http.StatusNotFound {
+		t.Errorf("Should not find the device, has %+v", r)
+	}
+}
+
+// silentCodec speaks h02, but can't tell the replies to commands apart.
+type silentCodec struct {
+	domain.Codec
+}
+
+func (silentCodec) Name() string {
+	return "silent"
+}
+
+func (silentCodec) Detect([]byte) bool {
+	return false
+}
+
+func init() {
+	h02, _ := domain.LookupCodec("h02")
+	domain.RegisterCodec(silentCodec{h02})
+}
+
+func TestCommandsWithoutReplies(t *testing.T) {
+	h := startTestHub(t, ProtocolFunc(func([]byte, *session) ([]byte, error) {
+		return nil, nil
+	}), Listen(listenerSpec{Network: "tcp", Addr: "127.0.0.1:0", Codec: "silent"}))
+	defer h.Stop(context.Background())
+	nc, stop := startTestCommands(t, h, time.Minute)
+	defer stop()
+
+	conn, err := net.Dial("tcp", h.listeners[0].ln.Addr().String())
+	if err != nil {
+		t.Fatal("Should connect to the hub:", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(testFrame))
+	waitForDevice(t, h, "1400046168")
+
+	if r := sendTestCommand(t, nc, "1400046168", "S71"); !r.OK || r.Status != http.StatusAccepted {
+		t.Errorf("Should respond once the command is written, has %+v", r)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if command, err := bufio.NewReader(conn).ReadString('#'); err != nil || !strings.HasPrefix(command, "*HQ,1400046168,S71,") {
+		t.Errorf("Should have written the command to the device, wrote %q: %v", command, err)
+	}
+}
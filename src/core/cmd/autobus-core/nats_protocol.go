@@ -1,28 +1,115 @@
 package main
 
-import "github.com/nats-io/nats"
+import (
+	"encoding/json"
+	"time"
+
+	"domain"
+
+	"github.com/nats-io/nats"
+)
 
 type NatsProtocol struct {
 	client *nats.Conn
+	// tells which core received the frames, in their envelopes
+	instanceID string
+	// holds on to the messages while NATS is unreachable, if set
+	spool *spool
 }
 
 const (
-	SubjectMessageReceived string = "gps.update"
+	// frames are published, in envelopes (see domain.Envelope), to gps.update.<codec>.<deviceID>,
+	// or to gps.update.<codec> while the device is not identified (see domain.UpdateSubject).
+	SubjectMessageReceived string = domain.SubjectUpdate
+
+	// alarms going on or off are published, as JSON, to gps.alarm.
+	SubjectAlarm string = "gps.alarm"
+
+	// how long to wait for NATS to acknowledge
+	// the published messages when closing.
+	natsFlushTimeout = 5 * time.Second
 )
 
-func (np *NatsProtocol) HandleMessage(msg []byte) ([]byte, error) {
-	if err := np.client.Publish(SubjectMessageReceived, msg); err != nil {
+func (np *NatsProtocol) HandleMessage(msg []byte, from *session) ([]byte, error) {
+	subject := domain.UpdateSubject(from.Codec(), from.DeviceID())
+	envelope := domain.Envelope{
+		Frame:        msg,
+		ReceivedAt:   time.Now().UnixNano(),
+		ConnectionID: from.ID,
+		RemoteAddr:   from.RemoteAddr.String(),
+		Listener:     from.Listener,
+		Codec:        from.Codec(),
+		DeviceID:     from.DeviceID(),
+		InstanceID:   np.instanceID,
+	}
+	data, err := envelope.Seal()
+	if err != nil {
+		return nil, err
+	}
+	if err := np.publish(subject, data); err != nil {
 		return nil, err
 	}
 	return nil, nil
 }
 
-func NewNatsProtocol(urls string) (Protocol, error) {
-	nc, err := nats.Connect(urls)
+func (np *NatsProtocol) publish(subject string, data []byte) error {
+	if np.spool != nil {
+		return np.spool.Publish(subject, data)
+	}
+	return np.client.Publish(subject, data)
+}
+
+// SpoolTo makes the protocol spool the messages to dir while NATS is
+// unreachable, and publish them once it is back. The spool takes no more
+// than maxBytes: the messages that don't fit are dropped.
+func (np *NatsProtocol) SpoolTo(dir string, maxBytes int64) error {
+	s, err := openSpool(dir, maxBytes, np.client)
+	if err != nil {
+		return err
+	}
+	np.spool = s
+	return nil
+}
+
+// SpoolStats returns how much the spool holds, and false if there's no spool.
+func (np *NatsProtocol) SpoolStats() (spoolStats, bool) {
+	if np.spool == nil {
+		return spoolStats{}, false
+	}
+	return np.spool.Stats(), true
+}
+
+// PublishAlarm publishes the alarm to SubjectAlarm.
+func (np *NatsProtocol) PublishAlarm(alarm domain.Alarm) error {
+	data, err := json.Marshal(alarm)
+	if err != nil {
+		return err
+	}
+	return np.publish(SubjectAlarm, data)
+}
+
+// Close closes the spool, flushes the messages still buffered by the client,
+// and closes the connection to NATS.
+func (np *NatsProtocol) Close() error {
+	defer np.client.Close()
+	if np.spool != nil {
+		if err := np.spool.Close(); err != nil {
+			return err
+		}
+	}
+	return np.client.FlushTimeout(natsFlushTimeout)
+}
+
+// NewNatsProtocol connects to NATS. The frames are published in envelopes
+// (see domain.Envelope) saying they were received by instanceID.
+func NewNatsProtocol(urls, instanceID string) (*NatsProtocol, error) {
+	// never give up reconnecting: the hub is useless without NATS
+	nc, err := nats.Connect(urls, nats.MaxReconnects(-1))
 	if err != nil {
 		return nil, err
 	}
 	return &NatsProtocol{
-		client: nc,
+		client:     nc,
+		instanceID: instanceID,
 	}, nil
 }
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The outcomes of the frames going through a stage of a pipeline.
+const (
+	stagePassed  = "passed"
+	stageDropped = "dropped"
+)
+
+// stage is a stage of a pipeline, e.g. "ratelimit:10/m".
+type stage struct {
+	Name, Arg string
+	build     stageBuilder
+}
+
+// stageBuilder builds the Decorator of a stage, for a listener.
+type stageBuilder func(env *pipelineEnv) (Decorator, error)
+
+// pipelineEnv is what the stages of the pipelines of the hub share.
+type pipelineEnv struct {
+	logger   *log.Logger
+	metrics  *metrics
+	listener string
+	network  string
+	// the files written to, by path, since the stages of several
+	// listeners may write to the same one
+	files map[string]io.Closer
+	// the recorders of the sessions of the listener (see the record stage)
+	recorders []*recorder
+}
+
+// stages parse the argument of each stage, by name.
+var stages = map[string]func(arg string) (stageBuilder, error){
+	"log":       parseLogStage,
+	"sample":    parseSampleStage,
+	"ratelimit": parseRateLimitStage,
+	"record":    parseRecordStage,
+	"validate":  parseValidateStage,
+	"tee":       parseTeeStage,
+	"drop":      parseDropStage,
+}
+
+// parsePipeline parses a comma separated list of stages, in the order they
+// see the frames, each one a name optionally followed by a colon and its
+// argument, e.g. "validate,drop:666|667,ratelimit:10/m,tee:/var/log/frames.jsonl".
+func parsePipeline(pipeline string) ([]stage, error) {
+	var all []stage
+	for _, raw := range strings.Split(pipeline, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		s := stage{Name: raw}
+		if i := strings.Index(raw, ":"); i >= 0 {
+			s.Name, s.Arg = raw[:i], raw[i+1:]
+		}
+		parse, ok := stages[s.Name]
+		if !ok {
+			return nil, errors.Errorf("unknown pipeline stage %q (raw: %s)", s.Name, pipeline)
+		}
+		build, err := parse(s.Arg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid pipeline stage %q (raw: %s)", raw, pipeline)
+		}
+		s.build = build
+		all = append(all, s)
+	}
+	return all, nil
+}
+
+// buildPipeline decorates root with the stages, so that the first one
+// sees the frames first.
+func buildPipeline(root Protocol, pipeline []stage, env *pipelineEnv) (Protocol, error) {
+	decorators := make([]Decorator, len(pipeline))
+	for i, s := range pipeline {
+		d, err := s.build(env)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error building the pipeline stage %s", s.Name)
+		}
+		decorators[len(pipeline)-1-i] = d
+	}
+	return Decorate(root, decorators...), nil
+}
+
+// file returns the file at path, opening it if no stage did yet.
+func (env *pipelineEnv) file(path string, open func() (io.Closer, error)) (io.Closer, error) {
+	if f, ok := env.files[path]; ok {
+		return f, nil
+	}
+	f, err := open()
+	if err != nil {
+		return nil, err
+	}
+	env.files[path] = f
+	return f, nil
+}
+
+// filter returns the Decorator of the stage, handing on the frames keep
+// keeps and dropping the others, and counting both.
+func (env *pipelineEnv) filter(name string, keep func(msg []byte, from *session) bool) Decorator {
+	return func(p Protocol) Protocol {
+		return ProtocolFunc(func(msg []byte, from *session) ([]byte, error) {
+			if !keep(msg, from) {
+				env.metrics.Staged(env.listener, name, stageDropped)
+				return nil, nil
+			}
+			env.metrics.Staged(env.listener, name, stagePassed)
+			return p.HandleMessage(msg, from)
+		})
+	}
+}
+
+// log logs every frame (see Logging).
+func parseLogStage(arg string) (stageBuilder, error) {
+	if arg != "" {
+		return nil, errors.New("log takes no argument")
+	}
+	return func(env *pipelineEnv) (Decorator, error) {
+		logging := Logging(env.logger)
+		return func(p Protocol) Protocol {
+			return env.filter("log", func([]byte, *session) bool { return true })(logging(p))
+		}, nil
+	}, nil
+}
+
+// sample:0.1 hands on a random tenth of the frames.
+func parseSampleStage(arg string) (stageBuilder, error) {
+	fraction, err := strconv.ParseFloat(arg, 64)
+	if err != nil || fraction <= 0 || fraction > 1 {
+		return nil, errors.Errorf("expected the fraction of frames to hand on, in (0, 1], got %q", arg)
+	}
+	return func(env *pipelineEnv) (Decorator, error) {
+		return env.filter("sample", func([]byte, *session) bool {
+			return rand.Float64() < fraction
+		}), nil
+	}, nil
+}
+
+// ratelimit:10/m hands on up to 10 frames a minute of each device,
+// in bursts of up to 10.
+func parseRateLimitStage(arg string) (stageBuilder, error) {
+	i := strings.Index(arg, "/")
+	if i < 0 {
+		return nil, errors.Errorf("expected a rate such as 10/m, got %q", arg)
+	}
+	count, err := strconv.Atoi(arg[:i])
+	if err != nil || count <= 0 {
+		return nil, errors.Errorf("expected a positive count of frames, got %q", arg[:i])
+	}
+	unit := arg[i+1:]
+	if unit == "s" || unit == "m" || unit == "h" {
+		unit = "1" + unit
+	}
+	per, err := time.ParseDuration(unit)
+	if err != nil || per <= 0 {
+		return nil, errors.Errorf("expected a positive period, such as s, m, h or 30s, got %q", arg[i+1:])
+	}
+	return func(env *pipelineEnv) (Decorator, error) {
+		limiter := newRateLimiter(count, per)
+		return env.filter("ratelimit", func(_ []byte, from *session) bool {
+			return limiter.Allow(sessionKey(from), time.Now())
+		}), nil
+	}, nil
+}
+
+// sessionKey is the device of the session or, if it is anonymous, its IP
+// address: the port changes with every connection.
+func sessionKey(s *session) string {
+	if deviceID := s.DeviceID(); deviceID != "" {
+		return deviceID
+	}
+	addr := s.RemoteAddr.String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// rateLimiter is a token bucket per device.
+//
+// The buckets which stayed full for longer than the period are forgotten,
+// as if they had never been used, so that the devices gone don't hold on
+// to theirs.
+type rateLimiter struct {
+	burst float64
+	// tokens per second
+	rate float64
+	per  time.Duration
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(count int, per time.Duration) *rateLimiter {
+	return &rateLimiter{
+		burst:   float64(count),
+		rate:    float64(count) / per.Seconds(),
+		per:     per,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// fullSince returns when the bucket got full again, or would.
+func (l *rateLimiter) fullSince(b *tokenBucket) time.Time {
+	return b.last.Add(time.Duration((l.burst - b.tokens) / l.rate * float64(time.Second)))
+}
+
+// sweep forgets the buckets which stayed full for longer than the period.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if now.Sub(l.fullSince(b)) > l.per {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// Allow takes a token of the bucket of key, if it has any left.
+func (l *rateLimiter) Allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) > l.per {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// validate drops the frames the codec of the session can't decode,
+// e.g. the ones failing their checksum, as they were decoded by the hub.
+func parseValidateStage(arg string) (stageBuilder, error) {
+	if arg != "" {
+		return nil, errors.New("validate takes no argument")
+	}
+	return func(env *pipelineEnv) (Decorator, error) {
+		return env.filter("validate", func(msg []byte, from *session) bool {
+			_, err := from.Decoded()
+			return err == nil
+		}), nil
+	}, nil
+}
+
+// tee:/var/log/autobus/frames.jsonl appends every frame to the file,
+// as a line of JSON.
+func parseTeeStage(arg string) (stageBuilder, error) {
+	if arg == "" {
+		return nil, errors.New("expected the path of the file to tee to")
+	}
+	return func(env *pipelineEnv) (Decorator, error) {
+		f, err := env.file(arg, func() (io.Closer, error) { return openTeeFile(arg) })
+		if err != nil {
+			return nil, err
+		}
+		tee, ok := f.(*teeFile)
+		if !ok {
+			return nil, errors.Errorf("%s is written to by another stage", arg)
+		}
+		return env.filter("tee", func(msg []byte, from *session) bool {
+			if err := tee.Write(msg, from); err != nil {
+				env.logger.Println("[ERROR] error while teeing the frame:", err)
+			}
+			return true
+		}), nil
+	}, nil
+}
+
+// record:/var/lib/autobus/capture.abcap records the traffic of the
+// sessions of the listener into the capture (see recorder). The bytes are
+// recorded as they are read and written, before any stage sees them, so
+// where the stage is in the pipeline doesn't matter.
+func parseRecordStage(arg string) (stageBuilder, error) {
+	if arg == "" {
+		return nil, errors.New("expected the path of the capture to record to")
+	}
+	return func(env *pipelineEnv) (Decorator, error) {
+		if env.network == "http" {
+			return nil, errors.New("http listeners have no sessions to record")
+		}
+		f, err := env.file(arg, func() (io.Closer, error) { return openRecorder(arg, env.logger) })
+		if err != nil {
+			return nil, err
+		}
+		r, ok := f.(*recorder)
+		if !ok {
+			return nil, errors.Errorf("%s is written to by another stage", arg)
+		}
+		env.recorders = append(env.recorders, r)
+		return func(p Protocol) Protocol { return p }, nil
+	}, nil
+}
+
+// teeFile is a file frames are appended to.
+type teeFile struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// teeLine is a frame, as written by tee.
+type teeLine struct {
+	ReceivedAt time.Time `json:"received_at"`
+	Listener   string    `json:"listener"`
+	RemoteAddr string    `json:"remote_addr"`
+	Codec      string    `json:"codec"`
+	DeviceID   string    `json:"device_id"`
+	Frame      []byte    `json:"frame"`
+}
+
+func openTeeFile(path string) (*teeFile, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error opening %s", path)
+	}
+	return &teeFile{f: f}, nil
+}
+
+func (t *teeFile) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.f.Close()
+}
+
+func (t *teeFile) Write(msg []byte, from *session) error {
+	line, err := json.Marshal(teeLine{
+		ReceivedAt: time.Now(),
+		Listener:   from.Listener,
+		RemoteAddr: from.RemoteAddr.String(),
+		Codec:      from.Codec(),
+		DeviceID:   from.DeviceID(),
+		Frame:      msg,
+	})
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, err = t.f.Write(append(line, '\n'))
+	return err
+}
+
+// drop:666|667 drops the frames of the devices 666 and 667.
+func parseDropStage(arg string) (stageBuilder, error) {
+	dropped := make(map[string]bool)
+	for _, deviceID := range strings.Split(arg, "|") {
+		if deviceID != "" {
+			dropped[deviceIDReplacer.Replace(deviceID)] = true
+		}
+	}
+	if len(dropped) == 0 {
+		return nil, errors.New("expected the IDs of the devices to drop, separated by |")
+	}
+	return func(env *pipelineEnv) (Decorator, error) {
+		return env.filter("drop", func(_ []byte, from *session) bool {
+			return !dropped[from.DeviceID()]
+		}), nil
+	}, nil
+}
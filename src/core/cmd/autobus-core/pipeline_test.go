@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePipeline(t *testing.T) {
+	stages, err := parsePipeline(" validate, drop:666|667 ,ratelimit:10/m,sample:0.5,tee:/tmp/frames.jsonl,log")
+	if err != nil {
+		t.Fatal("Should parse the pipeline:", err)
+	}
+	var names []string
+	for _, s := range stages {
+		names = append(names, s.Name)
+	}
+	if strings.Join(names, " ") != "validate drop ratelimit sample tee log" {
+		t.Error("Should keep the stages in order, got", names)
+	}
+	if stages, err := parsePipeline(""); err != nil || len(stages) != 0 {
+		t.Error("Should parse an empty pipeline, got", stages, err)
+	}
+
+	for _, invalid := range []string{"nope", "log:verbose", "sample:2", "sample:0", "ratelimit:10", "ratelimit:0/m", "ratelimit:10/fortnight", "tee", "drop:", "drop:|", "validate:strictly"} {
+		if _, err := parsePipeline(invalid); err == nil {
+			t.Error("Should fail with an invalid pipeline:", invalid)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(2, time.Minute)
+	start := time.Now()
+	testCases := []struct {
+		key     string
+		after   time.Duration
+		allowed bool
+	}{
+		{"a", 0, true},
+		{"a", 0, true},
+		{"a", time.Second, false},
+		{"b", time.Second, true},
+		{"a", 31 * time.Second, true},
+		{"a", 31 * time.Second, false},
+		{"a", 5 * time.Minute, true},
+		{"a", 5 * time.Minute, true},
+		{"a", 5 * time.Minute, false},
+	}
+	for i, tc := range testCases {
+		if allowed := limiter.Allow(tc.key, start.Add(tc.after)); allowed != tc.allowed {
+			t.Errorf("%d: expected %s to be allowed: %v, got %v", i, tc.key, tc.allowed, allowed)
+		}
+	}
+	// b is full again since a minute after it was used, and a was just used
+	limiter.sweep(start.Add(5*time.Minute + time.Second))
+	if _, ok := limiter.buckets["b"]; ok || len(limiter.buckets) != 1 {
+		t.Errorf("Should have forgotten the bucket of b only, has %v", limiter.buckets)
+	}
+}
+
+func TestRateLimiterForgetsBuckets(t *testing.T) {
+	limiter := newRateLimiter(1, time.Minute)
+	start := time.Now()
+	// anonymous clients connecting again and again
+	for i := 0; i < 1000; i++ {
+		limiter.Allow(strconv.Itoa(i), start.Add(time.Duration(i)*time.Second))
+	}
+	// used more than a minute ago, and full a minute later
+	if len(limiter.buckets) > 182 {
+		t.Errorf("Should have forgotten the buckets full for over a minute, has %d", len(limiter.buckets))
+	}
+}
+
+func TestSessionKey(t *testing.T) {
+	s := &session{RemoteAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 40000}}
+	if key := sessionKey(s); key != "10.0.0.5" {
+		t.Errorf("Should key anonymous sessions by their IP address, got %s", key)
+	}
+	s.deviceID = "1400046168"
+	if key := sessionKey(s); key != "1400046168" {
+		t.Errorf("Should key sessions by their device, got %s", key)
+	}
+}
+
+func TestHubPipelines(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+	tee := filepath.Join(dir, "frames.jsonl")
+
+	m := newMetrics()
+	handled := make(chan string, 10)
+	h := startTestHub(t, ProtocolFunc(func(msg []byte, from *session) ([]byte, error) {
+		handled <- from.Listener + " " + from.DeviceID()
+		return nil, nil
+	}), WithMetrics(m), Pipeline("drop:1400046169"), Listen(
+		listenerSpec{Network: "tcp", Addr: "127.0.0.1:0", Codec: "h02"},
+		listenerSpec{Network: "tcp", Addr: "127.0.0.2:0", Codec: "h02", Pipeline: "tee:" + tee + ",validate"},
+	))
+
+	other := strings.Replace(testFrame, "1400046168", "1400046169", 1)
+	invalid := "*HQ,1400046168,V1,nope#"
+	testCases := []struct {
+		listener int
+		stream   string
+		handled  []string
+	}{
+		{0, testFrame, []string{"127.0.0.1:0 1400046168"}},
+		{0, other, nil},
+		{1, other, []string{"127.0.0.2:0 1400046169"}},
+		{1, invalid + testFrame, []string{"127.0.0.2:0 1400046168"}},
+	}
+	for i, tc := range testCases {
+		conn, err := net.Dial("tcp", h.listeners[tc.listener].ln.Addr().String())
+		if err != nil {
+			t.Fatal("Should connect to the hub:", err)
+		}
+		conn.Write([]byte(tc.stream))
+		conn.(*net.TCPConn).CloseWrite()
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		ioutil.ReadAll(conn)
+		conn.Close()
+
+		deadline := time.Now().Add(time.Second)
+		for h.admission.Connected() > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		for _, expected := range tc.handled {
+			select {
+			case got := <-handled:
+				if got != expected {
+					t.Errorf("%d: expected %q to be handled, got %q", i, expected, got)
+				}
+			default:
+				t.Errorf("%d: expected %q to be handled", i, expected)
+			}
+		}
+		select {
+		case got := <-handled:
+			t.Errorf("%d: should not have handled %q", i, got)
+		default:
+		}
+	}
+
+	all, counts := m.stages.Counts()
+	expected := map[labels]uint64{
+		{"127.0.0.1:0", "drop", stagePassed}:      1,
+		{"127.0.0.1:0", "drop", stageDropped}:     1,
+		{"127.0.0.2:0", "tee", stagePassed}:       3,
+		{"127.0.0.2:0", "validate", stagePassed}:  2,
+		{"127.0.0.2:0", "validate", stageDropped}: 1,
+	}
+	if len(all) != len(expected) {
+		t.Errorf("Expected %d counts, got %v", len(expected), all)
+	}
+	for i, l := range all {
+		if counts[i] != expected[l] {
+			t.Errorf("Expected %d frames for %v, got %d", expected[l], l, counts[i])
+		}
+	}
+
+	// which closes the file teed to
+	h.Stop(context.Background())
+	f, err := os.Open(tee)
+	if err != nil {
+		t.Fatal("Should have teed the frames:", err)
+	}
+	defer f.Close()
+	var frames []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var line teeLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatal("Should tee JSON lines:", err)
+		}
+		frames = append(frames, string(line.Frame))
+	}
+	if strings.Join(frames, "") != other+invalid+testFrame {
+		t.Error("Should have teed every frame, got", frames)
+	}
+}
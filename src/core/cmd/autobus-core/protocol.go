@@ -1,30 +1,33 @@
 package main
 
 import (
+	"io"
 	"log"
 	"time"
 )
 
 // Protocol is a interface for messages of clients.
+// Each message is a whole frame, sent by the client of the given session.
 type Protocol interface {
-	HandleMessage(msg []byte) ([]byte, error)
+	HandleMessage(msg []byte, from *session) ([]byte, error)
 }
 
 // ProtocolFunc is a Protocol implementation as a closure
-type ProtocolFunc func(msg []byte) ([]byte, error)
+type ProtocolFunc func(msg []byte, from *session) ([]byte, error)
 
 // HandleMessage implements Protocol for ProtocolFunc
-func (pf ProtocolFunc) HandleMessage(msg []byte) ([]byte, error) {
-	return pf(msg)
+func (pf ProtocolFunc) HandleMessage(msg []byte, from *session) ([]byte, error) {
+	return pf(msg, from)
 }
 
 type Decorator func(Protocol) Protocol
 
 func Logging(logger *log.Logger) Decorator {
 	return func(p Protocol) Protocol {
-		return ProtocolFunc(func(msg []byte) ([]byte, error) {
+		return ProtocolFunc(func(msg []byte, from *session) ([]byte, error) {
 			start := time.Now()
-			ret, err := p.HandleMessage(msg)
+			ret, err := p.HandleMessage(msg, from)
+			logger.Println("From:", from.RemoteAddr, "codec:", from.Codec())
 			logger.Println("Message:", msg)
 			logger.Println("Response:", ret)
 			logger.Println("Took:", time.Since(start))
@@ -33,10 +36,18 @@ func Logging(logger *log.Logger) Decorator {
 	}
 }
 
+// Decorate applies the decorators to root, in order: the last one is the outermost.
+// If root is an io.Closer, so is the Protocol returned, closing root.
 func Decorate(root Protocol, decorators ...Decorator) Protocol {
 	decorated := root
 	for _, d := range decorators {
 		decorated = d(decorated)
 	}
+	if c, ok := root.(io.Closer); ok && len(decorators) > 0 {
+		return struct {
+			Protocol
+			io.Closer
+		}{decorated, c}
+	}
 	return decorated
 }
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The modes of the listeners behind load balancers speaking the PROXY protocol.
+const (
+	// connections may start with a PROXY header
+	proxyOptional = "optional"
+	// connections must start with a PROXY header
+	proxyStrict = "strict"
+
+	// how long clients have to send the PROXY header
+	proxyHeaderTimeout = 10 * time.Second
+	// the longest header of the version 1
+	proxyV1MaxLength = 107
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyListener accepts the connections of a load balancer speaking
+// the HAProxy PROXY protocol, version 1 or 2, whose headers tell the
+// addresses of the clients behind it.
+type proxyListener struct {
+	net.Listener
+	strict bool
+}
+
+// Accept returns a *proxyConn, which reads the header later on:
+// a slow client must not hold the others back.
+func (l proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, strict: l.strict}, nil
+}
+
+// proxyConn is a connection through a load balancer speaking the PROXY protocol.
+//
+// The header is read by the first call to Read, RemoteAddr or LocalAddr,
+// which then return the addresses in the header. If there is no header,
+// and it is optional, they are the addresses of the connection itself.
+// If the header is invalid, or missing when it is required, RemoteAddr
+// returns the address of the balancer, and Read fails with a rejection.
+type proxyConn struct {
+	net.Conn
+	strict bool
+
+	once          sync.Once
+	r             *bufio.Reader
+	remote, local net.Addr
+	err           error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.remote, c.local = c.Conn.RemoteAddr(), c.Conn.LocalAddr()
+		c.r = bufio.NewReaderSize(c.Conn, proxyV1MaxLength+1)
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+		remote, local, err := readProxyHeader(c.r, c.strict)
+		if err != nil {
+			c.err = rejection{disconnectProxyHeader, err}
+			return
+		}
+		if remote != nil {
+			c.remote, c.local = remote, local
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.init()
+	return c.local
+}
+
+// readProxyHeader reads the PROXY header, of either version, and returns
+// the addresses in it, or nil ones when the balancer doesn't say
+// (e.g. its own health checks), or when there is no header and it is optional.
+func readProxyHeader(r *bufio.Reader, strict bool) (remote, local net.Addr, err error) {
+	// devices may send fewer bytes than a header when there's no header,
+	// so the prefix is checked a byte at a time
+	matches := func(prefix []byte) bool {
+		for n := 1; n <= len(prefix); n++ {
+			peeked, _ := r.Peek(n)
+			if !bytes.Equal(peeked, prefix[:len(peeked)]) {
+				return false
+			}
+			if len(peeked) < n {
+				return false
+			}
+		}
+		return true
+	}
+	switch {
+	case matches([]byte("PROXY ")):
+		return readProxyV1(r)
+	case matches(proxyV2Signature):
+		return readProxyV2(r)
+	case strict:
+		return nil, nil, errors.New("missing PROXY header")
+	default:
+		return nil, nil, nil
+	}
+}
+
+// readProxyV1 reads a header such as "PROXY TCP4 10.0.0.5 10.0.0.1 40000 9009\r\n".
+func readProxyV1(r *bufio.Reader) (remote, local net.Addr, err error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error reading the PROXY header")
+	}
+	if len(line) > proxyV1MaxLength || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.Errorf("malformed PROXY header (raw: %q)", line)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errors.Errorf("malformed PROXY header (raw: %q)", line)
+	}
+	src, dst := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, srcErr := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, dstErr := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || srcErr != nil || dstErr != nil {
+		return nil, nil, errors.Errorf("malformed PROXY header (raw: %q)", line)
+	}
+	return &net.TCPAddr{IP: src, Port: int(srcPort)}, &net.TCPAddr{IP: dst, Port: int(dstPort)}, nil
+}
+
+// readProxyV2 reads a binary header: the signature, the version and command,
+// the family, the length of the addresses, and the addresses.
+func readProxyV2(r *bufio.Reader) (remote, local net.Addr, err error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, errors.Wrap(err, "error reading the PROXY header")
+	}
+	versionCommand, family := header[12], header[13]
+	addrs := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, addrs); err != nil {
+		return nil, nil, errors.Wrap(err, "error reading the PROXY header")
+	}
+	if versionCommand>>4 != 2 {
+		return nil, nil, errors.Errorf("unsupported PROXY version %d", versionCommand>>4)
+	}
+	switch versionCommand & 0x0f {
+	case 0:
+		// LOCAL: the balancer's own connection
+		return nil, nil, nil
+	case 1:
+		// PROXY
+	default:
+		return nil, nil, errors.Errorf("unsupported PROXY command %d", versionCommand&0x0f)
+	}
+
+	var ipLength int
+	switch family >> 4 {
+	case 1:
+		ipLength = net.IPv4len
+	case 2:
+		ipLength = net.IPv6len
+	default:
+		// unix sockets, or unspecified
+		return nil, nil, nil
+	}
+	if len(addrs) < 2*ipLength+4 {
+		return nil, nil, errors.Errorf("PROXY addresses too short (%d bytes)", len(addrs))
+	}
+	src, dst := net.IP(addrs[:ipLength]), net.IP(addrs[ipLength:2*ipLength])
+	srcPort := binary.BigEndian.Uint16(addrs[2*ipLength:])
+	dstPort := binary.BigEndian.Uint16(addrs[2*ipLength+2:])
+	return &net.TCPAddr{IP: src, Port: int(srcPort)}, &net.TCPAddr{IP: dst, Port: int(dstPort)}, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(command, family byte, addrs ...byte) string {
+		header := append([]byte{}, proxyV2Signature...)
+		header = append(header, 0x20|command, family, 0, byte(len(addrs)))
+		return string(append(header, addrs...))
+	}
+	testCases := []struct {
+		stream         string
+		strict         bool
+		remote, local  string
+		fails          bool
+		remainingBytes string
+	}{
+		{"PROXY TCP4 10.0.0.5 10.0.0.1 40000 9009\r\n*HQ#", true, "10.0.0.5:40000", "10.0.0.1:9009", false, "*HQ#"},
+		{"PROXY TCP6 2001:db8::5 2001:db8::1 40000 9009\r\n*HQ#", true, "[2001:db8::5]:40000", "[2001:db8::1]:9009", false, "*HQ#"},
+		{"PROXY UNKNOWN\r\n*HQ#", true, "", "", false, "*HQ#"},
+		{"PROXY TCP4 10.0.0.5 10.0.0.1 40000\r\n", true, "", "", true, ""},
+		{"PROXY TCP4 10.0.0.5 nope 40000 9009\r\n", true, "", "", true, ""},
+		{"PROXY TCP4 10.0.0.5 10.0.0.1 40000 9009\n", true, "", "", true, ""},
+		{v2(1, 0x11, 10, 0, 0, 5, 10, 0, 0, 1, 0x9c, 0x40, 0x23, 0x31) + "*HQ#", true, "10.0.0.5:40000", "10.0.0.1:9009", false, "*HQ#"},
+		{v2(1, 0x21, append(append(net.ParseIP("2001:db8::5"), net.ParseIP("2001:db8::1")...), 0x9c, 0x40, 0x23, 0x31)...) + "*HQ#", true, "[2001:db8::5]:40000", "[2001:db8::1]:9009", false, "*HQ#"},
+		{v2(0, 0) + "*HQ#", true, "", "", false, "*HQ#"},
+		{v2(1, 0x11, 10, 0, 0, 5), true, "", "", true, ""},
+		{v2(2, 0x11), true, "", "", true, ""},
+		{"*HQ,1400046168,V1#", false, "", "", false, "*HQ,1400046168,V1#"},
+		{"ID:x\r\n", false, "", "", false, "ID:x\r\n"},
+		{"PRO", false, "", "", false, "PRO"},
+		{"*HQ,1400046168,V1#", true, "", "", true, ""},
+	}
+	for i, tc := range testCases {
+		r := bufio.NewReaderSize(strings.NewReader(tc.stream), proxyV1MaxLength+1)
+		remote, local, err := readProxyHeader(r, tc.strict)
+		if tc.fails {
+			if err == nil {
+				t.Errorf("%d: should fail reading %q", i, tc.stream)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: should read %q: %v", i, tc.stream, err)
+			continue
+		}
+		if tc.remote == "" && (remote != nil || local != nil) {
+			t.Errorf("%d: expected no addresses, got %v and %v", i, remote, local)
+		}
+		if tc.remote != "" && (remote == nil || remote.String() != tc.remote || local.String() != tc.local) {
+			t.Errorf("%d: expected %s and %s, got %v and %v", i, tc.remote, tc.local, remote, local)
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != tc.remainingBytes {
+			t.Errorf("%d: expected %q to remain, got %q", i, tc.remainingBytes, rest)
+		}
+	}
+}
+
+func TestHubProxyProtocol(t *testing.T) {
+	handled := make(chan string, 10)
+	h := startTestHub(t, ProtocolFunc(func(msg []byte, from *session) ([]byte, error) {
+		handled <- from.RemoteAddr.String()
+		return nil, nil
+	}), Listen(listenerSpec{Network: "tcp", Addr: "127.0.0.1:0", Codec: "h02", Proxy: proxyStrict}))
+	defer h.Stop(context.Background())
+
+	send := func(stream string) {
+		conn, err := net.Dial("tcp", h.listeners[0].ln.Addr().String())
+		if err != nil {
+			t.Fatal("Should connect to the hub:", err)
+		}
+		defer conn.Close()
+		conn.Write([]byte(stream))
+		conn.(*net.TCPConn).CloseWrite()
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		ioutil.ReadAll(conn)
+	}
+
+	send("PROXY TCP4 203.0.113.7 10.0.0.1 40000 9009\r\n" + testFrame)
+	select {
+	case got := <-handled:
+		if got != "203.0.113.7:40000" {
+			t.Error("Should see the address of the client behind the balancer, got", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Should have handled the frame")
+	}
+
+	send(testFrame)
+	select {
+	case got := <-handled:
+		t.Error("Should not handle frames without a PROXY header, from", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+	var rejected uint64
+	for _, count := range h.Disconnects() {
+		if count.Reason == disconnectProxyHeader {
+			rejected = count.Count
+		}
+	}
+	if rejected != 1 {
+		t.Errorf("Should have counted a disconnect for %s, got %+v", disconnectProxyHeader, h.Disconnects())
+	}
+	if !strings.Contains(h.listeners[0].String(), "proxy=strict") {
+		t.Error("Should describe the proxy mode of the listener, got", h.listeners[0].listenerSpec)
+	}
+}
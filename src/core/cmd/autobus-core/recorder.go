@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"domain"
+
+	"github.com/pkg/errors"
+)
+
+// how often, at most, the recorder flushes what it recorded
+const recorderFlushInterval = time.Second
+
+// recorder records the traffic of sessions into a capture (see
+// domain.CaptureRecord), for autobus-replay to play it back: the bytes
+// read from the clients and written to them, acknowledgements included,
+// as they happened. Nothing is reassembled into frames first, so what the
+// framer discards, e.g. garbage and oversize frames, is recorded as well.
+//
+// Each run appends a segment to the capture.
+type recorder struct {
+	logger *log.Logger
+
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	capture *domain.CaptureWriter
+	// the sessions which did not end yet
+	open      map[uint64]*session
+	lastFlush time.Time
+}
+
+func openRecorder(path string, logger *log.Logger) (*recorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error opening %s", path)
+	}
+	w := bufio.NewWriter(f)
+	capture, err := domain.NewCaptureWriter(w)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &recorder{
+		logger:    logger,
+		f:         f,
+		w:         w,
+		capture:   capture,
+		open:      make(map[uint64]*session),
+		lastFlush: time.Now(),
+	}, nil
+}
+
+// captureConnection describes the session, as far as it is known.
+func captureConnection(s *session) domain.CaptureConnection {
+	return domain.CaptureConnection{
+		Listener:   s.Listener,
+		RemoteAddr: s.RemoteAddr.String(),
+		Codec:      s.Codec(),
+		DeviceID:   s.DeviceID(),
+	}
+}
+
+// Begin records the opening of the session.
+func (r *recorder) Begin(s *session) {
+	r.write(func(time.Time) error {
+		r.open[s.ID] = s
+		return r.capture.Open(s.ID, s.ConnectedAt, captureConnection(s))
+	})
+}
+
+// Record records what was read from (domain.CaptureIn) or written to
+// (domain.CaptureOut) the client of the session.
+func (r *recorder) Record(kind byte, s *session, data []byte) {
+	r.write(func(now time.Time) error {
+		return r.capture.Write(kind, s.ID, now, data)
+	})
+}
+
+// End records the end of the session, along with its codec and its
+// device, which were not known yet when it began.
+func (r *recorder) End(s *session) {
+	r.write(func(now time.Time) error {
+		delete(r.open, s.ID)
+		return r.capture.End(s.ID, now, captureConnection(s))
+	})
+}
+
+// write writes records to the capture, flushing it once in a while,
+// and logs the errors, which don't concern the sessions recorded.
+func (r *recorder) write(f func(now time.Time) error) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := f(now)
+	if err == nil && now.Sub(r.lastFlush) >= recorderFlushInterval {
+		r.lastFlush = now
+		err = errors.Wrap(r.w.Flush(), "error writing the capture")
+	}
+	if err != nil {
+		r.logger.Println("[ERROR] error while recording the sessions:", err)
+	}
+}
+
+// Close records the end of the sessions still open, and closes the capture.
+func (r *recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for id, s := range r.open {
+		if err := r.capture.End(id, now, captureConnection(s)); err != nil {
+			r.f.Close()
+			return err
+		}
+		delete(r.open, id)
+	}
+	if err := r.w.Flush(); err != nil {
+		r.f.Close()
+		return errors.Wrap(err, "error writing the capture")
+	}
+	return r.f.Close()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"domain"
+)
+
+// recordedConnection is what a capture holds of a connection.
+type recordedConnection struct {
+	kinds   []byte
+	opened  domain.CaptureConnection
+	closed  domain.CaptureConnection
+	in, out []byte
+}
+
+func readTestCapture(t *testing.T, path string) map[uint64]*recordedConnection {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal("Should have recorded a capture:", err)
+	}
+	defer f.Close()
+	cr, err := domain.NewCaptureReader(f)
+	if err != nil {
+		t.Fatal("Should read the capture:", err)
+	}
+	connections := make(map[uint64]*recordedConnection)
+	for {
+		r, err := cr.Next()
+		if err == io.EOF {
+			return connections
+		}
+		if err != nil {
+			t.Fatal("Should read the records:", err)
+		}
+		c, ok := connections[r.ConnectionID]
+		if !ok {
+			c = &recordedConnection{}
+			connections[r.ConnectionID] = c
+		}
+		c.kinds = append(c.kinds, r.Kind)
+		switch r.Kind {
+		case domain.CaptureOpen:
+			c.opened, err = r.Connection()
+		case domain.CaptureIn:
+			c.in = append(c.in, r.Data...)
+		case domain.CaptureOut:
+			c.out = append(c.out, r.Data...)
+		case domain.CaptureClose:
+			c.closed, err = r.Connection()
+		}
+		if err != nil {
+			t.Fatalf("Unexpected record %+v: %v", r, err)
+		}
+	}
+}
+
+func TestHubRecordsSessions(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "capture.abcap")
+
+	h := startTestHub(t, ProtocolFunc(func(msg []byte, from *session) ([]byte, error) {
+		return []byte("OK"), nil
+	}), Pipeline("record:"+path), MaxFrameSize(len(testFrame)))
+	// garbage, and an oversize frame, which the framer discards, are recorded as well
+	sent := "garbage\r\n" + testFrame + "*HQ," + string(bytes.Repeat([]byte("x"), len(testFrame))) + "#" + testFrame
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", h.listeners[0].ln.Addr().String())
+		if err != nil {
+			t.Fatal("Should connect to the hub:", err)
+		}
+		conn.Write([]byte(sent))
+		conn.(*net.TCPConn).CloseWrite()
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		ioutil.ReadAll(conn)
+		conn.Close()
+	}
+	h.Stop(context.Background())
+
+	connections := readTestCapture(t, path)
+	if len(connections) != 2 {
+		t.Fatalf("Should have recorded 2 connections, recorded %d", len(connections))
+	}
+	for id, c := range connections {
+		if c.kinds[0] != domain.CaptureOpen || c.kinds[len(c.kinds)-1] != domain.CaptureClose {
+			t.Errorf("%d: should be opened first and closed last: %v", id, c.kinds)
+		}
+		if c.opened.Listener != "127.0.0.1:0" || c.opened.DeviceID != "" {
+			t.Errorf("%d: unexpected connection when opened %+v", id, c.opened)
+		}
+		if c.closed.Listener != "127.0.0.1:0" || c.closed.Codec != "h02" || c.closed.DeviceID != "1400046168" {
+			t.Errorf("%d: unexpected connection when closed %+v", id, c.closed)
+		}
+		if string(c.in) != sent {
+			t.Errorf("%d: should have recorded what the client sent, as it sent it, recorded %q", id, c.in)
+		}
+		if string(c.out) != "OKOK" {
+			t.Errorf("%d: should have recorded what the client was answered, recorded %q", id, c.out)
+		}
+	}
+}
+
+func TestHubRecordsAcknowledgements(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "capture.abcap")
+
+	// like NatsProtocol, the protocol answers nothing: only the codec does
+	h := startTestHub(t, ProtocolFunc(func([]byte, *session) ([]byte, error) {
+		return nil, nil
+	}), Listen(listenerSpec{Network: "udp", Addr: "127.0.0.1:0", Codec: "gt06", Pipeline: "record:" + path}))
+	conn, err := net.Dial("udp", h.listeners[0].pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal("Should reach the hub:", err)
+	}
+	login, _ := hex.DecodeString("78780D01012345678901234500018CDD0D0A")
+	conn.Write(login)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 64)); err != nil {
+		t.Fatal("Should acknowledge the login:", err)
+	}
+	conn.Close()
+	h.Stop(context.Background())
+
+	connections := readTestCapture(t, path)
+	if len(connections) != 1 {
+		t.Fatalf("Should have recorded a connection, recorded %d", len(connections))
+	}
+	for _, c := range connections {
+		ack, _ := hex.DecodeString("787805010001D9DC0D0A")
+		if !bytes.Equal(c.in, login) || !bytes.Equal(c.out, ack) {
+			t.Errorf("Should have recorded the login and its ack, recorded %X and %X", c.in, c.out)
+		}
+		if c.closed.Codec != "gt06" || c.closed.DeviceID != "123456789012345" {
+			t.Errorf("Unexpected connection when closed %+v", c.closed)
+		}
+	}
+}
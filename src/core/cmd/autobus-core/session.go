@@ -0,0 +1,447 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"domain"
+)
+
+// session is a client connected to the hub.
+//
+// Until the client sends its first valid frame, we don't know which device
+// it is, so a session starts anonymous and is identified later on.
+type session struct {
+	// ID uniquely identifies the connection within this process.
+	ID          uint64
+	RemoteAddr  net.Addr
+	ConnectedAt time.Time
+	// Listener is the address the client connected to.
+	Listener string
+
+	conn    net.Conn
+	writeMu sync.Mutex
+	// the recorders of the traffic of the session, if any (see the record
+	// stage), set before it is registered
+	recorders []*recorder
+
+	// timeouts bound the reads from conn, and readDeadlineFor tells which
+	// one the last read was bound by. Both are only touched by the goroutine
+	// reading from the session.
+	timeouts        timeouts
+	readDeadlineFor string
+	// the packet decoded from the frame being handled, or why it could not
+	// be decoded. Only touched by the goroutine handling the frames.
+	packet    domain.Packet
+	decodeErr error
+
+	mu        sync.RWMutex
+	codec     string // the protocol the client speaks, once known
+	deviceID  string
+	certified bool
+	closedFor string
+	lastSeen  time.Time
+	state     *domain.VehicleState
+
+	// replies awaited from the device, by command
+	pendingMu sync.Mutex
+	pending   map[string][]chan []byte
+
+	bytesIn, bytesOut, framesIn uint64
+	// set once the session is closed, by the registry
+	closed int32
+}
+
+// sessionInfo is a point in time view of a session,
+// safe to be handed around and encoded.
+type sessionInfo struct {
+	ID          uint64    `json:"id"`
+	DeviceID    string    `json:"device_id"`
+	RemoteAddr  string    `json:"remote_addr"`
+	Listener    string    `json:"listener"`
+	Codec       string    `json:"codec"`
+	ConnectedAt time.Time `json:"connected_at"`
+	LastSeen    time.Time `json:"last_seen"`
+	BytesIn     uint64    `json:"bytes_in"`
+	BytesOut    uint64    `json:"bytes_out"`
+	FramesIn    uint64    `json:"frames_in"`
+
+	Certified bool                 `json:"certified"`
+	State     *domain.VehicleState `json:"state,omitempty"`
+}
+
+// Read reads from the underlying connection, accounting for the bytes read.
+// Reads time out as the timeouts of the session dictate.
+func (s *session) Read(p []byte) (int, error) {
+	s.mu.RLock()
+	deadline, reason := s.timeouts.deadline(time.Now(), s.lastSeen, s.ConnectedAt)
+	s.mu.RUnlock()
+	if !deadline.IsZero() || s.readDeadlineFor != "" {
+		s.conn.SetReadDeadline(deadline)
+		s.readDeadlineFor = reason
+	}
+	n, err := s.conn.Read(p)
+	atomic.AddUint64(&s.bytesIn, uint64(n))
+	if n > 0 {
+		s.record(domain.CaptureIn, p[:n])
+	}
+	return n, err
+}
+
+// Received accounts for data received from the client other than by Read,
+// e.g. the datagrams read by udp listeners.
+func (s *session) Received(data []byte) {
+	atomic.AddUint64(&s.bytesIn, uint64(len(data)))
+	s.record(domain.CaptureIn, data)
+}
+
+// Write writes to the underlying connection, accounting for the bytes written.
+// It is safe to be called concurrently.
+func (s *session) Write(p []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	n, err := s.conn.Write(p)
+	atomic.AddUint64(&s.bytesOut, uint64(n))
+	if n > 0 {
+		s.record(domain.CaptureOut, p[:n])
+	}
+	return n, err
+}
+
+// record records the data read from or written to the client.
+func (s *session) record(kind byte, data []byte) {
+	for _, r := range s.recorders {
+		r.Record(kind, s, data)
+	}
+}
+
+// Close closes the underlying connection.
+func (s *session) Close() error {
+	return s.conn.Close()
+}
+
+// CloseFor closes the underlying connection for the given reason,
+// unless it was already closed for another.
+func (s *session) CloseFor(reason string) error {
+	s.mu.Lock()
+	if s.closedFor == "" {
+		s.closedFor = reason
+	}
+	s.mu.Unlock()
+	return s.Close()
+}
+
+// Closed tells whether the session was closed.
+func (s *session) Closed() bool {
+	return atomic.LoadInt32(&s.closed) == 1
+}
+
+// closeReason returns why the hub closed the session, if it did.
+func (s *session) closeReason() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.closedFor
+}
+
+// deadlineReason returns why the last read from the session had a deadline.
+func (s *session) deadlineReason() string {
+	return s.readDeadlineFor
+}
+
+// DeviceID returns the ID of the device on the other end,
+// or an empty string if it has not identified itself yet.
+func (s *session) DeviceID() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.deviceID
+}
+
+// Certify records that the device on the other end presented a client
+// certificate: the device it identifies is the only one allowed through the session.
+func (s *session) Certify() {
+	s.mu.Lock()
+	s.certified = true
+	s.mu.Unlock()
+}
+
+// Certified reports whether the device presented a client certificate.
+func (s *session) Certified() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.certified
+}
+
+// Codec returns the name of the protocol the client speaks,
+// or an empty string if it is not known yet.
+func (s *session) Codec() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.codec
+}
+
+// SetCodec records the protocol the client speaks.
+func (s *session) SetCodec(codec string) {
+	s.mu.Lock()
+	s.codec = codec
+	s.mu.Unlock()
+}
+
+// Seen records a frame received from the client.
+func (s *session) Seen(t time.Time) {
+	atomic.AddUint64(&s.framesIn, 1)
+	s.mu.Lock()
+	s.lastSeen = t
+	s.mu.Unlock()
+}
+
+// Decoded returns the packet decoded from the frame being handled,
+// or why the codec of the session could not decode it.
+func (s *session) Decoded() (domain.Packet, error) {
+	return s.packet, s.decodeErr
+}
+
+// SetState records the last known state of the vehicle, and returns the previous one.
+func (s *session) SetState(state *domain.VehicleState) (previous *domain.VehicleState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, s.state = s.state, state
+	return previous
+}
+
+// Await registers interest in the device's reply to command.
+// The reply frame is sent on the returned channel; callers that give up
+// waiting must call cancel.
+func (s *session) Await(command string) (reply <-chan []byte, cancel func()) {
+	ch := make(chan []byte, 1)
+	s.pendingMu.Lock()
+	if s.pending == nil {
+		s.pending = make(map[string][]chan []byte)
+	}
+	s.pending[command] = append(s.pending[command], ch)
+	s.pendingMu.Unlock()
+
+	return ch, func() {
+		s.pendingMu.Lock()
+		defer s.pendingMu.Unlock()
+		waiting := s.pending[command]
+		for i, c := range waiting {
+			if c == ch {
+				s.pending[command] = append(waiting[:i], waiting[i+1:]...)
+				break
+			}
+		}
+		if len(s.pending[command]) == 0 {
+			delete(s.pending, command)
+		}
+	}
+}
+
+// Awaiting reports whether anyone is waiting for a reply from the device.
+func (s *session) Awaiting() bool {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	return len(s.pending) > 0
+}
+
+// Resolve hands the reply to command over to the oldest caller awaiting it.
+// It reports whether there was anyone waiting.
+func (s *session) Resolve(command string, frame []byte) bool {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	waiting := s.pending[command]
+	if len(waiting) == 0 {
+		return false
+	}
+	waiting[0] <- frame
+	if len(waiting) == 1 {
+		delete(s.pending, command)
+	} else {
+		s.pending[command] = waiting[1:]
+	}
+	return true
+}
+
+func (s *session) Info() sessionInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return sessionInfo{
+		ID:          s.ID,
+		DeviceID:    s.deviceID,
+		RemoteAddr:  s.RemoteAddr.String(),
+		Listener:    s.Listener,
+		Codec:       s.codec,
+		ConnectedAt: s.ConnectedAt,
+		LastSeen:    s.lastSeen,
+		BytesIn:     atomic.LoadUint64(&s.bytesIn),
+		BytesOut:    atomic.LoadUint64(&s.bytesOut),
+		FramesIn:    atomic.LoadUint64(&s.framesIn),
+		Certified:   s.certified,
+		State:       s.state,
+	}
+}
+
+// sessionRegistry keeps track of every session in the hub,
+// and of which device is connected through which of them.
+type sessionRegistry struct {
+	mu       sync.RWMutex
+	lastID   uint64
+	sessions map[uint64]*session
+	devices  map[string]*session
+	// the traffic of the sessions closed so far, by listener
+	closed map[string]listenerTraffic
+}
+
+// listenerTraffic is how many clients are connected to a listener,
+// and what its clients sent and were sent since the hub started.
+type listenerTraffic struct {
+	Listener string
+	Sessions int
+	BytesIn  uint64
+	BytesOut uint64
+	FramesIn uint64
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		sessions: make(map[uint64]*session),
+		devices:  make(map[string]*session),
+		closed:   make(map[string]listenerTraffic),
+	}
+}
+
+// Open registers a new, anonymous, session for conn,
+// accepted by the listener on the given address,
+// whose traffic the recorders record, if any.
+func (r *sessionRegistry) Open(conn net.Conn, listener string, recorders ...*recorder) *session {
+	now := time.Now()
+	s := &session{
+		RemoteAddr:  conn.RemoteAddr(),
+		Listener:    listener,
+		ConnectedAt: now,
+		conn:        conn,
+		recorders:   recorders,
+		lastSeen:    now,
+	}
+	r.mu.Lock()
+	r.lastID++
+	s.ID = r.lastID
+	for _, rec := range recorders {
+		// before the session can be written to
+		rec.Begin(s)
+	}
+	r.sessions[s.ID] = s
+	r.mu.Unlock()
+	return s
+}
+
+// Identify binds the session to the given device.
+//
+// A device can only be connected once: if it already had a session,
+// the device probably reconnected without us noticing the old connection
+// went away, so the stale session is closed and returned.
+func (r *sessionRegistry) Identify(s *session, deviceID string) (stale *session) {
+	s.mu.Lock()
+	s.deviceID = deviceID
+	s.mu.Unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if old, ok := r.devices[deviceID]; ok && old != s {
+		old.CloseFor(disconnectReplaced)
+		stale = old
+	}
+	r.devices[deviceID] = s
+	return stale
+}
+
+// Close closes the session and forgets about it.
+func (r *sessionRegistry) Close(s *session) error {
+	r.mu.Lock()
+	_, open := r.sessions[s.ID]
+	if open {
+		traffic := r.closed[s.Listener]
+		traffic.add(s)
+		r.closed[s.Listener] = traffic
+	}
+	delete(r.sessions, s.ID)
+	if id := s.DeviceID(); id != "" && r.devices[id] == s {
+		delete(r.devices, id)
+	}
+	r.mu.Unlock()
+	atomic.StoreInt32(&s.closed, 1)
+	err := s.Close()
+	if open {
+		for _, rec := range s.recorders {
+			rec.End(s)
+		}
+	}
+	return err
+}
+
+// CloseAll closes every session, and returns how many there were.
+func (r *sessionRegistry) CloseAll() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, s := range r.sessions {
+		s.CloseFor(disconnectShutdown)
+	}
+	return len(r.sessions)
+}
+
+// Lookup returns the session of the given device, if it is connected.
+func (r *sessionRegistry) Lookup(deviceID string) (*session, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s, ok := r.devices[deviceID]
+	return s, ok
+}
+
+// All returns a view of every session, including the anonymous ones.
+func (r *sessionRegistry) All() []sessionInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	all := make([]sessionInfo, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		all = append(all, s.Info())
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].ID < all[j].ID
+	})
+	return all
+}
+
+// Traffic returns the traffic of each listener, sorted by listener.
+func (r *sessionRegistry) Traffic() []listenerTraffic {
+	r.mu.RLock()
+	byListener := make(map[string]listenerTraffic, len(r.closed))
+	for listener, traffic := range r.closed {
+		byListener[listener] = traffic
+	}
+	for _, s := range r.sessions {
+		traffic := byListener[s.Listener]
+		traffic.Sessions++
+		traffic.add(s)
+		byListener[s.Listener] = traffic
+	}
+	r.mu.RUnlock()
+
+	all := make([]listenerTraffic, 0, len(byListener))
+	for listener, traffic := range byListener {
+		traffic.Listener = listener
+		all = append(all, traffic)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Listener < all[j].Listener
+	})
+	return all
+}
+
+// add accounts for the traffic of the session.
+func (t *listenerTraffic) add(s *session) {
+	t.BytesIn += atomic.LoadUint64(&s.bytesIn)
+	t.BytesOut += atomic.LoadUint64(&s.bytesOut)
+	t.FramesIn += atomic.LoadUint64(&s.framesIn)
+}
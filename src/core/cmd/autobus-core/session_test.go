@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSessionRegistryReconnect(t *testing.T) {
+	r := newSessionRegistry()
+
+	staleConn, staleClient := net.Pipe()
+	defer staleClient.Close()
+	stale := r.Open(staleConn, "0.0.0.0:9009")
+	r.Identify(stale, "1400046168")
+
+	freshConn, freshClient := net.Pipe()
+	defer freshClient.Close()
+	fresh := r.Open(freshConn, "0.0.0.0:9009")
+	if old := r.Identify(fresh, "1400046168"); old != stale {
+		t.Error("Should return the stale session, has:", old)
+	}
+	if _, err := staleClient.Read(make([]byte, 1)); err == nil {
+		t.Error("Should have closed the stale connection")
+	}
+
+	// the handler of the stale connection finishing
+	// must not forget about the fresh one
+	r.Close(stale)
+	if s, ok := r.Lookup("1400046168"); !ok || s != fresh {
+		t.Error("Should lookup the fresh session, has:", s)
+	}
+	if all := r.All(); len(all) != 1 || all[0].ID != fresh.ID {
+		t.Error("Should list only the fresh session, has:", all)
+	}
+}
+
+func TestSessionAwaitResolve(t *testing.T) {
+	conn, client := net.Pipe()
+	defer client.Close()
+	s := newSessionRegistry().Open(conn, "0.0.0.0:9009")
+
+	first, cancelFirst := s.Await("S71")
+	second, cancelSecond := s.Await("S71")
+	defer cancelSecond()
+	if !s.Awaiting() {
+		t.Error("Should be awaiting the replies")
+	}
+	if s.Resolve("S20", []byte("S20")) {
+		t.Error("Should not resolve a command no one awaits")
+	}
+
+	// the oldest caller gets the first reply
+	if !s.Resolve("S71", []byte("first")) {
+		t.Fatal("Should resolve the command")
+	}
+	if reply := <-first; string(reply) != "first" {
+		t.Errorf("Unexpected reply: %q", reply)
+	}
+	cancelFirst()
+
+	if !s.Resolve("S71", []byte("second")) {
+		t.Fatal("Should resolve the command")
+	}
+	if reply := <-second; string(reply) != "second" {
+		t.Errorf("Unexpected reply: %q", reply)
+	}
+	if s.Awaiting() || s.Resolve("S71", []byte("third")) {
+		t.Error("Should not await anything anymore")
+	}
+
+	// a caller giving up is not handed a reply
+	_, cancel := s.Await("S71")
+	cancel()
+	if s.Awaiting() || s.Resolve("S71", []byte("late")) {
+		t.Error("Should have forgotten the canceled caller")
+	}
+}
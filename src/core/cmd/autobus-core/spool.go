@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	spoolMaxSizeDefault = 256 << 20
+
+	// segments are rotated once they reach this size
+	spoolSegmentSize = 4 << 20
+	spoolSegmentExt  = ".seg"
+	spoolCursorFile  = "cursor"
+
+	// how many messages are replayed between each flush
+	spoolBatchSize     = 256
+	spoolFlushTimeout  = 5 * time.Second
+	spoolRetryInterval = time.Second
+
+	// length and checksum
+	spoolHeaderSize = 8
+)
+
+var (
+	errSpoolFull = errors.New("the spool is full")
+
+	spoolTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// spoolPublisher is where the spool delivers the messages to, i.e. NATS.
+type spoolPublisher interface {
+	Publish(subject string, data []byte) error
+	IsConnected() bool
+	FlushTimeout(timeout time.Duration) error
+}
+
+// spool holds on to the messages that can't be published, in a directory,
+// and replays them in order once the publisher is connected again.
+//
+// It is a log of segments, files named after their sequence number,
+// which are only appended to. Each record is the length and the CRC of
+// what follows: the length of the subject, the subject, and the message.
+// The cursor file points at the first record not replayed yet; segments
+// before it are deleted.
+//
+// While the spool is not empty, messages are appended to it even if the
+// publisher is connected, so that they are delivered in the order received.
+// Replayed messages are flushed before the cursor moves past them, so none
+// are lost, and the cursor is saved before closing, so a restart doesn't
+// replay them again. Only a crash between a flush and the next save of the
+// cursor replays the last batch again.
+type spool struct {
+	dir      string
+	maxBytes int64
+	pub      spoolPublisher
+
+	mu       sync.Mutex
+	segments []spoolSegment
+	tail     *os.File
+	cursor   spoolCursor
+	size     int64
+	depth    int
+	dropped  uint64
+
+	wake chan struct{}
+	quit chan struct{}
+	done chan struct{}
+}
+
+type spoolSegment struct {
+	seq  uint64
+	size int64
+}
+
+// spoolCursor is the position of a record in the spool.
+type spoolCursor struct {
+	Segment uint64
+	Offset  int64
+}
+
+type spoolRecord struct {
+	subject string
+	data    []byte
+}
+
+// spoolStats is a point in time view of the spool.
+type spoolStats struct {
+	// messages not replayed yet
+	Depth int `json:"depth"`
+	// bytes taken on disk
+	Bytes int64 `json:"bytes"`
+	// messages dropped since starting, because the spool was full
+	Dropped uint64 `json:"dropped"`
+}
+
+// openSpool opens the spool in dir, creating it if needed, and starts
+// replaying the messages it holds to pub. The records torn by a crash
+// are truncated. The spool takes no more than maxBytes on disk.
+func openSpool(dir string, maxBytes int64, pub spoolPublisher) (*spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "error creating the spool")
+	}
+	s := &spool{
+		dir:      dir,
+		maxBytes: maxBytes,
+		pub:      pub,
+		wake:     make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	go s.replay()
+	return s, nil
+}
+
+// load finds the segments in the directory, and the records not replayed yet.
+func (s *spool) load() error {
+	names, err := filepath.Glob(filepath.Join(s.dir, "*"+spoolSegmentExt))
+	if err != nil {
+		return errors.Wrap(err, "error listing the spool segments")
+	}
+	var seqs []uint64
+	for _, name := range names {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), spoolSegmentExt), 16, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	cursor, err := s.loadCursor()
+	if err != nil {
+		return err
+	}
+	if len(seqs) > 0 && (cursor == nil || cursor.Segment < seqs[0]) {
+		cursor = &spoolCursor{Segment: seqs[0]}
+	}
+	if cursor != nil {
+		s.cursor = *cursor
+	}
+
+	for _, seq := range seqs {
+		if seq < s.cursor.Segment {
+			os.Remove(s.segmentPath(seq))
+			continue
+		}
+		from := int64(0)
+		if seq == s.cursor.Segment {
+			from = s.cursor.Offset
+		}
+		count, size, err := s.check(seq, from)
+		if err != nil {
+			return err
+		}
+		if seq == s.cursor.Segment && s.cursor.Offset > size {
+			// the segment was emptied, but the cursor not saved after
+			s.cursor.Offset = size
+		}
+		s.segments = append(s.segments, spoolSegment{seq, size})
+		s.depth += count
+		s.size += size
+	}
+
+	if len(s.segments) == 0 {
+		s.cursor = spoolCursor{Segment: s.cursor.Segment + 1}
+		s.segments = []spoolSegment{{seq: s.cursor.Segment}}
+	}
+	tail := s.segments[len(s.segments)-1]
+	s.tail, err = os.OpenFile(s.segmentPath(tail.seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	return errors.Wrap(err, "error opening the spool")
+}
+
+// check counts the valid records in the segment from the given offset on,
+// and truncates the segment at the first invalid one.
+func (s *spool) check(seq uint64, from int64) (count int, size int64, err error) {
+	f, err := os.OpenFile(s.segmentPath(seq), os.O_RDWR, 0644)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "error opening the spool")
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "error opening the spool")
+	}
+	if from > info.Size() {
+		from = info.Size()
+	}
+	if _, err := f.Seek(from, io.SeekStart); err != nil {
+		return 0, 0, errors.Wrap(err, "error opening the spool")
+	}
+	r := bufio.NewReader(f)
+	offset := from
+	for {
+		n, _, err := readSpoolRecord(r)
+		if err != nil {
+			break
+		}
+		offset += n
+		count++
+	}
+	if offset < info.Size() {
+		if err := f.Truncate(offset); err != nil {
+			return 0, 0, errors.Wrap(err, "error truncating the torn records of the spool")
+		}
+	}
+	return count, offset, nil
+}
+
+func (s *spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%016x%s", seq, spoolSegmentExt))
+}
+
+func (s *spool) loadCursor() (*spoolCursor, error) {
+	raw, err := ioutil.ReadFile(filepath.Join(s.dir, spoolCursorFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading the spool cursor")
+	}
+	if len(raw) != 16 {
+		return nil, errors.Errorf("the spool cursor is corrupt (%d bytes)", len(raw))
+	}
+	return &spoolCursor{
+		Segment: binary.BigEndian.Uint64(raw),
+		Offset:  int64(binary.BigEndian.Uint64(raw[8:])),
+	}, nil
+}
+
+// saveCursor replaces the cursor file atomically.
+func (s *spool) saveCursor() error {
+	raw := make([]byte, 16)
+	binary.BigEndian.PutUint64(raw, s.cursor.Segment)
+	binary.BigEndian.PutUint64(raw[8:], uint64(s.cursor.Offset))
+	path := filepath.Join(s.dir, spoolCursorFile)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return errors.Wrap(err, "error saving the spool cursor")
+	}
+	_, err = f.Write(raw)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	return errors.Wrap(err, "error saving the spool cursor")
+}
+
+// Publish publishes the message right away, unless the publisher is
+// disconnected, fails, or there are older messages spooled:
+// then it is appended to the spool.
+func (s *spool) Publish(subject string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.depth == 0 && s.pub.IsConnected() {
+		if err := s.pub.Publish(subject, data); err == nil {
+			return nil
+		}
+	}
+	return s.append(subject, data)
+}
+
+func (s *spool) append(subject string, data []byte) error {
+	if len(subject) > 0xffff {
+		return errors.Errorf("the subject %.32s... is too long to be spooled", subject)
+	}
+	rec := make([]byte, spoolHeaderSize+2+len(subject)+len(data))
+	binary.BigEndian.PutUint32(rec, uint32(len(rec)-spoolHeaderSize))
+	binary.BigEndian.PutUint16(rec[spoolHeaderSize:], uint16(len(subject)))
+	copy(rec[spoolHeaderSize+2:], subject)
+	copy(rec[spoolHeaderSize+2+len(subject):], data)
+	binary.BigEndian.PutUint32(rec[4:], crc32.Checksum(rec[spoolHeaderSize:], spoolTable))
+
+	if s.size+int64(len(rec)) > s.maxBytes {
+		s.dropped++
+		return errSpoolFull
+	}
+	tail := &s.segments[len(s.segments)-1]
+	if tail.size > 0 && tail.size+int64(len(rec)) > spoolSegmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+		tail = &s.segments[len(s.segments)-1]
+	}
+	n, err := s.tail.Write(rec)
+	tail.size += int64(n)
+	s.size += int64(n)
+	if err != nil {
+		// a partial record is truncated when the spool is opened again
+		return errors.Wrap(err, "error writing to the spool")
+	}
+	s.depth++
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// rotate starts a new segment.
+func (s *spool) rotate() error {
+	if err := s.tail.Sync(); err != nil {
+		return errors.Wrap(err, "error syncing the spool")
+	}
+	s.tail.Close()
+	seq := s.segments[len(s.segments)-1].seq + 1
+	f, err := os.OpenFile(s.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrap(err, "error creating a spool segment")
+	}
+	s.tail = f
+	s.segments = append(s.segments, spoolSegment{seq: seq})
+	return nil
+}
+
+// replay delivers the spooled messages whenever the publisher is connected,
+// until the spool is closed.
+func (s *spool) replay() {
+	defer close(s.done)
+	retry := time.NewTicker(spoolRetryInterval)
+	defer retry.Stop()
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-s.wake:
+		case <-retry.C:
+		}
+		for s.replayBatch() {
+			select {
+			case <-s.quit:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// replayBatch delivers the oldest messages of the spool, and returns
+// whether it did, so there may be more to deliver.
+func (s *spool) replayBatch() bool {
+	s.mu.Lock()
+	pending := s.depth
+	cursor := s.cursor
+	segments := append([]spoolSegment(nil), s.segments...)
+	s.mu.Unlock()
+	if pending == 0 || !s.pub.IsConnected() {
+		return false
+	}
+
+	records, next, err := s.read(cursor, segments, spoolBatchSize)
+	if err != nil || len(records) == 0 {
+		return false
+	}
+	for _, r := range records {
+		if err := s.pub.Publish(r.subject, r.data); err != nil {
+			return false
+		}
+	}
+	if err := s.pub.FlushTimeout(spoolFlushTimeout); err != nil {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cursor = next
+	s.depth -= len(records)
+	if err := s.saveCursor(); err != nil {
+		return false
+	}
+	for len(s.segments) > 1 && s.segments[0].seq < s.cursor.Segment {
+		os.Remove(s.segmentPath(s.segments[0].seq))
+		s.size -= s.segments[0].size
+		s.segments = s.segments[1:]
+	}
+	if s.depth == 0 && len(s.segments) == 1 {
+		// everything was replayed, there's no need to keep it around
+		if err := s.tail.Truncate(0); err == nil {
+			s.size -= s.segments[0].size
+			s.segments[0].size = 0
+			s.cursor.Offset = 0
+			s.saveCursor()
+		}
+	}
+	return true
+}
+
+// read reads up to n records from the cursor on, and returns the cursor past them.
+// Only the records within the sizes of the segments given are read.
+func (s *spool) read(cursor spoolCursor, segments []spoolSegment, n int) ([]spoolRecord, spoolCursor, error) {
+	var records []spoolRecord
+	for i, seg := range segments {
+		if seg.seq < cursor.Segment {
+			continue
+		}
+		if seg.seq > cursor.Segment {
+			cursor = spoolCursor{Segment: seg.seq}
+		}
+		if cursor.Offset >= seg.size {
+			if i < len(segments)-1 {
+				continue
+			}
+			break
+		}
+		f, err := os.Open(s.segmentPath(seg.seq))
+		if err != nil {
+			return nil, cursor, errors.Wrap(err, "error reading the spool")
+		}
+		if _, err := f.Seek(cursor.Offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, cursor, errors.Wrap(err, "error reading the spool")
+		}
+		r := bufio.NewReader(io.LimitReader(f, seg.size-cursor.Offset))
+		for len(records) < n && cursor.Offset < seg.size {
+			size, rec, err := readSpoolRecord(r)
+			if err != nil {
+				f.Close()
+				return nil, cursor, errors.Wrap(err, "error reading the spool")
+			}
+			records = append(records, rec)
+			cursor.Offset += size
+		}
+		f.Close()
+		if len(records) == n {
+			break
+		}
+	}
+	return records, cursor, nil
+}
+
+// readSpoolRecord reads a record, and returns how many bytes it takes.
+func readSpoolRecord(r io.Reader) (int64, spoolRecord, error) {
+	header := make([]byte, spoolHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, spoolRecord{}, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length < 2 || length > spoolSegmentSize+0xffff {
+		return 0, spoolRecord{}, errors.Errorf("invalid spool record length %d", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, spoolRecord{}, err
+	}
+	if crc32.Checksum(body, spoolTable) != binary.BigEndian.Uint32(header[4:]) {
+		return 0, spoolRecord{}, errors.New("spool record checksum mismatch")
+	}
+	subjectLength := int(binary.BigEndian.Uint16(body))
+	if 2+subjectLength > len(body) {
+		return 0, spoolRecord{}, errors.Errorf("invalid spool record subject length %d", subjectLength)
+	}
+	return int64(spoolHeaderSize + length), spoolRecord{
+		subject: string(body[2 : 2+subjectLength]),
+		data:    body[2+subjectLength:],
+	}, nil
+}
+
+// Stats returns how much the spool holds.
+func (s *spool) Stats() spoolStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return spoolStats{
+		Depth:   s.depth,
+		Bytes:   s.size,
+		Dropped: s.dropped,
+	}
+}
+
+// Close stops replaying, and closes the spool. What it still holds
+// is replayed when opened again.
+func (s *spool) Close() error {
+	close(s.quit)
+	<-s.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.tail.Sync(); err != nil {
+		s.tail.Close()
+		return errors.Wrap(err, "error syncing the spool")
+	}
+	return s.tail.Close()
+}
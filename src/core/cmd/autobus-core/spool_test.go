@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// testPublisher records what is published while it is connected,
+// and fails otherwise.
+type testPublisher struct {
+	mu        sync.Mutex
+	connected bool
+	// publishing fails once this many messages are published, if positive
+	failAfter int
+	published []string
+}
+
+func (p *testPublisher) Publish(subject string, data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.connected || (p.failAfter > 0 && len(p.published) >= p.failAfter) {
+		return errors.New("not connected")
+	}
+	p.published = append(p.published, subject+" "+string(data))
+	return nil
+}
+
+func (p *testPublisher) IsConnected() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.connected
+}
+
+func (p *testPublisher) FlushTimeout(time.Duration) error {
+	return nil
+}
+
+func (p *testPublisher) set(connected bool, failAfter int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.connected, p.failAfter = connected, failAfter
+}
+
+func (p *testPublisher) Published() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.published...)
+}
+
+func waitForSpool(t *testing.T, s *spool, depth int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Stats().Depth != depth {
+		if time.Now().After(deadline) {
+			t.Fatalf("Should have %d messages spooled, has %+v", depth, s.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func tempSpoolDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestSpoolReplaysInOrder(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+	pub := &testPublisher{}
+	s, err := openSpool(dir, spoolMaxSizeDefault, pub)
+	if err != nil {
+		t.Fatal("Should open the spool:", err)
+	}
+	defer s.Close()
+
+	var expected []string
+	for i := 0; i < 600; i++ {
+		if err := s.Publish("gps.update.h02", []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal("Should spool the message:", err)
+		}
+		expected = append(expected, fmt.Sprint("gps.update.h02 ", i))
+	}
+	if stats := s.Stats(); stats.Depth != 600 {
+		t.Fatalf("Should have spooled every message, has %+v", stats)
+	}
+
+	pub.set(true, 0)
+	waitForSpool(t, s, 0)
+	s.Publish("gps.update.h02", []byte("600"))
+	expected = append(expected, "gps.update.h02 600")
+
+	published := pub.Published()
+	if len(published) != len(expected) {
+		t.Fatalf("Should have published %d messages, published %d", len(expected), len(published))
+	}
+	for i := range expected {
+		if published[i] != expected[i] {
+			t.Fatalf("Should publish in order: expected %q at %d, got %q", expected[i], i, published[i])
+		}
+	}
+	if stats := s.Stats(); stats.Bytes != 0 {
+		t.Errorf("Should have emptied the spool, has %+v", stats)
+	}
+}
+
+func TestSpoolSurvivesRestarts(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+	pub := &testPublisher{}
+	s, err := openSpool(dir, spoolMaxSizeDefault, pub)
+	if err != nil {
+		t.Fatal("Should open the spool:", err)
+	}
+	for i := 0; i < 2*spoolBatchSize; i++ {
+		s.Publish("gps.alarm", []byte(fmt.Sprint(i)))
+	}
+	// the first batch is delivered, the second fails halfway
+	pub.set(true, spoolBatchSize+spoolBatchSize/2)
+	waitForSpool(t, s, spoolBatchSize)
+	pub.set(false, 0)
+	if err := s.Close(); err != nil {
+		t.Fatal("Should close the spool:", err)
+	}
+
+	// a torn record, as left by a crash while appending
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+spoolSegmentExt))
+	f, err := os.OpenFile(segments[len(segments)-1], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 42, 1, 2})
+	f.Close()
+
+	pub = &testPublisher{}
+	s, err = openSpool(dir, spoolMaxSizeDefault, pub)
+	if err != nil {
+		t.Fatal("Should open the spool again:", err)
+	}
+	defer s.Close()
+	if stats := s.Stats(); stats.Depth != spoolBatchSize {
+		t.Fatalf("Should hold the messages not delivered, holds %+v", stats)
+	}
+	s.Publish("gps.alarm", []byte("last"))
+	pub.set(true, 0)
+	waitForSpool(t, s, 0)
+
+	published := pub.Published()
+	if len(published) != spoolBatchSize+1 {
+		t.Fatalf("Should deliver each message once, delivered %d", len(published))
+	}
+	if published[0] != fmt.Sprint("gps.alarm ", spoolBatchSize) || published[spoolBatchSize] != "gps.alarm last" {
+		t.Errorf("Should resume where it stopped, got %q ... %q", published[0], published[spoolBatchSize])
+	}
+}
+
+func TestSpoolIsBounded(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+	s, err := openSpool(dir, 100, &testPublisher{})
+	if err != nil {
+		t.Fatal("Should open the spool:", err)
+	}
+	defer s.Close()
+	message := make([]byte, 40)
+	for i := 0; i < 3; i++ {
+		err = s.Publish("gps.update", message)
+	}
+	if err != errSpoolFull {
+		t.Error("Should refuse the messages that don't fit, got", err)
+	}
+	if stats := s.Stats(); stats.Depth != 1 || stats.Dropped != 2 {
+		t.Errorf("Should count the messages dropped, got %+v", stats)
+	}
+}
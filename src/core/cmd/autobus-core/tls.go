@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// how long clients have to complete the TLS handshake
+const handshakeTimeout = 10 * time.Second
+
+// certificates is the TLS configuration of a listener, loaded from the
+// files in its spec. It can be reloaded while the listener is serving:
+// the connections made from then on use the new files.
+type certificates struct {
+	certFile, keyFile, caFile string
+
+	mu     sync.RWMutex
+	config *tls.Config
+}
+
+func loadCertificates(certFile, keyFile, caFile string) (*certificates, error) {
+	c := &certificates{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+	}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload reads the files again. If any of them is invalid,
+// the previous configuration is kept.
+func (c *certificates) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return errors.Wrapf(err, "error loading the certificate %s", c.certFile)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.caFile != "" {
+		pem, err := ioutil.ReadFile(c.caFile)
+		if err != nil {
+			return errors.Wrapf(err, "error loading the client CA %s", c.caFile)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.Errorf("no certificates found in the client CA %s", c.caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	c.mu.Lock()
+	c.config = config
+	c.mu.Unlock()
+	return nil
+}
+
+// Config returns the configuration to serve with,
+// which always hands out the latest files loaded.
+func (c *certificates) Config() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.mu.RLock()
+			defer c.mu.RUnlock()
+			return c.config, nil
+		},
+	}
+}
+
+// handshake completes the TLS handshake of conn, if it is a TLS connection,
+// and returns the device ID in its client certificate (its subject's common name),
+// or "" if the client sent none.
+func handshake(conn net.Conn) (deviceID string, err error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+	tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return "", errors.Wrap(err, "TLS handshake failed")
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return certifiedDevice(tlsConn.ConnectionState()), nil
+}
+
+// certifiedDevice returns the device ID in the verified client certificate, if any,
+// as the device IDs of the frames are: with dots and wildcards replaced.
+func certifiedDevice(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return deviceIDReplacer.Replace(state.PeerCertificates[0].Subject.CommonName)
+}
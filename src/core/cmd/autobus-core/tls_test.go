@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for the tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	dir, err := ioutil.TempDir("", "autobus-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &testCA{dir: dir}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "autobus test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	ca.cert, ca.key = ca.issue(t, template, "ca")
+	return ca
+}
+
+// issue signs the template (self signed, if ca has no certificate yet)
+// and writes the certificate and key to <name>.pem and <name>-key.pem.
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate, name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent, signer := template, key
+	if ca.cert != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(ca.path(name), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(ca.path(name+"-key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return cert, key
+}
+
+func (ca *testCA) leaf(t *testing.T, serial int64, commonName, name string) tls.Certificate {
+	ca.issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}, name)
+	cert, err := tls.LoadX509KeyPair(ca.path(name), ca.path(name+"-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func (ca *testCA) path(name string) string {
+	return filepath.Join(ca.dir, name+".pem")
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+func TestHubMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	defer os.RemoveAll(ca.dir)
+	ca.leaf(t, 2, "localhost", "server")
+	client := ca.leaf(t, 3, "1400046168", "client")
+
+	received := make(chan string, 1)
+	h := startTestHub(t, ProtocolFunc(func(msg []byte, from *session) ([]byte, error) {
+		received <- from.DeviceID()
+		return nil, nil
+	}), Listen(listenerSpec{
+		Network: "tcp",
+		Addr:    "127.0.0.1:0",
+		Codec:   "h02",
+		Cert:    ca.path("server"),
+		Key:     ca.path("server-key"),
+		CA:      ca.path("ca"),
+	}))
+	defer h.Stop(context.Background())
+	addr := h.listeners[0].ln.Addr().String()
+
+	dial := func(certs ...tls.Certificate) (*tls.Conn, error) {
+		return tls.Dial("tcp", addr, &tls.Config{
+			RootCAs:      ca.pool(),
+			ServerName:   "localhost",
+			Certificates: certs,
+		})
+	}
+
+	conn, err := dial(client)
+	if err != nil {
+		t.Fatal("Should connect with a client certificate:", err)
+	}
+	conn.Write([]byte(testFrame))
+	if device := <-received; device != "1400046168" {
+		t.Error("Should have identified the device by its certificate, identified:", device)
+	}
+	if serial := conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(); serial != 2 {
+		t.Error("Unexpected server certificate:", serial)
+	}
+
+	// another device through the same connection
+	conn.Write([]byte("*HQ,9999999999,V1,055600,A,2234.3066,N,11351.6829,E,000.0,000,080813,FFFFFBFF#"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Should have closed the connection of another device")
+	}
+	conn.Close()
+
+	if conn, err := dial(); err == nil {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Error("Should not accept connections without a client certificate")
+		}
+		conn.Close()
+	}
+
+	// the server certificate is renewed
+	ca.leaf(t, 4, "localhost", "server")
+	if err := h.ReloadCertificates(); err != nil {
+		t.Fatal("Should reload the certificates:", err)
+	}
+	conn, err = dial(client)
+	if err != nil {
+		t.Fatal("Should connect after reloading:", err)
+	}
+	defer conn.Close()
+	if serial := conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(); serial != 4 {
+		t.Error("Should serve the renewed certificate, serves:", serial)
+	}
+}
+
+func TestHubCertifiedOsmAnd(t *testing.T) {
+	ca := newTestCA(t)
+	defer os.RemoveAll(ca.dir)
+	ca.leaf(t, 2, "localhost", "server")
+	client := ca.leaf(t, 3, "bus.42", "client")
+
+	received := make(chan string, 1)
+	h := startTestHub(t, ProtocolFunc(func(msg []byte, from *session) ([]byte, error) {
+		received <- from.DeviceID()
+		return nil, nil
+	}), Listen(listenerSpec{
+		Network: "http",
+		Addr:    "127.0.0.1:0",
+		Codec:   codecOsmAnd,
+		Cert:    ca.path("server"),
+		Key:     ca.path("server-key"),
+		CA:      ca.path("ca"),
+	}))
+	defer h.Stop(context.Background())
+	url := "https://" + h.servers[0].Addr + "/?lat=-23.5&lon=-46.6&id="
+
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      ca.pool(),
+		ServerName:   "localhost",
+		Certificates: []tls.Certificate{client},
+	}}}
+	// the certificate is compared with the device ID as it is published
+	resp, err := c.Get(url + "bus.42")
+	if err != nil {
+		t.Fatal("Should post the position:", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("Should accept the position of the certified device, status:", resp.StatusCode)
+	}
+	if device := <-received; device != "bus-42" {
+		t.Error("Unexpected device:", device)
+	}
+
+	resp, err = c.Get(url + "bus.43")
+	if err != nil {
+		t.Fatal("Should get a response:", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Error("Should reject the positions of other devices")
+	}
+}
+
+func TestReloadKeepsValidCertificates(t *testing.T) {
+	ca := newTestCA(t)
+	defer os.RemoveAll(ca.dir)
+	ca.leaf(t, 2, "localhost", "server")
+	certs, err := loadCertificates(ca.path("server"), ca.path("server-key"), "")
+	if err != nil {
+		t.Fatal("Should load the certificates:", err)
+	}
+	ioutil.WriteFile(ca.path("server"), []byte("garbage"), 0600)
+	if err := certs.Reload(); err == nil {
+		t.Error("Should fail reloading an invalid certificate")
+	}
+	if config, _ := certs.Config().GetConfigForClient(nil); len(config.Certificates) != 1 {
+		t.Error("Should keep the previous certificate")
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"domain"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// the largest datagram there is
+	maxDatagramSize = 65535
+
+	// UDP has no connections to be closed, so the sessions of
+	// the clients that stopped sending datagrams are closed after a while
+	// (see IdleTimeout), or after this long when there's no idle timeout.
+	datagramSessionTimeout = 5 * time.Minute
+	datagramSweepInterval  = time.Minute
+)
+
+// datagramConn is the connection of a pseudo-session: a client of an udp
+// listener, told apart from the others by its source address.
+//
+// Writes are sent to the client as datagrams. There's nothing to read,
+// since the listener reads the datagrams of every client itself:
+// reads block until the connection is closed.
+type datagramConn struct {
+	pc     net.PacketConn
+	remote net.Addr
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newDatagramConn(pc net.PacketConn, remote net.Addr) *datagramConn {
+	return &datagramConn{
+		pc:     pc,
+		remote: remote,
+		closed: make(chan struct{}),
+	}
+}
+
+func (c *datagramConn) Read(p []byte) (int, error) {
+	<-c.closed
+	return 0, io.EOF
+}
+
+func (c *datagramConn) Write(p []byte) (int, error) {
+	if c.isClosed() {
+		return 0, io.ErrClosedPipe
+	}
+	return c.pc.WriteTo(p, c.remote)
+}
+
+func (c *datagramConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *datagramConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *datagramConn) LocalAddr() net.Addr                { return c.pc.LocalAddr() }
+func (c *datagramConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *datagramConn) SetDeadline(t time.Time) error      { return nil }
+func (c *datagramConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *datagramConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// datagramPeer is a client of an udp listener.
+type datagramPeer struct {
+	conn        *datagramConn
+	session     *session
+	codec       domain.Codec
+	connectedAt time.Time
+	lastSeen    time.Time
+}
+
+// serveDatagrams reads the datagrams sent to an udp listener, until it is closed.
+//
+// Each datagram holds one or more whole frames, which are handled the same
+// way as the frames read from connections: through the sessions of their
+// clients, known by their source addresses.
+func (h *hub) serveDatagrams(l *listener) {
+	defer h.accepting.Done()
+	peers := make(map[string]*datagramPeer)
+	defer func() {
+		for _, p := range peers {
+			h.disconnects.Add(disconnectShutdown)
+			h.sessions.Close(p.session)
+			h.admission.Release(p.conn.remote)
+		}
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	lastSweep := time.Now()
+	for {
+		l.pc.SetReadDeadline(time.Now().Add(datagramSweepInterval))
+		n, addr, err := l.pc.ReadFrom(buf)
+		now := time.Now()
+		if now.Sub(lastSweep) >= datagramSweepInterval {
+			h.sweepPeers(peers, now)
+			lastSweep = now
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			continue
+		}
+		if err != nil {
+			h.report(err)
+			return
+		}
+
+		p, ok := peers[addr.String()]
+		if ok && p.conn.isClosed() {
+			// e.g. the device was identified through another session
+			h.dropPeer(peers, addr.String(), p, disconnectReplaced, nil)
+			ok = false
+		}
+		if !ok {
+			codec, err := l.codecForPrefix(buf[:n])
+			if err != nil {
+				h.metrics.ParseError(parseUnknownCodec)
+				h.logDebug("Dropping datagram from", addr, "@", l.listenerSpec, "reason:", err)
+				continue
+			}
+			// each client counts as a connection
+			if reason := h.admission.Admit(addr); reason != "" {
+				h.disconnects.Add(reason)
+				h.metrics.Rejected(l.Addr, reason)
+				h.Println("Rejecting datagram from", addr, "@", l.listenerSpec, "reason:", reason)
+				continue
+			}
+			conn := newDatagramConn(l.pc, addr)
+			p = &datagramPeer{
+				conn:        conn,
+				session:     h.sessions.Open(conn, l.Addr, l.recorders...),
+				codec:       codec,
+				connectedAt: now,
+			}
+			p.session.SetCodec(codec.Name())
+			peers[addr.String()] = p
+			h.metrics.Accepted(l.Addr)
+		}
+		p.lastSeen = now
+		p.session.Received(buf[:n])
+
+		if err := h.handleDatagram(p, l, buf[:n]); err != nil {
+			h.dropPeer(peers, addr.String(), p, h.disconnectReason(p.session, err), err)
+		}
+	}
+}
+
+// handleDatagram handles each frame in the datagram.
+// It fails when handling them panicked as well, so that only the session
+// of the client is closed (see recoverSession).
+func (h *hub) handleDatagram(p *datagramPeer, l *listener, datagram []byte) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = panicked{v, debug.Stack()}
+		}
+	}()
+	scanner := bufio.NewScanner(bytes.NewReader(datagram))
+	scanner.Buffer(make([]byte, 0, len(datagram)), len(datagram)+1)
+	scanner.Split(p.codec.Split)
+	for scanner.Scan() {
+		frame := make([]byte, len(scanner.Bytes()))
+		copy(frame, scanner.Bytes())
+		if len(frame) > h.maxFrameSize {
+			h.metrics.ParseError(parseOversize)
+			h.logDebug("Discarding", len(frame), "bytes from", p.session.RemoteAddr, "exceeding the maximum frame size")
+			continue
+		}
+		if err := h.handleFrame(p.session, p.codec, l, frame); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// sweepPeers closes the sessions of the clients that went quiet,
+// or that lasted too long (see MaxSessionLifetime).
+func (h *hub) sweepPeers(peers map[string]*datagramPeer, now time.Time) {
+	idle := h.timeouts.Idle
+	if idle <= 0 {
+		idle = datagramSessionTimeout
+	}
+	for addr, p := range peers {
+		switch {
+		case p.conn.isClosed():
+			h.dropPeer(peers, addr, p, disconnectReplaced, nil)
+		case now.Sub(p.lastSeen) >= idle:
+			h.dropPeer(peers, addr, p, disconnectIdle, errors.Errorf("no datagrams for %s", now.Sub(p.lastSeen)))
+		case h.timeouts.Lifetime > 0 && now.Sub(p.connectedAt) >= h.timeouts.Lifetime:
+			h.dropPeer(peers, addr, p, disconnectLifetime, errors.Errorf("connected for %s", now.Sub(p.connectedAt)))
+		}
+	}
+}
+
+// dropPeer closes the session of a client, for the reason given.
+func (h *hub) dropPeer(peers map[string]*datagramPeer, addr string, p *datagramPeer, reason string, err error) {
+	h.disconnected(p.session, reason, err)
+	h.sessions.Close(p.session)
+	h.admission.Release(p.conn.remote)
+	delete(peers, addr)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHubServesDatagrams(t *testing.T) {
+	received := make(chan *session, 4)
+	h := startTestHub(t, ProtocolFunc(func(msg []byte, from *session) ([]byte, error) {
+		received <- from
+		return nil, nil
+	}), Listen(listenerSpec{Network: "udp", Addr: "127.0.0.1:0", Codec: codecAuto}))
+	defer h.Stop(context.Background())
+	addr := h.listeners[0].pc.LocalAddr().String()
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal("Should reach the hub:", err)
+	}
+	defer conn.Close()
+	// two frames in a single datagram, then another datagram
+	conn.Write([]byte(testFrame + testFrame))
+	conn.Write([]byte(testFrame))
+
+	var sessions []*session
+	for i := 0; i < 3; i++ {
+		select {
+		case s := <-received:
+			sessions = append(sessions, s)
+		case <-time.After(time.Second):
+			t.Fatal("Should have handled frame", i)
+		}
+	}
+	if sessions[0] != sessions[1] || sessions[1] != sessions[2] {
+		t.Error("Should handle the datagrams of a client in the same session")
+	}
+	if s, ok := h.Sessions().Lookup("1400046168"); !ok || s != sessions[0] || s.Codec() != "h02" {
+		t.Error("Should have identified the device")
+	}
+	if info := sessions[0].Info(); info.FramesIn != 3 || info.BytesIn != uint64(3*len(testFrame)) {
+		t.Errorf("Unexpected session: %+v", info)
+	}
+}
+
+func TestHubAcknowledgesDatagrams(t *testing.T) {
+	h := startTestHub(t, ProtocolFunc(func([]byte, *session) ([]byte, error) {
+		return nil, nil
+	}), Listen(listenerSpec{Network: "udp", Addr: "127.0.0.1:0", Codec: "gt06"}))
+	defer h.Stop(context.Background())
+
+	conn, err := net.Dial("udp", h.listeners[0].pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal("Should reach the hub:", err)
+	}
+	defer conn.Close()
+	login, _ := hex.DecodeString("78780D01012345678901234500018CDD0D0A")
+	conn.Write(login)
+
+	ack := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(ack)
+	if err != nil {
+		t.Fatal("Should acknowledge the login:", err)
+	}
+	if expected, _ := hex.DecodeString("787805010001D9DC0D0A"); !bytes.Equal(ack[:n], expected) {
+		t.Errorf("Unexpected ack: wanted %X, have %X", expected, ack[:n])
+	}
+}
+
+func TestHubRecoversFromDatagramPanics(t *testing.T) {
+	received := make(chan *session, 1)
+	panics := 1
+	h := startTestHub(t, ProtocolFunc(func(msg []byte, from *session) ([]byte, error) {
+		if panics > 0 {
+			panics--
+			panic("bug")
+		}
+		received <- from
+		return nil, nil
+	}), Listen(listenerSpec{Network: "udp", Addr: "127.0.0.1:0", Codec: "h02"}))
+	defer h.Stop(context.Background())
+
+	conn, err := net.Dial("udp", h.listeners[0].pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal("Should reach the hub:", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(testFrame))
+	conn.Write([]byte(testFrame))
+
+	select {
+	case s := <-received:
+		if s.Closed() {
+			t.Error("Should have handled the next datagram in a new session")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Should still handle datagrams")
+	}
+	counts := h.Disconnects()
+	if len(counts) != 1 || counts[0].Reason != disconnectPanic || counts[0].Count != 1 {
+		t.Errorf("Expected one disconnect for %s, got %+v", disconnectPanic, counts)
+	}
+}
+
+func TestHubAdmitsDatagramClients(t *testing.T) {
+	received := make(chan *session, 4)
+	h := startTestHub(t, ProtocolFunc(func(msg []byte, from *session) ([]byte, error) {
+		received <- from
+		return nil, nil
+	}), Listen(listenerSpec{Network: "udp", Addr: "127.0.0.1:0", Codec: "h02"}), MaxConnectionsPerIP(1))
+	addr := h.listeners[0].pc.LocalAddr().String()
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal("Should reach the hub:", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(testFrame))
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("Should have handled the frame")
+	}
+
+	// another client from the same IP address
+	rejected, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal("Should reach the hub:", err)
+	}
+	defer rejected.Close()
+	rejected.Write([]byte(testFrame))
+	deadline := time.Now().Add(time.Second)
+	for len(h.Disconnects()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if counts := h.Disconnects(); len(counts) != 1 || counts[0].Reason != rejectMaxConnectionsPerIP {
+		t.Errorf("Should count the rejection, got %+v", counts)
+	}
+	select {
+	case <-received:
+		t.Error("Should drop the datagrams of the client over the limit")
+	default:
+	}
+	if connected := h.admission.Connected(); connected != 1 {
+		t.Errorf("Should have admitted a single client, admitted %d", connected)
+	}
+
+	h.Stop(context.Background())
+	if connected := h.admission.Connected(); connected != 0 {
+		t.Errorf("Should release the clients when stopping, %d left", connected)
+	}
+}
@@ -0,0 +1,249 @@
+// Command autobus-replay plays the captures recorded by autobus-core (see
+// the record stage of its pipelines) back against a hub, each connection
+// on its own, at the original speed or faster:
+//
+//	autobus-replay -hub localhost:9009 -speed 10 capture.abcap
+//
+// or decodes the frames in them, without any hub:
+//
+//	autobus-replay -parse -device 1400046168 capture.abcap
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"domain"
+)
+
+var Version string
+
+// connection is a connection of a capture, and its records.
+type connection struct {
+	domain.CaptureConnection
+	id      uint64
+	records []domain.CaptureRecord
+}
+
+// key identifies a connection within a capture.
+type key struct {
+	file, segment int
+	id            uint64
+}
+
+func main() {
+	hubAddr := flag.String("hub", "localhost:9009", "the TCP address of the hub to play the captures back against")
+	speed := flag.Float64("speed", 1, "how many times faster than recorded to play the captures back, or as fast as possible if 0")
+	parse := flag.Bool("parse", false, "decode and print the frames, instead of playing them back")
+	deviceID := flag.String("device", "", "the device of the connections to play back, or any if empty")
+	flag.Parse()
+
+	logger := log.New(os.Stderr, "autobus-replay: ", log.LstdFlags)
+	if flag.NArg() == 0 {
+		logger.Fatal("expected the paths of the captures")
+	}
+	if *speed < 0 {
+		logger.Fatal("the speed can't be negative")
+	}
+
+	var records []domain.CaptureRecord
+	connections := make(map[key]*connection)
+	var order []*connection
+	for i, path := range flag.Args() {
+		err := readCapture(path, func(r domain.CaptureRecord) {
+			k := key{i, r.Segment, r.ConnectionID}
+			c, ok := connections[k]
+			if !ok {
+				c = &connection{id: r.ConnectionID}
+				connections[k] = c
+				order = append(order, c)
+			}
+			// what was learnt about the connection is in its close record,
+			// except in older captures
+			if r.Kind == domain.CaptureOpen || r.Kind == domain.CaptureClose && len(r.Data) > 0 {
+				known, err := r.Connection()
+				if err != nil {
+					logger.Fatal("error while reading ", path, ": ", err)
+				}
+				c.CaptureConnection = known
+			}
+			c.records = append(c.records, r)
+			records = append(records, r)
+		})
+		if err != nil {
+			logger.Fatal("error while reading ", path, ": ", err)
+		}
+	}
+	var selected []*connection
+	for _, c := range order {
+		if *deviceID == "" || c.DeviceID == *deviceID {
+			selected = append(selected, c)
+		}
+	}
+	logger.Println("Version:", Version)
+	logger.Println("Read", len(records), "records of", len(selected), "connections")
+
+	if *parse {
+		for _, c := range selected {
+			printConnection(c)
+		}
+		return
+	}
+	replay(logger, *hubAddr, *speed, selected)
+}
+
+// readCapture reads the records of the capture at path.
+func readCapture(path string, f func(domain.CaptureRecord)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	cr, err := domain.NewCaptureReader(file)
+	if err != nil {
+		return err
+	}
+	for {
+		r, err := cr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		f(r)
+	}
+}
+
+// printConnection prints what the client of the connection sent, and the
+// frames it makes, decoded with its codec, and what it was answered.
+func printConnection(c *connection) {
+	fmt.Printf("connection %d of %s from %s @ %s (%s)\n", c.id, c.DeviceID, c.RemoteAddr, c.Listener, c.Codec)
+	codec, ok := domain.LookupCodec(c.Codec)
+	if !ok {
+		fmt.Printf("\tunknown codec %q, the frames are not decoded\n", c.Codec)
+	}
+	// what was read, and not split into frames yet
+	var pending []byte
+	for _, r := range c.records {
+		at := r.Time.UTC().Format(time.RFC3339Nano)
+		switch r.Kind {
+		case domain.CaptureIn:
+			fmt.Printf("%s <- %q\n", at, r.Data)
+			if ok {
+				pending = printFrames(codec, append(pending, r.Data...), false)
+			}
+		case domain.CaptureOut:
+			fmt.Printf("%s -> %q\n", at, r.Data)
+		case domain.CaptureClose:
+			if ok {
+				printFrames(codec, pending, true)
+			}
+			fmt.Printf("%s closed\n", at)
+		}
+	}
+}
+
+// printFrames prints the frames in data, decoded, and returns what is
+// left of it, the beginning of the next frame.
+func printFrames(codec domain.Codec, data []byte, atEOF bool) []byte {
+	for len(data) > 0 {
+		advance, frame, err := codec.Split(data, atEOF)
+		if err != nil {
+			fmt.Printf("\tunsplittable (%s)\n", err)
+			return nil
+		}
+		if advance == 0 {
+			return data
+		}
+		data = data[advance:]
+		if frame == nil {
+			continue
+		}
+		packet, err := codec.Decode(frame)
+		if err != nil {
+			fmt.Printf("\tframe %q undecodable (%s)\n", frame, err)
+			continue
+		}
+		fmt.Printf("\tframe %T %+v\n", packet, packet)
+	}
+	return data
+}
+
+// replay plays the connections back against the hub, each one on its own,
+// sending what the clients sent, byte for byte, and keeping the time
+// between the records, divided by speed.
+func replay(logger *log.Logger, hubAddr string, speed float64, connections []*connection) {
+	if len(connections) == 0 {
+		return
+	}
+	first := connections[0].records[0].Time
+	for _, c := range connections {
+		if c.records[0].Time.Before(first) {
+			first = c.records[0].Time
+		}
+	}
+	start := time.Now()
+	wait := func(t time.Time) {
+		if speed == 0 {
+			return
+		}
+		at := start.Add(time.Duration(float64(t.Sub(first)) / speed))
+		time.Sleep(time.Until(at))
+	}
+
+	var frames, failed, received int64
+	var wg, reading sync.WaitGroup
+	for _, c := range connections {
+		wg.Add(1)
+		go func(c *connection) {
+			defer wg.Done()
+			var conn net.Conn
+			defer func() {
+				if conn != nil {
+					conn.Close()
+				}
+			}()
+			for _, r := range c.records {
+				wait(r.Time)
+				if conn == nil && r.Kind != domain.CaptureClose {
+					var err error
+					if conn, err = net.Dial("tcp", hubAddr); err != nil {
+						logger.Println("[ERROR] error while connecting for", c.DeviceID, "connection", c.id, "reason:", err)
+						atomic.AddInt64(&failed, 1)
+						return
+					}
+					// what the hub answers is not compared with what was recorded
+					reading.Add(1)
+					go func(conn net.Conn) {
+						defer reading.Done()
+						n, _ := io.Copy(ioutil.Discard, conn)
+						atomic.AddInt64(&received, n)
+					}(conn)
+				}
+				switch r.Kind {
+				case domain.CaptureIn:
+					if _, err := conn.Write(r.Data); err != nil {
+						logger.Println("[ERROR] error while sending the frame of", c.DeviceID, "connection", c.id, "reason:", err)
+						atomic.AddInt64(&failed, 1)
+						return
+					}
+					atomic.AddInt64(&frames, 1)
+				case domain.CaptureClose:
+					return
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+	reading.Wait()
+	logger.Println("Sent", frames, "frames in", time.Since(start), "and received", atomic.LoadInt64(&received), "bytes;", failed, "connections failed")
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"domain"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	knotsPerKmh = 1 / 1.852
+
+	// the stops within this many meters of a bus are the stop it is at
+	atStop = 0.5
+)
+
+// profile is how fast the buses go between the stops.
+type profile struct {
+	// in km/h
+	cruise float64
+	// how much the speed varies around cruise, as a fraction of it
+	jitter float64
+}
+
+var profiles = map[string]profile{
+	"urban":   {cruise: 25, jitter: 0.4},
+	"express": {cruise: 50, jitter: 0.2},
+}
+
+// parseProfile parses the name of a profile, or constant:<km/h>.
+func parseProfile(s string) (profile, error) {
+	if p, ok := profiles[s]; ok {
+		return p, nil
+	}
+	if strings.HasPrefix(s, "constant:") {
+		kmh, err := strconv.ParseFloat(strings.TrimPrefix(s, "constant:"), 64)
+		if err != nil || kmh <= 0 {
+			return profile{}, errors.Errorf("expected a positive speed in km/h, got %q", s)
+		}
+		return profile{cruise: kmh}, nil
+	}
+	return profile{}, errors.Errorf("unknown speed profile %q, expected urban, express or constant:<km/h>", s)
+}
+
+// speed returns a speed of the profile, in km/h.
+func (p profile) speed(r *rand.Rand) float64 {
+	return p.cruise * (1 + p.jitter*(2*r.Float64()-1))
+}
+
+// faults are the misbehaviours of real devices the buses have.
+type faults struct {
+	// the chance of each report to be an invalid fix,
+	// as when the device lost the GPS signal
+	invalid float64
+	// the chance of each report to start a burst: the device holds on to
+	// its reports for a while, then sends them all at once, as when it
+	// lost the network
+	burst float64
+	// the chance of the device to drop its connection and dial again
+	// before each report
+	reconnect float64
+	// up to how far off, ahead or behind, the clock of each device is
+	skew time.Duration
+}
+
+// parseFaults parses a comma separated list of faults, e.g.
+// "invalid=0.05,burst=0.01,reconnect=0.002,skew=5m".
+func parseFaults(s string) (faults, error) {
+	var f faults
+	for _, raw := range strings.Split(s, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		i := strings.Index(raw, "=")
+		if i < 0 {
+			return faults{}, errors.Errorf("expected a fault such as invalid=0.05, got %q (raw: %s)", raw, s)
+		}
+		name, value := raw[:i], raw[i+1:]
+		if name == "skew" {
+			skew, err := time.ParseDuration(value)
+			if err != nil || skew < 0 {
+				return faults{}, errors.Errorf("expected a positive duration for skew, got %q", value)
+			}
+			f.skew = skew
+			continue
+		}
+		chance, err := strconv.ParseFloat(value, 64)
+		if err != nil || chance < 0 || chance > 1 {
+			return faults{}, errors.Errorf("expected a chance in [0, 1] for %s, got %q", name, value)
+		}
+		switch name {
+		case "invalid":
+			f.invalid = chance
+		case "burst":
+			f.burst = chance
+		case "reconnect":
+			f.reconnect = chance
+		default:
+			return faults{}, errors.Errorf("unknown fault %q, expected invalid, burst, reconnect or skew", name)
+		}
+	}
+	return f, nil
+}
+
+// bus is a virtual tracker on a bus going back and forth along a route,
+// dwelling at each stop.
+type bus struct {
+	id      string
+	route   *route
+	profile profile
+	dwell   time.Duration
+	faults  faults
+	rand    *rand.Rand
+
+	// how far off the clock of the device is
+	skew time.Duration
+	// how far along the route the bus is, in meters
+	along   float64
+	forward bool
+	// when the bus leaves the stop it is at, in simulated time
+	leaves time.Time
+}
+
+func newBus(id string, r *route, p profile, dwell time.Duration, f faults, rnd *rand.Rand) *bus {
+	b := &bus{
+		id:      id,
+		route:   r,
+		profile: p,
+		dwell:   dwell,
+		faults:  f,
+		rand:    rnd,
+		along:   rnd.Float64() * r.length(),
+		forward: rnd.Intn(2) == 0,
+	}
+	if f.skew > 0 {
+		b.skew = time.Duration((2*rnd.Float64() - 1) * float64(f.skew))
+	}
+	return b
+}
+
+// move moves the bus for dt, up to now, stopping at the next stop or at
+// the end of the route, and returns its speed, in km/h.
+func (b *bus) move(now time.Time, dt time.Duration) float64 {
+	if now.Before(b.leaves) {
+		return 0
+	}
+	speed := b.profile.speed(b.rand)
+	travel := speed / 3.6 * dt.Seconds()
+	target := b.along - travel
+	if b.forward {
+		target = b.along + travel
+	}
+	if stop, ok := b.nextStop(); ok && (b.forward && stop <= target || !b.forward && stop >= target) {
+		b.along = stop
+		b.stay(now)
+		return 0
+	}
+	if target <= 0 || target >= b.route.length() {
+		// the end of the line: the bus turns around, after a while
+		b.along = math.Max(0, math.Min(target, b.route.length()))
+		b.forward = !b.forward
+		b.stay(now)
+		return 0
+	}
+	b.along = target
+	return speed
+}
+
+// nextStop returns how far along the route the next stop ahead of the bus is.
+func (b *bus) nextStop() (float64, bool) {
+	stops := b.route.stops
+	if b.forward {
+		i := sort.SearchFloat64s(stops, b.along+atStop)
+		if i < len(stops) {
+			return stops[i], true
+		}
+		return 0, false
+	}
+	i := sort.SearchFloat64s(stops, b.along-atStop)
+	if i > 0 {
+		return stops[i-1], true
+	}
+	return 0, false
+}
+
+// stay keeps the bus where it is for about the dwell time.
+func (b *bus) stay(now time.Time) {
+	b.leaves = now.Add(time.Duration((0.5 + b.rand.Float64()) * float64(b.dwell)))
+}
+
+// report returns the frame the device sends at now, going at speed km/h.
+func (b *bus) report(now time.Time, speed float64) ([]byte, error) {
+	p, heading := b.route.position(b.along)
+	if !b.forward {
+		heading = math.Mod(heading+180, 360)
+	}
+	msg := domain.GPSMessage{
+		ID:        b.id,
+		Type:      "V1",
+		Valid:     b.rand.Float64() >= b.faults.invalid,
+		Loc:       &domain.Location{Type: "Point", Coordinates: []float64{p[0], p[1]}},
+		DateTime:  now.Add(b.skew),
+		Speed:     speed * knotsPerKmh,
+		Direction: int64(heading),
+		Status:    "FFFFFBFF",
+	}
+	return msg.MarshalText()
+}
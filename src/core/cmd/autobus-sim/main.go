@@ -0,0 +1,248 @@
+// Command autobus-sim simulates a fleet of buses going along the routes of
+// the lines, dwelling at their stops, each one with a H02 tracker reporting
+// its position to a hub over TCP, like the real ones do:
+//
+//	autobus-sim -hub localhost:9009 -mongo localhost/autobus -buses 50 -faults invalid=0.05,reconnect=0.01
+//
+// The routes and stops are loaded from the backend of autobus-web, or
+// from a GeoJSON file of LineStrings and Points:
+//
+//	autobus-sim -geojson lines.geojson -profile express -accelerate 10
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var Version string
+
+const (
+	dialTimeout = 5 * time.Second
+
+	// how many reports a tracker holds on to while it can't reach the hub
+	maxPending = 500
+)
+
+// simulation is the fleet of buses, and the clock they go by.
+type simulation struct {
+	logger   *log.Logger
+	hubAddr  string
+	interval time.Duration
+	// how many times faster than the wall clock the simulated one goes
+	accelerate float64
+	start      time.Time
+
+	frames, reconnects, failures int64
+}
+
+// now returns the simulated time.
+func (s *simulation) now() time.Time {
+	return s.start.Add(time.Duration(float64(time.Since(s.start)) * s.accelerate))
+}
+
+func main() {
+	hubAddr := flag.String("hub", "localhost:9009", "the TCP address of the hub the trackers report to")
+	mongoURL := flag.String("mongo", "", "the URL of the MongoDB of autobus-web to load the lines and stops from")
+	geojson := flag.String("geojson", "", "a GeoJSON file to load the routes (LineStrings) and stops (Points) from, instead of MongoDB")
+	buses := flag.Int("buses", 10, "how many buses to simulate, spread over the routes")
+	firstID := flag.Uint64("first-id", 9100000000, "the ID of the device of the first bus, the others following it")
+	profileName := flag.String("profile", "urban", "how fast the buses go between the stops: urban, express or constant:<km/h>")
+	dwell := flag.Duration("dwell", 30*time.Second, "about how long the buses stay at each stop, and at the ends of the routes")
+	interval := flag.Duration("interval", 10*time.Second, "how often each tracker reports the position of its bus")
+	accelerate := flag.Float64("accelerate", 1, "how many times faster than real time the buses go, and the trackers report")
+	faultList := flag.String("faults", "", "the faults of the trackers, e.g. invalid=0.05,burst=0.01,reconnect=0.002,skew=5m")
+	duration := flag.Duration("duration", 0, "how long to run for, or until interrupted if 0")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "the seed of the simulation, to run it again")
+	flag.Parse()
+
+	logger := log.New(os.Stderr, "autobus-sim: ", log.LstdFlags)
+	if (*mongoURL == "") == (*geojson == "") {
+		logger.Fatal("expected either -mongo or -geojson")
+	}
+	if *buses <= 0 || *interval <= 0 || *accelerate <= 0 {
+		logger.Fatal("the buses, the interval and the acceleration must be positive")
+	}
+	p, err := parseProfile(*profileName)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	f, err := parseFaults(*faultList)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	var routes []*route
+	if *geojson != "" {
+		routes, err = loadGeoJSONRoutes(*geojson)
+	} else {
+		routes, err = loadBackendRoutes(*mongoURL)
+	}
+	if err != nil {
+		logger.Fatal("error loading the routes: ", err)
+	}
+	if len(routes) == 0 {
+		logger.Fatal("no routes to simulate the buses on")
+	}
+	logger.Println("Version:", Version)
+	for _, r := range routes {
+		logger.Printf("Route %s: %.0f m, %d stops", r.name, r.length(), len(r.stops))
+	}
+
+	s := &simulation{
+		logger:     logger,
+		hubAddr:    *hubAddr,
+		interval:   *interval,
+		accelerate: *accelerate,
+		start:      time.Now(),
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < *buses; i++ {
+		id := fmt.Sprintf("%010d", *firstID+uint64(i))
+		b := newBus(id, routes[i%len(routes)], p, *dwell, f, rand.New(rand.NewSource(*seed+int64(i))))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.track(b, done)
+		}()
+	}
+	logger.Println("Simulating", *buses, "buses on", len(routes), "routes, reporting to", *hubAddr, "with seed", *seed)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	var timeout <-chan time.Time
+	if *duration > 0 {
+		timeout = time.After(*duration)
+	}
+	stats := time.NewTicker(time.Minute)
+	defer stats.Stop()
+loop:
+	for {
+		select {
+		case <-stats.C:
+			s.logStats()
+		case <-stop:
+			break loop
+		case <-timeout:
+			break loop
+		}
+	}
+	close(done)
+	wg.Wait()
+	s.logStats()
+}
+
+func (s *simulation) logStats() {
+	s.logger.Println("Sent", atomic.LoadInt64(&s.frames), "frames, reconnected", atomic.LoadInt64(&s.reconnects), "times and failed to reach the hub", atomic.LoadInt64(&s.failures), "times")
+}
+
+// track moves the bus and reports where it is to the hub, every interval
+// of simulated time, until done is closed.
+func (s *simulation) track(b *bus, done <-chan struct{}) {
+	// so that the trackers don't all report at once
+	select {
+	case <-time.After(time.Duration(b.rand.Int63n(int64(s.period())))):
+	case <-done:
+		return
+	}
+	ticker := time.NewTicker(s.period())
+	defer ticker.Stop()
+
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	var pending [][]byte
+	bursting, reachable := 0, true
+	last := s.now()
+	for {
+		now := s.now()
+		speed := b.move(now, now.Sub(last))
+		last = now
+		frame, err := b.report(now, speed)
+		if err != nil {
+			s.logger.Println("[ERROR] error while encoding the report of", b.id, "reason:", err)
+		} else {
+			pending = append(pending, frame)
+			if len(pending) > maxPending {
+				pending = pending[len(pending)-maxPending:]
+			}
+		}
+
+		if bursting == 0 && b.rand.Float64() < b.faults.burst {
+			bursting = 3 + b.rand.Intn(8)
+		}
+		if bursting > 0 {
+			bursting--
+		} else {
+			if conn != nil && b.rand.Float64() < b.faults.reconnect {
+				conn.Close()
+				conn = nil
+				atomic.AddInt64(&s.reconnects, 1)
+			}
+			if conn == nil {
+				if conn, err = s.dial(); err != nil {
+					// logged once until the hub is reachable again
+					if reachable {
+						s.logger.Println("[ERROR] error while connecting for", b.id, "reason:", err)
+					}
+					reachable = false
+					atomic.AddInt64(&s.failures, 1)
+				} else {
+					reachable = true
+				}
+			}
+			if conn != nil {
+				if _, err := conn.Write(bytes.Join(pending, nil)); err != nil {
+					s.logger.Println("[ERROR] error while sending the reports of", b.id, "reason:", err)
+					conn.Close()
+					conn = nil
+					atomic.AddInt64(&s.failures, 1)
+				} else {
+					atomic.AddInt64(&s.frames, int64(len(pending)))
+					pending = nil
+				}
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// period returns how often, on the wall clock, the trackers report.
+func (s *simulation) period() time.Duration {
+	period := time.Duration(float64(s.interval) / s.accelerate)
+	if period < time.Millisecond {
+		period = time.Millisecond
+	}
+	return period
+}
+
+// dial connects to the hub, discarding what it answers.
+func (s *simulation) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", s.hubAddr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	go io.Copy(ioutil.Discard, conn)
+	return conn, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+
+	"web"
+
+	"github.com/pkg/errors"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	earthRadius = 6371000.0
+
+	// how far from a route, in meters, the stops of a GeoJSON file
+	// can be to be stops of the route
+	stopRadius = 30.0
+)
+
+// point is a GeoJSON position: a longitude and a latitude.
+type point [2]float64
+
+// route is the route of a line, along which buses go back and forth,
+// dwelling at its stops.
+type route struct {
+	name   string
+	points []point
+	// at is how far along the route each point is, in meters
+	at []float64
+	// stops is how far along the route each stop is, in meters, sorted
+	stops []float64
+}
+
+func newRoute(name string, coordinates [][]float64) (*route, error) {
+	r := &route{name: name}
+	for _, c := range coordinates {
+		if len(c) < 2 {
+			return nil, errors.Errorf("route %s has a position without a longitude and a latitude: %v", name, c)
+		}
+		p := point{c[0], c[1]}
+		if len(r.points) > 0 && r.points[len(r.points)-1] == p {
+			continue
+		}
+		along := 0.0
+		if len(r.points) > 0 {
+			along = r.at[len(r.at)-1] + distance(r.points[len(r.points)-1], p)
+		}
+		r.points = append(r.points, p)
+		r.at = append(r.at, along)
+	}
+	if len(r.points) < 2 {
+		return nil, errors.Errorf("route %s needs at least two positions", name)
+	}
+	return r, nil
+}
+
+// length returns the length of the route, in meters.
+func (r *route) length() float64 {
+	return r.at[len(r.at)-1]
+}
+
+// addStop makes p a stop of the route, if it is no farther than
+// maxOffset meters from it, or whatever the distance if maxOffset is 0.
+func (r *route) addStop(p point, maxOffset float64) bool {
+	along, offset := r.project(p)
+	if maxOffset > 0 && offset > maxOffset {
+		return false
+	}
+	r.stops = append(r.stops, along)
+	sort.Float64s(r.stops)
+	return true
+}
+
+// position returns where the bus is when it is d meters along the route,
+// and its heading, in degrees, when going forward.
+func (r *route) position(d float64) (point, float64) {
+	d = math.Max(0, math.Min(d, r.length()))
+	i := sort.SearchFloat64s(r.at, d)
+	if i == 0 {
+		i = 1
+	}
+	a, b := r.points[i-1], r.points[i]
+	t := 0.0
+	if segment := r.at[i] - r.at[i-1]; segment > 0 {
+		t = (d - r.at[i-1]) / segment
+	}
+	return point{a[0] + t*(b[0]-a[0]), a[1] + t*(b[1]-a[1])}, bearing(a, b)
+}
+
+// project returns how far along the route the closest point to p is,
+// and how far from the route p is, in meters.
+func (r *route) project(p point) (along, offset float64) {
+	offset = math.Inf(1)
+	for i := 1; i < len(r.points); i++ {
+		a, b := r.points[i-1], r.points[i]
+		// on a plane tangent to a, which is precise enough for a segment
+		scale := math.Cos(a[1] * math.Pi / 180)
+		bx, by := (b[0]-a[0])*scale, b[1]-a[1]
+		px, py := (p[0]-a[0])*scale, p[1]-a[1]
+		t := 0.0
+		if norm := bx*bx + by*by; norm > 0 {
+			t = math.Max(0, math.Min(1, (px*bx+py*by)/norm))
+		}
+		closest := point{a[0] + t*(b[0]-a[0]), a[1] + t*(b[1]-a[1])}
+		if d := distance(p, closest); d < offset {
+			offset = d
+			along = r.at[i-1] + t*(r.at[i]-r.at[i-1])
+		}
+	}
+	return along, offset
+}
+
+// distance returns the great-circle distance between a and b, in meters.
+func distance(a, b point) float64 {
+	lat1, lat2 := a[1]*math.Pi/180, b[1]*math.Pi/180
+	dLat, dLon := lat2-lat1, (b[0]-a[0])*math.Pi/180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
+
+// bearing returns the initial bearing from a to b, in degrees clockwise from north.
+func bearing(a, b point) float64 {
+	lat1, lat2 := a[1]*math.Pi/180, b[1]*math.Pi/180
+	dLon := (b[0] - a[0]) * math.Pi / 180
+	y := math.Sin(dLon) * math.Cos(lat2)
+	x := math.Cos(lat1)*math.Sin(lat2) - math.Sin(lat1)*math.Cos(lat2)*math.Cos(dLon)
+	return math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+}
+
+// loadBackendRoutes loads the routes of the lines stored in the backend
+// of autobus-web, along with their stops.
+func loadBackendRoutes(mongoURL string) ([]*route, error) {
+	session, err := mgo.Dial(mongoURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error connecting to %s", mongoURL)
+	}
+	defer session.Close()
+	backend := web.NewMongoBackend(session)
+	defer backend.Close()
+
+	lines, err := backend.Lines().GetAll(nil)
+	if err != nil {
+		return nil, err
+	}
+	var routes []*route
+	for _, line := range lines {
+		r, err := newRoute(line.Name, line.Route.Coordinates)
+		if err != nil {
+			return nil, err
+		}
+		ids := make([]bson.ObjectId, len(line.Stops))
+		for i, stop := range line.Stops {
+			ids[i] = stop.ID
+		}
+		stops, err := backend.Stops().GetAll(bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			return nil, err
+		}
+		for _, stop := range stops {
+			if c := stop.Location.Coordinates; len(c) == 2 {
+				r.addStop(point{c[0], c[1]}, 0)
+			}
+		}
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+// featureCollection is a GeoJSON FeatureCollection of routes
+// (LineStrings) and stops (Points), named by their name property.
+type featureCollection struct {
+	Features []struct {
+		Properties struct {
+			Name string `json:"name"`
+		} `json:"properties"`
+		Geometry struct {
+			Type        string          `json:"type"`
+			Coordinates json.RawMessage `json:"coordinates"`
+		} `json:"geometry"`
+	} `json:"features"`
+}
+
+// loadGeoJSONRoutes loads the routes of a GeoJSON file. Its stops are
+// the stops of the routes they lie on.
+func loadGeoJSONRoutes(path string) ([]*route, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading %s", path)
+	}
+	var fc featureCollection
+	if err := json.Unmarshal(raw, &fc); err != nil {
+		return nil, errors.Wrapf(err, "error decoding %s", path)
+	}
+	var routes []*route
+	var stops []point
+	for i, f := range fc.Features {
+		switch f.Geometry.Type {
+		case "LineString":
+			var coordinates [][]float64
+			if err := json.Unmarshal(f.Geometry.Coordinates, &coordinates); err != nil {
+				return nil, errors.Wrapf(err, "error decoding the route of feature %d of %s", i, path)
+			}
+			name := f.Properties.Name
+			if name == "" {
+				name = fmt.Sprintf("route %d", i)
+			}
+			r, err := newRoute(name, coordinates)
+			if err != nil {
+				return nil, err
+			}
+			routes = append(routes, r)
+		case "Point":
+			var c []float64
+			if err := json.Unmarshal(f.Geometry.Coordinates, &c); err != nil || len(c) < 2 {
+				return nil, errors.Errorf("invalid stop in feature %d of %s", i, path)
+			}
+			stops = append(stops, point{c[0], c[1]})
+		}
+	}
+	for _, stop := range stops {
+		for _, r := range routes {
+			r.addStop(stop, stopRadius)
+		}
+	}
+	return routes, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"domain"
+)
+
+// about 1.1 km along the equator, then 1.1 km north
+var testCoordinates = [][]float64{{0, 0}, {0.01, 0}, {0.01, 0.01}}
+
+func TestRoute(t *testing.T) {
+	r, err := newRoute("test", testCoordinates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := r.length(); math.Abs(l-2*1111.95) > 1 {
+		t.Errorf("expected a route of about 2224 m, got %.1f m", l)
+	}
+	p, heading := r.position(r.length() / 4)
+	if math.Abs(p[0]-0.005) > 1e-9 || p[1] != 0 || math.Abs(heading-90) > 1e-6 {
+		t.Errorf("expected to be halfway through the first segment, heading east, got %v heading %.1f", p, heading)
+	}
+	if !r.addStop(point{0.01, 0.005}, stopRadius) {
+		t.Error("expected a stop on the route to be added")
+	}
+	if r.addStop(point{0.005, 0.005}, stopRadius) {
+		t.Error("expected a stop off the route not to be added")
+	}
+	if len(r.stops) != 1 || math.Abs(r.stops[0]-r.length()*3/4) > 1 {
+		t.Errorf("expected a stop three quarters along the route, got %v", r.stops)
+	}
+
+	if _, err := newRoute("short", [][]float64{{0, 0}, {0, 0}}); err == nil {
+		t.Error("expected a route of a single position to be refused")
+	}
+}
+
+func TestLoadGeoJSONRoutes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobus-sim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lines.geojson")
+	err = ioutil.WriteFile(path, []byte(`{"type": "FeatureCollection", "features": [
+		{"type": "Feature", "properties": {"name": "Circular"}, "geometry": {"type": "LineString", "coordinates": [[0, 0], [0.01, 0], [0.01, 0.01]]}},
+		{"type": "Feature", "properties": {"name": "Terminal"}, "geometry": {"type": "Point", "coordinates": [0.0001, 0.0001]}},
+		{"type": "Feature", "properties": {"name": "Elsewhere"}, "geometry": {"type": "Point", "coordinates": [1, 1]}}
+	]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, err := loadGeoJSONRoutes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 1 || routes[0].name != "Circular" || len(routes[0].stops) != 1 {
+		t.Fatalf("expected the route Circular with a stop, got %+v", routes)
+	}
+}
+
+func TestBus(t *testing.T) {
+	r, err := newRoute("test", testCoordinates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.addStop(point{0.01, 0.005}, 0)
+	b := newBus("9100000000", r, profile{cruise: 36}, time.Minute, faults{skew: time.Hour}, rand.New(rand.NewSource(1)))
+	b.along, b.forward = 0, true
+
+	now := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	// 10 m/s, for 100 s
+	if speed := b.move(now, 100*time.Second); speed != 36 || math.Abs(b.along-1000) > 1e-6 {
+		t.Fatalf("expected the bus 1000 m along at 36 km/h, got %.1f m at %.1f km/h", b.along, speed)
+	}
+	frame, err := b.report(now, 36)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec, _ := domain.LookupCodec("h02")
+	packet, err := codec.Decode(frame)
+	if err != nil {
+		t.Fatalf("expected a valid frame, got %q: %v", frame, err)
+	}
+	msg, ok := packet.(*domain.Position)
+	if !ok {
+		t.Fatalf("expected a position, got %T", packet)
+	}
+	if msg.ID != "9100000000" || !msg.Valid || msg.Direction != 90 || math.Abs(msg.Speed-19.4) > 0.05 {
+		t.Errorf("unexpected report %+v", msg)
+	}
+	if skew := msg.DateTime.Sub(now); skew-b.skew >= time.Second || b.skew-skew >= time.Second || skew == 0 {
+		t.Errorf("expected the clock off by %s, got %s", b.skew, skew)
+	}
+
+	// the stop is 1667 m along, reached in the next 100 s, where the bus stays
+	now = now.Add(100 * time.Second)
+	if speed := b.move(now, 100*time.Second); speed != 0 || b.along != r.stops[0] {
+		t.Fatalf("expected the bus at the stop, got %.1f m at %.1f km/h", b.along, speed)
+	}
+	now = now.Add(10 * time.Second)
+	if speed := b.move(now, 10*time.Second); speed != 0 || b.along != r.stops[0] {
+		t.Fatalf("expected the bus to dwell at the stop, got %.1f m at %.1f km/h", b.along, speed)
+	}
+	now = now.Add(2 * time.Minute)
+	b.move(now, 10*time.Second)
+	if b.along <= r.stops[0] {
+		t.Fatalf("expected the bus to leave the stop, got %.1f m", b.along)
+	}
+
+	// then turns around at the end of the route
+	now = now.Add(100 * time.Second)
+	b.move(now, 100*time.Second)
+	if b.forward || b.along != r.length() {
+		t.Errorf("expected the bus to turn around at the end of the route, got %.1f m, forward %v", b.along, b.forward)
+	}
+}
+
+func TestParseFaults(t *testing.T) {
+	f, err := parseFaults("invalid=0.05, burst=0.01,reconnect=0.002,skew=5m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f != (faults{invalid: 0.05, burst: 0.01, reconnect: 0.002, skew: 5 * time.Minute}) {
+		t.Errorf("unexpected faults %+v", f)
+	}
+	for _, invalid := range []string{"invalid", "invalid=2", "late=0.1", "skew=soon"} {
+		if _, err := parseFaults(invalid); err == nil {
+			t.Errorf("expected %q to be refused", invalid)
+		}
+	}
+}
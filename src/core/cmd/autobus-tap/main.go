@@ -0,0 +1,74 @@
+// Command autobus-tap prints the frames autobus-core publishes,
+// of every device, or only of those of a codec, or of a single device.
+//
+//	autobus-tap -nats nats://localhost:4222 -codec h02 -device 1400046168
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"domain"
+
+	"github.com/nats-io/nats"
+)
+
+var Version string
+
+func main() {
+	natsURL := flag.String("nats", nats.DefaultURL, "the NATS URL autobus-core publishes to")
+	codecName := flag.String("codec", "", "the codec of the frames to print, or any if empty")
+	deviceID := flag.String("device", "", "the device of the frames to print, or any if empty")
+	raw := flag.Bool("raw", false, "print the frames as they are, without decoding them")
+	flag.Parse()
+
+	logger := log.New(os.Stderr, "autobus-tap: ", log.LstdFlags)
+	nc, err := nats.Connect(*natsURL)
+	if err != nil {
+		logger.Fatal("error while connecting to nats: ", err)
+	}
+	defer nc.Close()
+	logger.Println("Version:", Version)
+
+	tap := func(m *nats.Msg) {
+		envelope, err := domain.OpenEnvelope(m.Data)
+		if err != nil {
+			logger.Println("[ERROR] error while opening the envelope:", err)
+			return
+		}
+		received := "-"
+		if envelope.Version > 0 {
+			received = envelope.Received().Format(time.RFC3339Nano)
+		}
+		fmt.Printf("%s %s from %s (connection %d @ %s on %s)\n", received, m.Subject,
+			envelope.RemoteAddr, envelope.ConnectionID, envelope.Listener, envelope.InstanceID)
+
+		codec, _ := domain.ParseUpdateSubject(m.Subject)
+		if envelope.Codec != "" {
+			codec = envelope.Codec
+		}
+		if c, ok := domain.LookupCodec(codec); ok && !*raw {
+			packet, err := c.Decode(envelope.Frame)
+			if err == nil {
+				fmt.Printf("\t%T %+v\n", packet, packet)
+				return
+			}
+			fmt.Printf("\tundecodable (%s)\n", err)
+		}
+		fmt.Printf("\t%q\n", envelope.Frame)
+	}
+	for _, subject := range domain.UpdateSubscriptions(*codecName, *deviceID) {
+		if _, err := nc.Subscribe(subject, tap); err != nil {
+			logger.Fatal("error while subscribing to ", subject, ": ", err)
+		}
+		logger.Println("Tapping", subject)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	<-sig
+}
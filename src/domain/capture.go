@@ -0,0 +1,198 @@
+package domain
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CaptureMagic starts every segment of a capture.
+const CaptureMagic = "ABUSCAP1"
+
+// The kinds of the records of a capture.
+const (
+	// a connection was opened: its data is the CaptureConnection
+	CaptureOpen byte = 1
+	// bytes read from the client of the connection, as they were read
+	CaptureIn byte = 2
+	// bytes written to the client of the connection, as they were written
+	CaptureOut byte = 3
+	// the connection was closed: its data is the CaptureConnection as it
+	// was known by then, e.g. with the codec sniffed and the device
+	// identified, or nothing in older captures
+	CaptureClose byte = 4
+)
+
+// maxCaptureRecord bounds the records read, so that a corrupt
+// capture can't make the reader allocate without bounds.
+const maxCaptureRecord = 1 << 20
+
+// CaptureRecord is a record of a capture: the traffic of the connections
+// recorded by autobus-core, in the order it happened.
+//
+// A capture is made of segments, one per run of the recorder, each
+// starting with CaptureMagic, so that captures can be appended to and
+// concatenated. Each record is its kind, the connection it belongs to
+// and the nanoseconds since the previous record of the segment (since
+// the Unix epoch for the first one), as varints, then its data, prefixed
+// by its length.
+type CaptureRecord struct {
+	Kind byte
+	// Segment is the segment of the record: connection IDs are only
+	// unique within a segment.
+	Segment      int
+	ConnectionID uint64
+	Time         time.Time
+	Data         []byte
+}
+
+// CaptureConnection describes a connection recorded.
+type CaptureConnection struct {
+	Listener, RemoteAddr, Codec, DeviceID string
+}
+
+func (c CaptureConnection) encode() []byte {
+	return []byte(strings.Join([]string{c.Listener, c.RemoteAddr, c.Codec, c.DeviceID}, "\x00"))
+}
+
+// Connection returns the connection an open or close record describes.
+func (r CaptureRecord) Connection() (CaptureConnection, error) {
+	fields := bytes.Split(r.Data, []byte{0})
+	if (r.Kind != CaptureOpen && r.Kind != CaptureClose) || len(fields) != 4 {
+		return CaptureConnection{}, errors.Errorf("not a connection (kind %d, data %q)", r.Kind, r.Data)
+	}
+	return CaptureConnection{
+		Listener:   string(fields[0]),
+		RemoteAddr: string(fields[1]),
+		Codec:      string(fields[2]),
+		DeviceID:   string(fields[3]),
+	}, nil
+}
+
+// CaptureWriter writes a segment of a capture.
+// It is not safe to be used concurrently.
+type CaptureWriter struct {
+	w    io.Writer
+	last int64
+	buf  []byte
+}
+
+// NewCaptureWriter starts a segment of a capture on w.
+func NewCaptureWriter(w io.Writer) (*CaptureWriter, error) {
+	if _, err := io.WriteString(w, CaptureMagic); err != nil {
+		return nil, errors.Wrap(err, "error starting the capture")
+	}
+	return &CaptureWriter{w: w}, nil
+}
+
+// Open records the opening of a connection.
+func (cw *CaptureWriter) Open(connection uint64, t time.Time, c CaptureConnection) error {
+	return cw.Write(CaptureOpen, connection, t, c.encode())
+}
+
+// End records the closing of a connection, and what was learnt about it
+// since it was opened.
+func (cw *CaptureWriter) End(connection uint64, t time.Time, c CaptureConnection) error {
+	return cw.Write(CaptureClose, connection, t, c.encode())
+}
+
+// Write writes a record.
+func (cw *CaptureWriter) Write(kind byte, connection uint64, t time.Time, data []byte) error {
+	now := t.UnixNano()
+	var varint [binary.MaxVarintLen64]byte
+	buf := append(cw.buf[:0], kind)
+	buf = append(buf, varint[:binary.PutUvarint(varint[:], connection)]...)
+	buf = append(buf, varint[:binary.PutVarint(varint[:], now-cw.last)]...)
+	buf = append(buf, varint[:binary.PutUvarint(varint[:], uint64(len(data)))]...)
+	buf = append(buf, data...)
+	cw.buf = buf
+	if _, err := cw.w.Write(buf); err != nil {
+		return errors.Wrap(err, "error writing the capture")
+	}
+	cw.last = now
+	return nil
+}
+
+// CaptureReader reads the records of a capture.
+type CaptureReader struct {
+	r       *bufio.Reader
+	segment int
+	last    int64
+}
+
+// NewCaptureReader reads the capture of r, which must start with a segment.
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	cr := &CaptureReader{r: bufio.NewReader(r)}
+	if err := cr.readMagic(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *CaptureReader) readMagic() error {
+	magic := make([]byte, len(CaptureMagic))
+	if _, err := io.ReadFull(cr.r, magic); err != nil || string(magic) != CaptureMagic {
+		return errors.Errorf("not a capture (starts with %q)", magic)
+	}
+	cr.segment++
+	cr.last = 0
+	return nil
+}
+
+// Next returns the next record, or io.EOF at the end of the capture.
+func (cr *CaptureReader) Next() (CaptureRecord, error) {
+	kind, err := cr.r.ReadByte()
+	if err != nil {
+		return CaptureRecord{}, err
+	}
+	if kind == CaptureMagic[0] {
+		cr.r.UnreadByte()
+		if err := cr.readMagic(); err != nil {
+			return CaptureRecord{}, err
+		}
+		return cr.Next()
+	}
+	if kind < CaptureOpen || kind > CaptureClose {
+		return CaptureRecord{}, errors.Errorf("unknown capture record kind %d", kind)
+	}
+	connection, err := binary.ReadUvarint(cr.r)
+	if err != nil {
+		return CaptureRecord{}, errors.Wrap(unexpected(err), "error reading the capture")
+	}
+	delta, err := binary.ReadVarint(cr.r)
+	if err != nil {
+		return CaptureRecord{}, errors.Wrap(unexpected(err), "error reading the capture")
+	}
+	length, err := binary.ReadUvarint(cr.r)
+	if err != nil {
+		return CaptureRecord{}, errors.Wrap(unexpected(err), "error reading the capture")
+	}
+	if length > maxCaptureRecord {
+		return CaptureRecord{}, errors.Errorf("capture record too long (%d bytes)", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(cr.r, data); err != nil {
+		return CaptureRecord{}, errors.Wrap(unexpected(err), "error reading the capture")
+	}
+	cr.last += delta
+	return CaptureRecord{
+		Kind:         kind,
+		Segment:      cr.segment,
+		ConnectionID: connection,
+		Time:         time.Unix(0, cr.last),
+		Data:         data,
+	}, nil
+}
+
+// unexpected turns the end of the capture in the middle of a record into an error.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
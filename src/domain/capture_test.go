@@ -0,0 +1,79 @@
+package domain
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestCaptureRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	start := time.Unix(1491822906, 123456789)
+	conn := CaptureConnection{Listener: "0.0.0.0:9009", RemoteAddr: "10.0.0.5:40000", Codec: "h02", DeviceID: "1400046168"}
+	frame := []byte("*HQ,1400046168,V1,055600,A,2234.3066,N,11351.6829,E,000.0,000,080813,FFFFFBFF#")
+
+	// two runs of the recorder, appending to the same capture
+	for run := 0; run < 2; run++ {
+		cw, err := NewCaptureWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cw.Open(1, start, conn)
+		cw.Write(CaptureIn, 1, start.Add(time.Millisecond), frame)
+		cw.Write(CaptureOut, 1, start.Add(2*time.Millisecond), []byte("ack"))
+		if run == 0 {
+			cw.Write(CaptureClose, 1, start.Add(time.Minute), nil)
+		} else {
+			cw.End(1, start.Add(time.Minute), conn)
+		}
+	}
+
+	cr, err := NewCaptureReader(&buf)
+	if err != nil {
+		t.Fatal("Should read the capture:", err)
+	}
+	var records []CaptureRecord
+	for {
+		r, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal("Should read the records:", err)
+		}
+		records = append(records, r)
+	}
+	if len(records) != 8 {
+		t.Fatalf("Should have read 8 records, read %d", len(records))
+	}
+	for i, r := range records {
+		if r.Segment != 1+i/4 || r.ConnectionID != 1 {
+			t.Errorf("%d: unexpected segment %d and connection %d", i, r.Segment, r.ConnectionID)
+		}
+	}
+	if got, err := records[4].Connection(); err != nil || got != conn {
+		t.Errorf("Should read the connection, got %+v (%v)", got, err)
+	}
+	if !records[5].Time.Equal(start.Add(time.Millisecond)) || !bytes.Equal(records[5].Data, frame) {
+		t.Errorf("Unexpected frame record %+v", records[5])
+	}
+	if !records[7].Time.Equal(start.Add(time.Minute)) || records[7].Kind != CaptureClose {
+		t.Errorf("Unexpected close record %+v", records[7])
+	}
+	if _, err := records[3].Connection(); err == nil {
+		t.Error("Should not read a connection from the close records of older captures")
+	}
+	if got, err := records[7].Connection(); err != nil || got != conn {
+		t.Errorf("Should read the connection of the close record, got %+v (%v)", got, err)
+	}
+
+	if _, err := NewCaptureReader(bytes.NewReader(frame)); err == nil {
+		t.Error("Should not read what is not a capture")
+	}
+	truncated := bytes.NewReader(append([]byte(CaptureMagic), CaptureIn, 1, 2, 10, 'x'))
+	cr, _ = NewCaptureReader(truncated)
+	if _, err := cr.Next(); err == nil || err == io.EOF {
+		t.Error("Should fail reading a truncated record, got", err)
+	}
+}
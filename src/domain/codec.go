@@ -0,0 +1,124 @@
+package domain
+
+import (
+	"sync"
+)
+
+// Codec reads and writes the frames of a tracker protocol.
+//
+// Codecs make themselves available by calling RegisterCodec,
+// so the applications can look them up by name.
+type Codec interface {
+	// Name identifies the codec, e.g. "h02".
+	Name() string
+
+	// Detect reports whether the first bytes sent by a device
+	// look like a frame of this codec.
+	Detect(prefix []byte) bool
+
+	// Split is a bufio.SplitFunc that extracts whole frames from a stream.
+	Split(data []byte, atEOF bool) (advance int, token []byte, err error)
+
+	// Decode parses a single frame. Position reports come out as a *Position;
+	// other frames decode to codec specific packets.
+	Decode(frame []byte) (Packet, error)
+
+	// Encode writes the packet as a single frame.
+	// Codecs only know how to encode some kinds of packets, e.g. *Command.
+	Encode(p Packet) ([]byte, error)
+}
+
+// Packet is the decoded content of a frame,
+// sent by a device or to a device.
+type Packet interface {
+	// Device returns the ID of the device the packet is from, or to.
+	Device() string
+}
+
+// Reply is a Packet acknowledging a command sent to a device.
+type Reply interface {
+	Packet
+	// ReplyTo returns the name of the command being acknowledged.
+	ReplyTo() string
+}
+
+// Replier is implemented by codecs whose devices reply to the commands
+// they are sent, with frames decoding to a Reply.
+type Replier interface {
+	// ReplyKey returns what the Reply of the device to the command
+	// returns from ReplyTo.
+	ReplyKey(c *Command) string
+}
+
+// Acknowledger is implemented by codecs whose devices expect the server
+// to acknowledge the frames they send.
+type Acknowledger interface {
+	// Ack returns what should be sent back to the device after
+	// receiving frame, or nil if it needs no acknowledgement.
+	Ack(frame []byte) []byte
+}
+
+// Identifier is implemented by codecs whose frames don't say which device
+// sent them, so devices must be identified by their connection instead.
+type Identifier interface {
+	// Identify returns the ID of the device, given the first frame it sent
+	// and the banner the listener expects, or "" if the frame is no banner.
+	// Devices without a banner are identified by their address.
+	Identify(first []byte, banner string) string
+}
+
+// Authenticator is implemented by codecs whose devices can present a shared
+// secret along with their ID, e.g. in a login packet or a banner, so the
+// server can tell them from impostors.
+type Authenticator interface {
+	// Secret returns the secret presented in frame, given the banner
+	// the listener expects, or "" if the frame presents none.
+	Secret(frame []byte, banner string) string
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   []Codec
+)
+
+// RegisterCodec makes a codec available by its name.
+// If RegisterCodec is called twice with the same name, it panics.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	for _, registered := range codecs {
+		if registered.Name() == c.Name() {
+			panic("domain: RegisterCodec called twice for codec " + c.Name())
+		}
+	}
+	codecs = append(codecs, c)
+}
+
+// LookupCodec returns the codec registered with the given name.
+func LookupCodec(name string) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	for _, c := range codecs {
+		if c.Name() == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// Codecs returns the registered codecs, in the order they were registered.
+func Codecs() []Codec {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	return append([]Codec(nil), codecs...)
+}
+
+// DetectCodec returns the first registered codec that detects prefix.
+func DetectCodec(prefix []byte) (Codec, bool) {
+	for _, c := range Codecs() {
+		if c.Detect(prefix) {
+			return c, true
+		}
+	}
+	return nil, false
+}
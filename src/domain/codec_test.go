@@ -0,0 +1,121 @@
+package domain
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestH02Codec(t *testing.T) {
+	codec, ok := LookupCodec("h02")
+	if !ok {
+		t.Fatal("Should have registered the h02 codec")
+	}
+	if detected, ok := DetectCodec([]byte("*HQ,")); !ok || detected != codec {
+		t.Error("Should detect h02 frames, detected:", detected)
+	}
+
+	packet, err := codec.Decode([]byte("*HQ,1400046168,V1,055600,A,2234.3066,N,11351.6829,E,000.0,000,080813,FFFFFBFF#"))
+	if err != nil {
+		t.Fatal("Should not fail with a valid message:", err)
+	}
+	position, ok := packet.(*Position)
+	if !ok {
+		t.Fatalf("Should decode a position, decoded %T", packet)
+	}
+	if position.Codec != "h02" || position.Device() != "1400046168" || !position.Valid {
+		t.Error("Unexpected position:", position)
+	}
+
+	packet, err = codec.Decode([]byte("*HQ,1400046168,V4,S71,22,60,130305,130307,A,2234.3066,N,11351.6829,E,000.0,000,100417,FFFFFBFF#"))
+	if err != nil {
+		t.Fatal("Should not fail with a valid reply:", err)
+	}
+	if reply, ok := packet.(Reply); !ok || reply.ReplyTo() != "S71" {
+		t.Errorf("Should decode a reply to S71, decoded %T", packet)
+	}
+
+	command := &Command{DeviceID: "1400046168", Name: "S71", Args: []string{"22", "60"}}
+	raw, err := codec.Encode(command)
+	if err != nil {
+		t.Fatal("Should encode commands:", err)
+	}
+	if key := codec.(Replier).ReplyKey(command); key != "S71" {
+		t.Error("Should await the reply to S71, awaits", key)
+	}
+	if expected := "*HQ,1400046168,S71,000000,22,60#"; string(raw) != expected {
+		t.Errorf("Unexpected command: wanted %s, have %s", expected, raw)
+	}
+}
+
+func TestH02CodecMessages(t *testing.T) {
+	codec, _ := LookupCodec("h02")
+	if detected, ok := DetectCodec(testBinaryFrame(t)[:4]); !ok || detected != codec {
+		t.Error("Should detect binary h02 frames, detected:", detected)
+	}
+	if codec.Detect([]byte("$GPR")) {
+		t.Error("Should not detect h02 on frames that are not BCD")
+	}
+
+	packet, err := codec.Decode(testBinaryFrame(t))
+	if err != nil {
+		t.Fatal("Should not fail with a binary message:", err)
+	}
+	if position, ok := packet.(*Position); !ok || position.Device() != "1400046168" {
+		t.Errorf("Should decode a position, decoded %#v", packet)
+	}
+
+	packet, err = codec.Decode([]byte("*HQ,1400046168,NBR,055600,460,0,1,2,9360,4082,131,9360,4092,148,080813,FFFFFBFF#"))
+	if err != nil {
+		t.Fatal("Should not fail with a cell report:", err)
+	}
+	report, ok := packet.(*H02CellReport)
+	if !ok {
+		t.Fatalf("Should decode a cell report, decoded %T", packet)
+	}
+	expectedCells := []Cell{{9360, 4082, 131}, {9360, 4092, 148}}
+	if report.MCC != 460 || report.TimingAdvance != 1 || !reflect.DeepEqual(report.Cells, expectedCells) {
+		t.Errorf("Unexpected cell report: %+v", report)
+	}
+	if _, err := codec.Decode([]byte("*HQ,1400046168,NBR,055600,460,0,1,3,9360,4082,131,080813,FFFFFBFF#")); err == nil {
+		t.Error("Should fail with missing cells")
+	}
+	// 3 times the count overflows to 2
+	if _, err := codec.Decode([]byte("*HQ,1400046168,NBR,055600,460,0,1,6148914691236517206,9360,4082,080813,FFFFFBFF#")); err == nil {
+		t.Error("Should fail with a count of cells overflowing")
+	}
+
+	packet, err = codec.Decode([]byte("*HQ,1400046168,LINK,055600,20,8,67,0,0,080813,FFFFFBFF#"))
+	if err != nil {
+		t.Fatal("Should not fail with a heartbeat:", err)
+	}
+	heartbeat, ok := packet.(*H02Heartbeat)
+	if !ok {
+		t.Fatalf("Should decode a heartbeat, decoded %T", packet)
+	}
+	expectedTime := time.Date(2013, 8, 8, 5, 56, 0, 0, time.UTC)
+	if heartbeat.GSMSignal != 20 || heartbeat.Satellites != 8 || heartbeat.Battery != 67 || !heartbeat.DateTime.Equal(expectedTime) {
+		t.Errorf("Unexpected heartbeat: %+v", heartbeat)
+	}
+
+	packet, err = codec.Decode([]byte("*HQ,1400046168,XT,V,0,0#"))
+	if err != nil {
+		t.Fatal("Should not fail with a XT heartbeat:", err)
+	}
+	if heartbeat, ok := packet.(*H02Heartbeat); !ok || heartbeat.Type != "XT" || len(heartbeat.Fields) != 3 {
+		t.Errorf("Unexpected heartbeat: %#v", packet)
+	}
+
+	if _, err := codec.Decode([]byte("*HQ,1400046168,WHAT#")); err == nil {
+		t.Error("Should fail with an unknown message type")
+	}
+}
+
+func TestRegisterCodecTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Should panic registering h02 again")
+		}
+	}()
+	RegisterCodec(h02Codec{})
+}
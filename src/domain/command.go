@@ -0,0 +1,78 @@
+package domain
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	mgo "gopkg.in/mgo.v2"
+)
+
+const h02CommandTimeLayout = "150405"
+
+// H02Command is a command sent by the server to a H02 device.
+// e.g. "*HQ,1400046168,S71,130305,22,60#" sets the reporting interval to 60 seconds.
+type H02Command struct {
+	DeviceID string
+	Command  string
+	Args     []string
+	DateTime time.Time
+}
+
+func (c *H02Command) MarshalText() ([]byte, error) {
+	if c.DeviceID == "" {
+		return nil, errors.New("missing the device ID")
+	}
+	if c.Command == "" {
+		return nil, errors.New("missing the command")
+	}
+	parts := []string{"*HQ", c.DeviceID, c.Command, c.DateTime.UTC().Format(h02CommandTimeLayout)}
+	parts = append(parts, c.Args...)
+	for _, p := range parts[1:] {
+		if strings.ContainsAny(p, ",*#") {
+			return nil, errors.Errorf("invalid character in command field (raw: %s)", p)
+		}
+	}
+	return []byte(strings.Join(parts, ",") + "#"), nil
+}
+
+// H02Reply is the acknowledgement of a H02Command, sent back by the device.
+// e.g. "*HQ,1400046168,V4,S71,22,60,130305,130307,A,...#"
+type H02Reply struct {
+	MessageHead string `bson:"head"`
+	ID          string `bson:"gps_id"`
+	Command     string `bson:"command"`
+	// Fields holds everything after the command, unparsed:
+	// the arguments echoed by the device, followed by its position.
+	Fields []string `bson:"fields"`
+}
+
+func (r *H02Reply) Device() string {
+	return r.ID
+}
+
+func (r *H02Reply) ReplyTo() string {
+	return r.Command
+}
+
+func (r *H02Reply) UnmarshalText(raw []byte) error {
+	parts, err := h02Fields(raw)
+	if err != nil {
+		return err
+	}
+	if len(parts) < 4 {
+		return errors.Errorf("the raw data has insufficient data (raw: %s)", raw)
+	}
+	if parts[2] != "V4" {
+		return errors.Errorf("not a reply (type: %s)", parts[2])
+	}
+	r.MessageHead = "*" + parts[0]
+	r.ID = parts[1]
+	r.Command = parts[3]
+	r.Fields = parts[4:]
+	return nil
+}
+
+func (r *H02Reply) Insert(session *mgo.Session) error {
+	return errors.Wrap(session.DB("autobus").C("gps_replies").Insert(r), "error while inserting the reply")
+}
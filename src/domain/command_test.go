@@ -0,0 +1,44 @@
+package domain
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMarshalCommand(t *testing.T) {
+	cmd := H02Command{
+		DeviceID: "1400046168",
+		Command:  "S71",
+		Args:     []string{"22", "60"},
+		DateTime: time.Date(2017, 4, 10, 13, 3, 5, 0, time.UTC),
+	}
+	raw, err := cmd.MarshalText()
+	if err != nil {
+		t.Fatal("Should not fail with a valid command:", err)
+	}
+	if expected := "*HQ,1400046168,S71,130305,22,60#"; string(raw) != expected {
+		t.Errorf("Unexpected command: wanted %s, have %s", expected, raw)
+	}
+
+	cmd.Args = []string{"22#"}
+	if _, err := cmd.MarshalText(); err == nil {
+		t.Error("Should fail with delimiters in the arguments")
+	}
+}
+
+func TestUnmarshalReply(t *testing.T) {
+	rawMessage := []byte("*HQ,1400046168,V4,S71,22,60,130305,130307,A,2234.3066,N,11351.6829,E,000.0,000,100417,FFFFFBFF#")
+
+	var reply H02Reply
+	if err := reply.UnmarshalText(rawMessage); err != nil {
+		t.Fatal("Should not fail with a valid reply:", err)
+	}
+	if reply.ID != "1400046168" || reply.Command != "S71" {
+		t.Error("Unexpected reply:", reply)
+	}
+
+	var position H02Reply
+	if err := position.UnmarshalText([]byte("*HQ,1400046168,V1,055600,A,2234.3066,N,11351.6829,E,000.0,000,080813,FFFFFBFF#")); err == nil {
+		t.Error("Should fail with a position message")
+	}
+}
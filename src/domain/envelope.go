@@ -0,0 +1,74 @@
+package domain
+
+import (
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+// EnvelopeVersion is the version of the envelopes published by this build.
+const EnvelopeVersion = 1
+
+// Envelope is the message described in envelope.proto.
+// The proto package marshals it by its struct tags, so the two must be
+// kept in sync: fields are only ever added, with new numbers.
+type Envelope struct {
+	Version      uint32 `protobuf:"varint,1,opt,name=version" json:"version,omitempty"`
+	Frame        []byte `protobuf:"bytes,2,opt,name=frame,proto3" json:"frame,omitempty"`
+	ReceivedAt   int64  `protobuf:"varint,3,opt,name=received_at,json=receivedAt" json:"received_at,omitempty"`
+	ConnectionID uint64 `protobuf:"varint,4,opt,name=connection_id,json=connectionId" json:"connection_id,omitempty"`
+	RemoteAddr   string `protobuf:"bytes,5,opt,name=remote_addr,json=remoteAddr" json:"remote_addr,omitempty"`
+	Listener     string `protobuf:"bytes,6,opt,name=listener" json:"listener,omitempty"`
+	Codec        string `protobuf:"bytes,7,opt,name=codec" json:"codec,omitempty"`
+	DeviceID     string `protobuf:"bytes,8,opt,name=device_id,json=deviceId" json:"device_id,omitempty"`
+	InstanceID   string `protobuf:"bytes,9,opt,name=instance_id,json=instanceId" json:"instance_id,omitempty"`
+}
+
+func (m *Envelope) Reset()         { *m = Envelope{} }
+func (m *Envelope) String() string { return proto.CompactTextString(m) }
+func (*Envelope) ProtoMessage()    {}
+
+// Received returns when the frame was received.
+func (m *Envelope) Received() time.Time {
+	return time.Unix(0, m.ReceivedAt).UTC()
+}
+
+// Ingestion returns where and when the frame was received,
+// or nil for the legacy frames, which don't say.
+func (m *Envelope) Ingestion() *Ingestion {
+	if m.Version == 0 {
+		return nil
+	}
+	return &Ingestion{
+		ReceivedAt:   m.Received(),
+		ConnectionID: m.ConnectionID,
+		RemoteAddr:   m.RemoteAddr,
+		Listener:     m.Listener,
+		InstanceID:   m.InstanceID,
+	}
+}
+
+// Seal encodes the envelope, setting its version.
+func (m *Envelope) Seal() ([]byte, error) {
+	m.Version = EnvelopeVersion
+	return proto.Marshal(m)
+}
+
+// OpenEnvelope decodes a message published on gps.update.
+//
+// Older cores published the raw frames, which are returned in an envelope
+// with only the frame set, and a zero version.
+func OpenEnvelope(data []byte) (*Envelope, error) {
+	if len(data) == 0 || data[0] != 0x08 {
+		return &Envelope{Frame: data}, nil
+	}
+	m := &Envelope{}
+	if err := proto.Unmarshal(data, m); err != nil {
+		return nil, errors.Wrap(err, "error decoding the envelope")
+	}
+	if m.Version == 0 || m.Version > EnvelopeVersion {
+		return nil, errors.Errorf("unsupported envelope version %d", m.Version)
+	}
+	return m, nil
+}
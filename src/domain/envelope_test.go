@@ -0,0 +1,64 @@
+package domain
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestEnvelope(t *testing.T) {
+	received := time.Date(2017, 4, 10, 11, 15, 6, 500, time.UTC)
+	sealed := Envelope{
+		Frame:        []byte("*HQ,1400046168,V1,055600,A,2234.3066,N,11351.6829,E,000.0,000,080813,FFFFFBFF#"),
+		ReceivedAt:   received.UnixNano(),
+		ConnectionID: 42,
+		RemoteAddr:   "10.0.0.5:40000",
+		Listener:     "0.0.0.0:9009",
+		Codec:        "h02",
+		DeviceID:     "1400046168",
+		InstanceID:   "core-1",
+	}
+	data, err := sealed.Seal()
+	if err != nil {
+		t.Fatal("Should seal the envelope:", err)
+	}
+	if data[0] != 0x08 {
+		t.Fatalf("Should start with the version, starts with %#x", data[0])
+	}
+	opened, err := OpenEnvelope(data)
+	if err != nil {
+		t.Fatal("Should open the envelope:", err)
+	}
+	if !bytes.Equal(opened.Frame, sealed.Frame) || opened.Version != EnvelopeVersion ||
+		opened.ConnectionID != 42 || opened.DeviceID != "1400046168" || opened.InstanceID != "core-1" {
+		t.Errorf("Expected %v, got %v", sealed.String(), opened.String())
+	}
+	ingestion := opened.Ingestion()
+	if ingestion == nil || !ingestion.ReceivedAt.Equal(received) || ingestion.RemoteAddr != "10.0.0.5:40000" || ingestion.Listener != "0.0.0.0:9009" {
+		t.Errorf("Unexpected ingestion: %+v", ingestion)
+	}
+
+	if _, err := OpenEnvelope(append([]byte{0x08, 0x02}, data[2:]...)); err == nil {
+		t.Error("Should not open envelopes of newer versions")
+	}
+}
+
+func TestOpenLegacyFrames(t *testing.T) {
+	frames := [][]byte{
+		[]byte("*HQ,1400046168,V1,055600,A,2234.3066,N,11351.6829,E,000.0,000,080813,FFFFFBFF#"),
+		testBinaryFrame(t),
+		{0x78, 0x78, 0x0d, 0x01, 0x01, 0x23, 0x45, 0x67, 0x89, 0x01, 0x23, 0x45, 0x00, 0x01, 0x8c, 0xdd, 0x0d, 0x0a},
+		[]byte("$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*6A\r\n"),
+		[]byte("id=123456&lat=-23.5&lon=-46.6&timestamp=1491822906"),
+	}
+	for _, frame := range frames {
+		envelope, err := OpenEnvelope(frame)
+		if err != nil {
+			t.Errorf("Should take the raw frame %q, got %s", frame, err)
+			continue
+		}
+		if envelope.Version != 0 || !bytes.Equal(envelope.Frame, frame) || envelope.Ingestion() != nil {
+			t.Errorf("Should wrap the raw frame %q as it is, got %v", frame, envelope.String())
+		}
+	}
+}
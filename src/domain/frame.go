@@ -0,0 +1,96 @@
+package domain
+
+import "bytes"
+
+const (
+	// h02BinaryLength is the length of binary H02 frames ("$...").
+	h02BinaryLength = 32
+	// the device ID starting binary frames, in BCD
+	h02BinaryIDLength = 5
+)
+
+// SplitH02 is a bufio.SplitFunc that extracts complete H02 frames
+// ("*HQ,...#", or the binary "$..." ones) from a stream of bytes,
+// such as a TCP connection.
+//
+// Anything between frames is discarded. If a frame is interrupted by the
+// beginning of another one (e.g. the device rebooted mid-sentence), the
+// broken part is dropped and the newest frame is returned instead.
+func SplitH02(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	for {
+		start := bytes.IndexAny(data[advance:], "*$")
+		if start == -1 {
+			// no frame starts here, throw the noise away
+			return len(data), nil, nil
+		}
+		start += advance
+
+		if data[start] == '$' {
+			// binary frames start with the device ID: a "$" followed
+			// by anything else is noise, which must not swallow
+			// the frames after it
+			id := data[start+1:]
+			if len(id) > h02BinaryIDLength {
+				id = id[:h02BinaryIDLength]
+			}
+			if !isBCD(id) {
+				advance = start + 1
+				continue
+			}
+			// binary frames have a fixed length, and no delimiter at the end
+			if len(data)-start < h02BinaryLength {
+				if atEOF {
+					return len(data), nil, nil
+				}
+				return start, nil, nil
+			}
+			return start + h02BinaryLength, data[start : start+h02BinaryLength], nil
+		}
+
+		end := bytes.IndexByte(data[start:], '#')
+		if end == -1 {
+			if atEOF {
+				// the frame will never be completed
+				return len(data), nil, nil
+			}
+			// drop whatever comes before the frame and wait for more data
+			return start, nil, nil
+		}
+		end += start
+
+		// resynchronize on the last beginning before the end
+		start += bytes.LastIndexByte(data[start:end], '*')
+		return end + 1, data[start : end+1], nil
+	}
+}
+
+// DetectH02 reports whether the first bytes of a stream look like a H02 frame.
+func DetectH02(prefix []byte) bool {
+	if len(prefix) == 0 {
+		return false
+	}
+	if prefix[0] == '$' {
+		// binary frames start with the device ID, in BCD,
+		// which could still be mistaken for a NMEA sentence ("$GPRMC,...")
+		return isBCD(prefix[1:]) && !isUpper(prefix[1:])
+	}
+	return prefix[0] == '*'
+}
+
+func isBCD(b []byte) bool {
+	for _, c := range b {
+		if c>>4 > 9 || c&0x0F > 9 {
+			return false
+		}
+	}
+	return true
+}
+
+func isUpper(b []byte) bool {
+	for _, c := range b {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return len(b) > 0
+}
@@ -0,0 +1,54 @@
+package domain
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func scanH02(t *testing.T, stream string) []string {
+	scanner := bufio.NewScanner(strings.NewReader(stream))
+	scanner.Split(SplitH02)
+	var frames []string
+	for scanner.Scan() {
+		frames = append(frames, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal("Should not fail scanning:", err)
+	}
+	return frames
+}
+
+func TestSplitH02(t *testing.T) {
+	frame := "*HQ,1400046168,V1,055600,A,2234.3066,N,11351.6829,E,000.0,000,080813,FFFFFBFF#"
+	binary := string(testBinaryFrame(t))
+	tests := []struct {
+		name   string
+		stream string
+		want   []string
+	}{
+		{"Single", frame, []string{frame}},
+		{"Coalesced", frame + frame, []string{frame, frame}},
+		{"Noise", "\r\n" + frame + "garbage\r\n" + frame + "\r\n", []string{frame, frame}},
+		{"Interrupted", frame[:40] + frame, []string{frame}},
+		{"Incomplete", frame + frame[:40], []string{frame}},
+		{"Binary", frame + binary + frame, []string{frame, binary, frame}},
+		{"Incomplete binary", frame + binary[:20], []string{frame}},
+		{"Stray dollar", "\r\n$\r\n" + frame + "$GP" + frame + "$", []string{frame, frame}},
+		{"Empty", "", nil},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(tt *testing.T) {
+			frames := scanH02(tt, test.stream)
+			if len(frames) != len(test.want) {
+				tt.Fatalf("Should have %d frames, has %d: %q", len(test.want), len(frames), frames)
+			}
+			for i := range frames {
+				if frames[i] != test.want[i] {
+					tt.Errorf("Unexpected frame %d: wanted %q, have %q", i, test.want[i], frames[i])
+				}
+			}
+		})
+	}
+}
@@ -2,12 +2,14 @@ package domain
 
 import (
 	"bytes"
+	"encoding/hex"
+	"fmt"
+	"math"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/pkg/errors"
-	mgo "gopkg.in/mgo.v2"
 )
 
 const stupidDateTimeLayout = "020106150405"
@@ -22,6 +24,9 @@ type GPSMessage struct {
 	Speed       float64
 	Direction   int64
 	Status      string
+	// Extra holds the fields some firmwares append after the status
+	// (e.g. the cell tower the device is connected to), unparsed.
+	Extra []string
 }
 
 func (msg *GPSMessage) UnmarshalText(raw []byte) (err error) {
@@ -36,6 +41,9 @@ func (msg *GPSMessage) UnmarshalText(raw []byte) (err error) {
 	if end == -1 {
 		return errors.New("malformed message: no end")
 	}
+	if end < beginning {
+		return errors.New("malformed message: the end comes before the beginning")
+	}
 
 	raw = raw[beginning:end]
 	if len(raw) < 60 {
@@ -44,6 +52,9 @@ func (msg *GPSMessage) UnmarshalText(raw []byte) (err error) {
 
 	rawStr := string(raw)
 	parts := strings.Split(rawStr, ",")
+	if len(parts) < 13 {
+		return errors.Errorf("the raw data has insufficient fields (raw: %s)", rawStr)
+	}
 	msg.MessageHead = parts[0]
 	msg.ID = parts[1]
 	msg.Type = parts[2]
@@ -61,7 +72,7 @@ func (msg *GPSMessage) UnmarshalText(raw []byte) (err error) {
 	}
 
 	msg.Loc = new(Location)
-	if err := msg.Loc.UnmarshalText(raw[27:51]); err != nil {
+	if err := msg.Loc.UnmarshalText([]byte(strings.Join(parts[5:9], ","))); err != nil {
 		return errors.Wrapf(err, "error while decoding latitude/longitude information")
 	}
 
@@ -90,24 +101,139 @@ func (msg *GPSMessage) UnmarshalText(raw []byte) (err error) {
 		return errors.Wrapf(err, "error decoding time (raw: time: %s - date: %s)", timePart, datePart)
 	}
 	msg.Status = parts[12]
+	if len(parts) > 13 {
+		msg.Extra = parts[13:]
+	}
 	return nil
 }
 
-func (m *GPSMessage) Insert(session *mgo.Session) error {
-	transient := session.DB("autobus").C("gps_data_transient")
-	persisted := session.DB("autobus").C("gps_data")
-	if err := transient.Insert(m); err != nil {
-		return errors.Wrap(err, "error while inserting to a transient collection")
+// MarshalText encodes the message as a H02 text frame, e.g.
+// "*HQ,1400046168,V1,055600,A,2234.3066,N,11351.6829,E,000.0,000,080813,FFFFFBFF#".
+// Messages decoded from binary frames are encoded as text frames as well.
+func (msg *GPSMessage) MarshalText() ([]byte, error) {
+	if msg.ID == "" {
+		return nil, errors.New("missing the device ID")
+	}
+	if msg.Loc == nil {
+		return nil, errors.New("missing the location")
 	}
-	if err := persisted.Insert(m); err != nil {
-		return errors.Wrap(err, "error while inserting to a persisted collection")
+	head := msg.MessageHead
+	if !strings.HasPrefix(head, "*") {
+		head = "*HQ"
+	}
+	messageType := msg.Type
+	if messageType == "" {
+		messageType = "V1"
+	}
+	valid := "V"
+	if msg.Valid {
+		valid = "A"
+	}
+	loc, err := msg.Loc.MarshalText()
+	if err != nil {
+		return nil, errors.Wrap(err, "error encoding the location")
+	}
+	dt := msg.DateTime.UTC()
+
+	parts := []string{
+		head,
+		msg.ID,
+		messageType,
+		dt.Format(stupidDateTimeLayout[6:]),
+		valid,
+		string(loc),
+		fmt.Sprintf("%05.1f", msg.Speed),
+		fmt.Sprintf("%03d", msg.Direction),
+		dt.Format(stupidDateTimeLayout[:6]),
+		msg.Status,
+	}
+	parts = append(parts, msg.Extra...)
+	for _, p := range append([]string{msg.ID, messageType, msg.Status}, msg.Extra...) {
+		if strings.ContainsAny(p, ",*#") {
+			return nil, errors.Errorf("invalid character in message field (raw: %s)", p)
+		}
+	}
+	return []byte(strings.Join(parts, ",") + "#"), nil
+}
+
+// UnmarshalBinary parses the binary H02 frames, which devices send instead
+// of the V1 text ones when flushing the positions they buffered.
+// Most of the frame is BCD encoded:
+//
+//	$  ID  hhmmss  ddmmyy  DDMMmmmm  battery  DDDMMmmmm  flags  speed  course  status    ...
+//	1  5   3       3       4         1        4.5        0.5    1.5    1.5     4 (hex)   3
+func (msg *GPSMessage) UnmarshalBinary(raw []byte) (err error) {
+	if len(raw) < h02BinaryLength || raw[0] != '$' {
+		return errors.Errorf("malformed binary message (raw: %X)", raw)
+	}
+	if !isBCD(raw[1:12]) {
+		return errors.Errorf("the ID or date is not BCD encoded (raw: %X)", raw)
+	}
+	digits := strings.ToUpper(hex.EncodeToString(raw[1:h02BinaryLength]))
+
+	msg.MessageHead = "$"
+	msg.ID = digits[0:10]
+	msg.Type = "V1"
+
+	flags, err := strconv.ParseUint(digits[41:42], 16, 8)
+	if err != nil {
+		return errors.Wrapf(err, "error decoding flags (raw: %X)", raw)
+	}
+	msg.Valid = flags&0x02 != 0
+
+	latitudeDir, longitudeDir := "S", "W"
+	if flags&0x04 != 0 {
+		latitudeDir = "N"
+	}
+	if flags&0x08 != 0 {
+		longitudeDir = "E"
+	}
+	loc := fmt.Sprintf("%s.%s,%s,%s.%s,%s", digits[22:26], digits[26:30], latitudeDir, digits[32:37], digits[37:41], longitudeDir)
+	msg.Loc = new(Location)
+	if err := msg.Loc.UnmarshalText([]byte(loc)); err != nil {
+		return errors.Wrapf(err, "error while decoding latitude/longitude information")
+	}
+
+	msg.Speed, err = strconv.ParseFloat(digits[42:45], 64)
+	if err != nil {
+		return errors.Wrapf(err, "error decoding speed (raw: %s)", digits[42:45])
 	}
+	msg.Direction, err = strconv.ParseInt(digits[45:48], 10, 64)
+	if err != nil {
+		return errors.Wrapf(err, "error decoding direction (raw: %s)", digits[45:48])
+	}
+
+	msg.DateTime, err = time.Parse(stupidDateTimeLayout, digits[16:22]+digits[10:16])
+	if err != nil {
+		return errors.Wrapf(err, "error decoding time (raw: time: %s - date: %s)", digits[10:16], digits[16:22])
+	}
+	msg.Status = digits[48:56]
 	return nil
 }
 
+// Position returns the position reported by the message.
+// A status that cannot be decoded is kept as is, without a state.
+func (msg *GPSMessage) Position() *Position {
+	state, _ := DecodeH02Status(msg.Status)
+	return &Position{
+		Codec:       "h02",
+		MessageHead: msg.MessageHead,
+		ID:          msg.ID,
+		Type:        msg.Type,
+		Valid:       msg.Valid,
+		Loc:         msg.Loc,
+		DateTime:    msg.DateTime,
+		Speed:       msg.Speed,
+		Direction:   msg.Direction,
+		Status:      msg.Status,
+		State:       state,
+	}
+}
+
+// Location is a GeoJSON point.
 type Location struct {
-	Type        string
-	Coordinates []float64
+	Type        string    `bson:"type" json:"type"`
+	Coordinates []float64 `bson:"coordinates" json:"coordinates"`
 }
 
 func (l *Location) UnmarshalText(raw []byte) error {
@@ -116,20 +242,26 @@ func (l *Location) UnmarshalText(raw []byte) error {
 	}
 	rawStr := string(raw)
 	parts := strings.Split(rawStr, ",")
+	if len(parts) != 4 {
+		return errors.Errorf("expected a latitude and a longitude, with their directions (raw: %s)", rawStr)
+	}
 
 	// Latitude
 
 	// Degree
 	latitudePart := parts[0]
+	if len(latitudePart) <= 2 {
+		return errors.Errorf("the latitude is too short (raw: %s)", latitudePart)
+	}
 	latitudeDegree, err := strconv.ParseInt(latitudePart[:2], 10, 64)
 	if err != nil {
-		return errors.Wrapf(err, "error decoding the latitude degree (raw: %s)", latitudeDegree)
+		return errors.Wrapf(err, "error decoding the latitude degree (raw: %s)", latitudePart)
 	}
 
 	// Minute
 	latitudeMinute, err := strconv.ParseFloat(latitudePart[2:], 64)
 	if err != nil {
-		return errors.Wrapf(err, "error decoding the latitude minute (raw: %s)", latitudeMinute)
+		return errors.Wrapf(err, "error decoding the latitude minute (raw: %s)", latitudePart)
 	}
 
 	// Direction
@@ -137,13 +269,13 @@ func (l *Location) UnmarshalText(raw []byte) error {
 	if latitudeDir != "S" && latitudeDir != "N" {
 		return errors.Errorf("latitude direction should be either S or N (south or north), it is %s", latitudeDir)
 	}
-	if "S" == latitudeDir {
-		latitudeDegree = -latitudeDegree
-	}
 	// End Latitude
 
 	// Longitude
 	longitudePart := parts[2]
+	if len(longitudePart) <= 3 {
+		return errors.Errorf("the longitude is too short (raw: %s)", longitudePart)
+	}
 
 	// Degree
 	longitudeDegree, err := strconv.ParseFloat(longitudePart[:3], 64)
@@ -154,7 +286,7 @@ func (l *Location) UnmarshalText(raw []byte) error {
 	// Minute
 	longitudeMinute, err := strconv.ParseFloat(longitudePart[3:], 64)
 	if err != nil {
-		return errors.Wrapf(err, "error decoding the latitude minute (raw: %s)", latitudePart)
+		return errors.Wrapf(err, "error decoding the longitude minute (raw: %s)", longitudePart)
 	}
 
 	// Direction
@@ -162,18 +294,45 @@ func (l *Location) UnmarshalText(raw []byte) error {
 	if longitudeDir != "E" && longitudeDir != "W" {
 		return errors.Errorf("longitude direction should be either E or W (east or west), it is %s", longitudeDir)
 	}
-	if "W" == longitudeDir {
-		longitudeDegree = -longitudeDegree
-	}
 	// End Longitude
 
-	// convert the thing
+	// convert the thing, the minutes have the same sign as the degree
 	latitude := float64(latitudeDegree) + (latitudeMinute / 60)
 	longitude := float64(longitudeDegree) + (longitudeMinute / 60)
+	if "S" == latitudeDir {
+		latitude = -latitude
+	}
+	if "W" == longitudeDir {
+		longitude = -longitude
+	}
 
-	// TODO: use the minutes as part of the full latitude/longitude information
 	// Location is a GeoJSON value
 	l.Type = "Point"
 	l.Coordinates = []float64{float64(longitude), float64(latitude)}
 	return nil
 }
+
+// MarshalText encodes the location the way H02 devices do, e.g. "2234.3066,N,11351.6829,E".
+func (l *Location) MarshalText() ([]byte, error) {
+	if len(l.Coordinates) != 2 {
+		return nil, errors.Errorf("a location needs a longitude and a latitude, it has %v", l.Coordinates)
+	}
+	latitude := degreesMinutes(l.Coordinates[1], 2, "N", "S")
+	longitude := degreesMinutes(l.Coordinates[0], 3, "E", "W")
+	return []byte(latitude + "," + longitude), nil
+}
+
+// degreesMinutes formats the coordinate as degrees and minutes
+// (DDMM.mmmm, or DDDMM.mmmm for longitudes), followed by its hemisphere.
+// The hemisphere of zero is kept, thanks to the sign bit of -0.
+func degreesMinutes(coordinate float64, degreeDigits int, positive, negative string) string {
+	hemisphere := positive
+	if math.Signbit(coordinate) {
+		hemisphere = negative
+		coordinate = -coordinate
+	}
+	// in ten thousandths of a minute, so that rounding can carry into the degree
+	minutes := int64(math.Floor(coordinate*60*10000 + 0.5))
+	degree, minutes := minutes/(60*10000), minutes%(60*10000)
+	return fmt.Sprintf("%0*d%02d.%04d,%s", degreeDigits, degree, minutes/10000, minutes%10000, hemisphere)
+}
@@ -1,6 +1,10 @@
 package domain
 
-import "testing"
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
 
 func TestCorrectMessage(t *testing.T) {
 	rawMessage := []byte("*HQ,1400046168,V1,055600,A,2234.3066,N,11351.6829,E,000.0,000,080813,FFFFFBFF#")
@@ -20,6 +24,24 @@ func TestInvalidMessage(t *testing.T) {
 	}
 }
 
+func TestMalformedMessages(t *testing.T) {
+	for _, raw := range []string{
+		// an empty latitude, shifting the fields
+		"*HQ,1400046168,V1,055600,A,,2234.3066,N,11351.6829,E,000.0,000,080813,FFFFFBFF#",
+		// a comma in the longitude
+		"*HQ,1400046168,V1,055600,A,2234.3066,N,11,351.6829,E,000.0,000,080813,FFFFFBFF#",
+		"*HQ,1400046168,V1,055600,A,22,N,11351.6829,E,000.0,000,080813,FFFFFBFF#########",
+		"*HQ,1400046168,V1,055600,A,2234.3066,N,113,E,000.0,000,080813,FFFFFBFF##########",
+		// the end before the beginning
+		"#HQ,1400046168,V1,055600,A,2234.3066,N,11351.6829,E,000.0,000,080813,FFFFFBFF*",
+	} {
+		var gpsMessage GPSMessage
+		if err := gpsMessage.UnmarshalText([]byte(raw)); err == nil {
+			t.Errorf("Should fail with a malformed message: %s", raw)
+		}
+	}
+}
+
 func TestLongitudeAndLatitude(t *testing.T) {
 	rawMessage := []byte("*HQ,1400046168,V1,055600,A,2234.3066,N,11351.6829,E,000.0,000,080813,FFFFFBFF#")
 
@@ -55,3 +77,115 @@ func TestGPSMessageIsInvalid(t *testing.T) {
 		t.Error("Message should be invalid")
 	}
 }
+
+// testBinaryFrame is the binary version of the V1 message used across these tests.
+func testBinaryFrame(t *testing.T) []byte {
+	raw, err := hex.DecodeString("1400046168" + "055600" + "080813" + "22343066" + "FF" + "113516829" + "E" + "000" + "000" + "FFFFFBFF" + "000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte("$"), raw...)
+}
+
+func TestBinaryMessage(t *testing.T) {
+	var binary, text GPSMessage
+	if err := binary.UnmarshalBinary(testBinaryFrame(t)); err != nil {
+		t.Fatal("Should not fail with a valid binary message:", err)
+	}
+	if err := text.UnmarshalText([]byte("*HQ,1400046168,V1,055600,A,2234.3066,N,11351.6829,E,000.0,000,080813,FFFFFBFF#")); err != nil {
+		t.Fatal("Should not fail with a valid message:", err)
+	}
+	text.MessageHead = "$"
+	if !reflect.DeepEqual(binary, text) {
+		t.Errorf("Should decode the same message as the text one:\nwanted %+v\nhave   %+v", text, binary)
+	}
+
+	frame := testBinaryFrame(t)
+	frame[1] = 0xAB
+	if err := binary.UnmarshalBinary(frame); err == nil {
+		t.Error("Should fail with an ID that is not BCD")
+	}
+}
+
+func TestSouthernAndWesternHemispheres(t *testing.T) {
+	rawMessage := []byte("*HQ,1400046168,V1,121506,A,2330.5000,S,04637.2500,W,000.0,000,100417,FFFFFBFF#")
+
+	var gpsMessage GPSMessage
+	if err := gpsMessage.UnmarshalText(rawMessage); err != nil {
+		t.Fatal("Should not fail with a valid message:", err)
+	}
+
+	expectedLongitude := -(46 + (37.25 / 60))
+	if gpsMessage.Loc.Coordinates[0] != expectedLongitude {
+		t.Errorf("Unexpected longitude: wanted %f, have %f", expectedLongitude, gpsMessage.Loc.Coordinates[0])
+	}
+
+	expectedLatitude := -(23 + (30.5 / 60))
+	if gpsMessage.Loc.Coordinates[1] != expectedLatitude {
+		t.Errorf("Unexpected latitude: wanted %f, have %f", expectedLatitude, gpsMessage.Loc.Coordinates[1])
+	}
+}
+
+// h02Corpus holds frames as sent by devices around the world.
+var h02Corpus = []string{
+	"*HQ,1400046168,V1,055600,A,2234.3066,N,11351.6829,E,000.0,000,080813,FFFFFBFF#",
+	"*HQ,1400046168,V1,055600,V,2234.3066,N,11351.6829,E,000.0,000,080813,FFFFFFFE#",
+	"*HQ,4209951296,V1,121506,A,2330.4890,S,04637.9137,W,034.6,247,100417,FFFFFBFF#",
+	"*HQ,4210051415,V1,164549,A,0956.3869,N,08406.7068,W,000.0,000,221215,FFFFFBFF,712,01,0,0,6#",
+	"*HQ,353588020068342,V1,000000,V,0000.0000,S,00000.0000,W,000.0,000,010100,FFFDFFFF#",
+	"*HQ,8800000015,V1,195940,A,3744.6010,S,14456.9100,E,102.5,359,311216,FFFF9FFF#",
+	"*HQ,1451316485,V1,235959,A,5131.0712,N,00007.6054,W,012.3,090,291217,7FFFFBFF#",
+	"*HQ,1451316485,V1,000001,A,0000.0001,N,00000.0001,E,000.1,001,010118,FFFFFBFF#",
+}
+
+func TestGPSMessageRoundTrip(t *testing.T) {
+	for _, frame := range h02Corpus {
+		frame := frame
+		t.Run(frame, func(tt *testing.T) {
+			var msg GPSMessage
+			if err := msg.UnmarshalText([]byte(frame)); err != nil {
+				tt.Fatal("Should not fail with a valid message:", err)
+			}
+			raw, err := msg.MarshalText()
+			if err != nil {
+				tt.Fatal("Should encode the message:", err)
+			}
+			if string(raw) != frame {
+				tt.Errorf("Should encode the same frame:\nwanted %s\nhave   %s", frame, raw)
+			}
+		})
+	}
+}
+
+func TestBinaryMessageMarshalsToText(t *testing.T) {
+	var msg GPSMessage
+	if err := msg.UnmarshalBinary(testBinaryFrame(t)); err != nil {
+		t.Fatal("Should not fail with a valid binary message:", err)
+	}
+	raw, err := msg.MarshalText()
+	if err != nil {
+		t.Fatal("Should encode the message:", err)
+	}
+	if expected := "*HQ,1400046168,V1,055600,A,2234.3066,N,11351.6829,E,000.0,000,080813,FFFFFBFF#"; string(raw) != expected {
+		t.Errorf("Unexpected frame:\nwanted %s\nhave   %s", expected, raw)
+	}
+}
+
+func TestGPSMessageMarshalInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  GPSMessage
+	}{
+		{"No ID", GPSMessage{Loc: &Location{Coordinates: []float64{0, 0}}}},
+		{"No location", GPSMessage{ID: "1400046168"}},
+		{"Separator in the status", GPSMessage{ID: "1400046168", Loc: &Location{Coordinates: []float64{0, 0}}, Status: "FF,FF"}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(tt *testing.T) {
+			if _, err := test.msg.MarshalText(); err == nil {
+				tt.Error("Should fail encoding the message")
+			}
+		})
+	}
+}
@@ -0,0 +1,363 @@
+package domain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	RegisterCodec(gt06Codec{})
+}
+
+// GT06 protocol numbers
+const (
+	gt06Login    byte = 0x01
+	gt06GPS      byte = 0x10
+	gt06Location byte = 0x12
+	gt06Status   byte = 0x13
+	gt06Alarm    byte = 0x16
+	gt06Command  byte = 0x80
+	// the replies to the commands, the newer devices sending the latter
+	gt06Reply     byte = 0x15
+	gt06ReplyInfo byte = 0x21
+)
+
+// knots per km/h: H02 devices report the speed in knots,
+// so GT06 speeds are converted for positions to be comparable.
+const knotsPerKmh = 1 / 1.852
+
+var gt06Stop = []byte{0x0D, 0x0A}
+
+// gt06Codec is the codec of the GT06 (a.k.a. Concox) binary protocol.
+//
+// Every frame looks like this:
+//
+//	start  length  protocol  content  serial  crc  stop
+//	7878   1 byte  1 byte    n bytes  2       2    0D0A
+//
+// Frames starting with 7979 have a 2 bytes length instead.
+// The length counts from the protocol number up to the crc, and the crc
+// (CRC-ITU) covers from the length up to the serial number.
+//
+// Only the login frame carries the ID of the device, so the other packets
+// decoded by this codec belong to whichever device logged in on the connection.
+type gt06Codec struct{}
+
+func (gt06Codec) Name() string {
+	return "gt06"
+}
+
+func (gt06Codec) Detect(prefix []byte) bool {
+	return bytes.HasPrefix(prefix, []byte{0x78, 0x78}) || bytes.HasPrefix(prefix, []byte{0x79, 0x79})
+}
+
+// gt06FrameLength returns the total length of the frame starting at data,
+// or 0 if there is not enough data to know it yet.
+func gt06FrameLength(data []byte) int {
+	switch {
+	case len(data) >= 3 && data[0] == 0x78 && data[1] == 0x78:
+		return 2 + 1 + int(data[2]) + 2
+	case len(data) >= 4 && data[0] == 0x79 && data[1] == 0x79:
+		return 2 + 2 + int(binary.BigEndian.Uint16(data[2:4])) + 2
+	}
+	return 0
+}
+
+func (c gt06Codec) Split(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	for {
+		start := bytes.IndexAny(data[advance:], "\x78\x79")
+		if start == -1 {
+			return len(data), nil, nil
+		}
+		advance += start
+		frame := data[advance:]
+		if len(frame) >= 2 && !c.Detect(frame) {
+			// not a start after all
+			advance++
+			continue
+		}
+
+		length := gt06FrameLength(frame)
+		if length == 0 || len(frame) < length {
+			if atEOF {
+				return len(data), nil, nil
+			}
+			return advance, nil, nil
+		}
+		if !bytes.Equal(frame[length-2:length], gt06Stop) {
+			// either noise or a corrupted frame, look for the next one
+			advance++
+			continue
+		}
+		return advance + length, frame[:length], nil
+	}
+}
+
+// gt06Header is what every GT06 frame has in common.
+type gt06Header struct {
+	Protocol byte
+	Serial   uint16
+}
+
+// gt06Unwrap validates the frame and returns its header and content.
+func gt06Unwrap(frame []byte) (h gt06Header, content []byte, err error) {
+	length := gt06FrameLength(frame)
+	if length == 0 || length != len(frame) {
+		return h, nil, errors.Errorf("gt06: malformed frame (raw: %X)", frame)
+	}
+	if !bytes.Equal(frame[length-2:], gt06Stop) {
+		return h, nil, errors.Errorf("gt06: no stop bits (raw: %X)", frame)
+	}
+
+	lengthSize := 1
+	if frame[0] == 0x79 {
+		lengthSize = 2
+	}
+	body := frame[2 : length-4] // length up to the serial
+	if len(body) < lengthSize+1+2 {
+		return h, nil, errors.Errorf("gt06: frame too short (raw: %X)", frame)
+	}
+	expected := binary.BigEndian.Uint16(frame[length-4 : length-2])
+	if actual := crcITU(body); actual != expected {
+		return h, nil, errors.Errorf("gt06: crc mismatch, expected %04X, have %04X (raw: %X)", expected, actual, frame)
+	}
+
+	h.Protocol = body[lengthSize]
+	h.Serial = binary.BigEndian.Uint16(body[len(body)-2:])
+	return h, body[lengthSize+1 : len(body)-2], nil
+}
+
+// gt06Wrap builds a short frame with the given content.
+func gt06Wrap(protocol byte, serial uint16, content []byte) []byte {
+	frame := []byte{0x78, 0x78, byte(1 + len(content) + 2 + 2), protocol}
+	frame = append(frame, content...)
+	frame = append(frame, byte(serial>>8), byte(serial))
+	crc := crcITU(frame[2:])
+	frame = append(frame, byte(crc>>8), byte(crc))
+	return append(frame, gt06Stop...)
+}
+
+func (gt06Codec) Decode(frame []byte) (Packet, error) {
+	h, content, err := gt06Unwrap(frame)
+	if err != nil {
+		return nil, err
+	}
+	switch h.Protocol {
+	case gt06Login:
+		if len(content) < 8 {
+			return nil, errors.Errorf("gt06: login too short (raw: %X)", frame)
+		}
+		return &GT06Login{
+			DeviceID: strings.TrimPrefix(hex.EncodeToString(content[:8]), "0"),
+			Serial:   h.Serial,
+		}, nil
+	case gt06GPS, gt06Location:
+		return decodeGT06Position(h, content)
+	case gt06Alarm:
+		p, err := decodeGT06Position(h, content)
+		if err != nil {
+			return nil, err
+		}
+		// after the gps: lbs length, then the lbs itself, then the status
+		if len(content) < 19 {
+			return nil, errors.Errorf("gt06: alarm too short (raw: %X)", frame)
+		}
+		lbs := 18 + int(content[18])
+		if len(content) < lbs+5 {
+			return nil, errors.Errorf("gt06: alarm too short (raw: %X)", frame)
+		}
+		p.Status = fmt.Sprintf("%X", content[lbs:lbs+5])
+		return p, nil
+	case gt06Status:
+		if len(content) < 5 {
+			return nil, errors.Errorf("gt06: status too short (raw: %X)", frame)
+		}
+		return &GT06Status{
+			Serial:       h.Serial,
+			TerminalInfo: content[0],
+			Voltage:      content[1],
+			GSMSignal:    content[2],
+			Alarm:        content[3],
+			Language:     content[4],
+		}, nil
+	case gt06Reply:
+		// command length (the server flag included), server flag, command
+		if len(content) < 5 || len(content) < 1+int(content[0]) || content[0] < 4 {
+			return nil, errors.Errorf("gt06: reply too short (raw: %X)", frame)
+		}
+		return &GT06Reply{
+			Serial:     h.Serial,
+			ServerFlag: binary.BigEndian.Uint32(content[1:5]),
+			Text:       string(content[5 : 1+content[0]]),
+		}, nil
+	case gt06ReplyInfo:
+		// server flag, encoding (1 for ASCII, 2 for UTF-16), command
+		if len(content) < 5 {
+			return nil, errors.Errorf("gt06: reply too short (raw: %X)", frame)
+		}
+		text := string(content[5:])
+		if content[4] == 2 {
+			units := make([]uint16, (len(content)-5)/2)
+			for i := range units {
+				units[i] = binary.BigEndian.Uint16(content[5+2*i:])
+			}
+			text = string(utf16.Decode(units))
+		}
+		return &GT06Reply{
+			Serial:     h.Serial,
+			ServerFlag: binary.BigEndian.Uint32(content[:4]),
+			Text:       text,
+		}, nil
+	default:
+		return nil, errors.Errorf("gt06: unsupported protocol number %02X", h.Protocol)
+	}
+}
+
+// decodeGT06Position decodes the gps part shared by the position and alarm packets:
+//
+//	date time  satellites  latitude  longitude  speed  course/status
+//	6 bytes    1 byte      4 bytes   4 bytes    1      2 bytes
+func decodeGT06Position(h gt06Header, content []byte) (*Position, error) {
+	if len(content) < 18 {
+		return nil, errors.Errorf("gt06: position too short (raw: %X)", content)
+	}
+	dt := time.Date(2000+int(content[0]), time.Month(content[1]), int(content[2]),
+		int(content[3]), int(content[4]), int(content[5]), 0, time.UTC)
+
+	// in minutes * 30000
+	latitude := float64(binary.BigEndian.Uint32(content[7:11])) / 30000 / 60
+	longitude := float64(binary.BigEndian.Uint32(content[11:15])) / 30000 / 60
+	courseStatus := binary.BigEndian.Uint16(content[16:18])
+	if courseStatus&0x0400 == 0 {
+		latitude = -latitude
+	}
+	if courseStatus&0x0800 != 0 {
+		longitude = -longitude
+	}
+
+	return &Position{
+		Codec: "gt06",
+		Type:  fmt.Sprintf("%02X", h.Protocol),
+		Valid: courseStatus&0x1000 != 0,
+		Loc: &Location{
+			Type:        "Point",
+			Coordinates: []float64{longitude, latitude},
+		},
+		DateTime:  dt,
+		Speed:     float64(content[15]) * knotsPerKmh,
+		Direction: int64(courseStatus & 0x03FF),
+	}, nil
+}
+
+// Ack returns the acknowledgement the server must send for the frame.
+// Devices stop talking to the server when their logins are not acknowledged.
+func (gt06Codec) Ack(frame []byte) []byte {
+	h, _, err := gt06Unwrap(frame)
+	if err != nil {
+		return nil
+	}
+	switch h.Protocol {
+	case gt06Login, gt06Status, gt06Alarm:
+		return gt06Wrap(h.Protocol, h.Serial, nil)
+	}
+	return nil
+}
+
+// gt06CommandText returns the text of the command, e.g. "DYD,000000#",
+// and the server flag it is sent with, which the device sends back in
+// its reply.
+func gt06CommandText(c *Command) (text string, serverFlag uint32) {
+	text = strings.Join(append([]string{c.Name}, c.Args...), ",") + "#"
+	return text, crc32.ChecksumIEEE([]byte(text))
+}
+
+// Encode encodes commands, e.g. "DYD,000000" (cut off the fuel) or "WHERE".
+func (gt06Codec) Encode(p Packet) ([]byte, error) {
+	switch p := p.(type) {
+	case *Command:
+		command, serverFlag := gt06CommandText(p)
+		// command length (the server flag included), server flag, command
+		content := []byte{byte(4 + len(command)), 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(content[1:], serverFlag)
+		content = append(content, command...)
+		return gt06Wrap(gt06Command, 1, content), nil
+	default:
+		return nil, errors.Errorf("gt06: cannot encode %T", p)
+	}
+}
+
+// ReplyKey returns the server flag the command is sent with, in hex: the
+// replies don't say which command they are about, but they carry its flag.
+func (gt06Codec) ReplyKey(c *Command) string {
+	_, serverFlag := gt06CommandText(c)
+	return fmt.Sprintf("%08X", serverFlag)
+}
+
+// GT06Login is the first packet a GT06 device sends.
+type GT06Login struct {
+	// DeviceID is the IMEI of the device.
+	DeviceID string
+	Serial   uint16
+}
+
+func (l *GT06Login) Device() string {
+	return l.DeviceID
+}
+
+// GT06Status is the heartbeat of GT06 devices.
+type GT06Status struct {
+	Serial       uint16
+	TerminalInfo byte
+	// Voltage goes from 0 (no power) to 6 (full)
+	Voltage   byte
+	GSMSignal byte
+	Alarm     byte
+	Language  byte
+}
+
+// Device returns an empty string: the status doesn't identify the device.
+func (s *GT06Status) Device() string {
+	return ""
+}
+
+// GT06Reply is the reply of a GT06 device to a command,
+// e.g. "Cut off the fuel supply: Success!" for "DYD,000000#".
+type GT06Reply struct {
+	Serial uint16
+	// ServerFlag is the flag the command was sent with (see ReplyKey).
+	ServerFlag uint32
+	Text       string
+}
+
+// Device returns an empty string: the reply doesn't identify the device.
+func (r *GT06Reply) Device() string {
+	return ""
+}
+
+func (r *GT06Reply) ReplyTo() string {
+	return fmt.Sprintf("%08X", r.ServerFlag)
+}
+
+// crcITU is the CRC-16/X-25 checksum used by GT06 devices.
+func crcITU(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0x8408
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return ^crc
+}
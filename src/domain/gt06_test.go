@@ -0,0 +1,146 @@
+package domain
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"math"
+	"testing"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestGT06Login(t *testing.T) {
+	codec, _ := LookupCodec("gt06")
+	frame := mustDecodeHex(t, "78780D01012345678901234500018CDD0D0A")
+
+	packet, err := codec.Decode(frame)
+	if err != nil {
+		t.Fatal("Should not fail with a valid login:", err)
+	}
+	login, ok := packet.(*GT06Login)
+	if !ok {
+		t.Fatalf("Should decode a login, decoded %T", packet)
+	}
+	if login.Device() != "123456789012345" {
+		t.Error("Unexpected device ID:", login.Device())
+	}
+
+	ack := codec.(Acknowledger).Ack(frame)
+	if expected := mustDecodeHex(t, "787805010001D9DC0D0A"); !bytes.Equal(ack, expected) {
+		t.Errorf("Unexpected ack: wanted %X, have %X", expected, ack)
+	}
+
+	frame[5] = 0xFF
+	if _, err := codec.Decode(frame); err == nil {
+		t.Error("Should fail with a wrong crc")
+	}
+}
+
+func TestGT06Location(t *testing.T) {
+	codec, _ := LookupCodec("gt06")
+	frame := gt06Wrap(gt06Location, 3, mustDecodeHex(t, "0B081D112E10CC027AC7EB0C46584900148F01CC00287D001FB8"))
+
+	packet, err := codec.Decode(frame)
+	if err != nil {
+		t.Fatal("Should not fail with a valid location:", err)
+	}
+	position, ok := packet.(*Position)
+	if !ok {
+		t.Fatalf("Should decode a position, decoded %T", packet)
+	}
+	if !position.Valid || position.Direction != 143 || position.DateTime.Format("2006-01-02 15:04:05") != "2011-08-29 17:46:16" {
+		t.Error("Unexpected position:", position)
+	}
+	if lon, lat := position.Loc.Coordinates[0], position.Loc.Coordinates[1]; math.Abs(lat-23.111668) > 1e-6 || math.Abs(lon-114.409285) > 1e-6 {
+		t.Error("Unexpected coordinates:", position.Loc.Coordinates)
+	}
+	if ack := codec.(Acknowledger).Ack(frame); ack != nil {
+		t.Errorf("Should not acknowledge locations, acked %X", ack)
+	}
+}
+
+func TestGT06Split(t *testing.T) {
+	codec, _ := LookupCodec("gt06")
+	login := mustDecodeHex(t, "78780D01012345678901234500018CDD0D0A")
+	heartbeat := gt06Wrap(gt06Status, 2, []byte{0x40, 0x04, 0x04, 0x00, 0x01})
+	stream := append(append(append([]byte{0x78, 0x00, 0x13}, login...), heartbeat...), login[:5]...)
+
+	scanner := bufio.NewScanner(bytes.NewReader(stream))
+	scanner.Split(codec.Split)
+	var frames [][]byte
+	for scanner.Scan() {
+		frames = append(frames, append([]byte(nil), scanner.Bytes()...))
+	}
+	if len(frames) != 2 || !bytes.Equal(frames[0], login) || !bytes.Equal(frames[1], heartbeat) {
+		t.Fatalf("Unexpected frames: %X", frames)
+	}
+
+	packet, err := codec.Decode(frames[1])
+	if err != nil {
+		t.Fatal("Should not fail with a valid heartbeat:", err)
+	}
+	if status, ok := packet.(*GT06Status); !ok || status.Voltage != 4 {
+		t.Errorf("Unexpected heartbeat: %#v", packet)
+	}
+}
+
+func TestGT06CommandReply(t *testing.T) {
+	codec, _ := LookupCodec("gt06")
+	command := &Command{DeviceID: "123456789012345", Name: "DYD", Args: []string{"000000"}}
+	frame, err := codec.Encode(command)
+	if err != nil {
+		t.Fatal("Should encode the command:", err)
+	}
+	_, content, err := gt06Unwrap(frame)
+	if err != nil {
+		t.Fatal("Should encode a valid frame:", err)
+	}
+	if int(content[0]) != len(content)-1 || string(content[5:]) != "DYD,000000#" {
+		t.Fatalf("Unexpected command: %X", frame)
+	}
+	serverFlag := content[1:5]
+	key := codec.(Replier).ReplyKey(command)
+
+	// the device sends the server flag back, with its reply
+	text := "Cut off the fuel supply: Success!"
+	replies := []struct {
+		name  string
+		frame []byte
+		text  string
+	}{
+		{"Reply", gt06Wrap(gt06Reply, 5, append(append([]byte{byte(4 + len(text))}, serverFlag...), text...)), text},
+		// the language follows the text
+		{"Reply with language", gt06Wrap(gt06Reply, 5, append(append(append([]byte{byte(4 + len(text))}, serverFlag...), text...), 0x00, 0x02)), text},
+		{"Information", gt06Wrap(gt06ReplyInfo, 5, append(append(append([]byte(nil), serverFlag...), 1), text...)), text},
+		{"Information in UTF-16", gt06Wrap(gt06ReplyInfo, 5, append(append([]byte(nil), serverFlag...), 2, 0, 'O', 0, 'K')), "OK"},
+	}
+	for _, tc := range replies {
+		packet, err := codec.Decode(tc.frame)
+		if err != nil {
+			t.Errorf("%s: should decode the reply: %v", tc.name, err)
+			continue
+		}
+		reply, ok := packet.(*GT06Reply)
+		if !ok {
+			t.Errorf("%s: should decode a reply, decoded %T", tc.name, packet)
+			continue
+		}
+		if reply.ReplyTo() != key || reply.Text != tc.text {
+			t.Errorf("%s: should reply %q to %s, replied %+v", tc.name, tc.text, key, reply)
+		}
+	}
+
+	if other := codec.(Replier).ReplyKey(&Command{Name: "HFYD"}); other == key {
+		t.Error("Should tell the replies to other commands apart")
+	}
+	if _, err := codec.Decode(gt06Wrap(gt06Reply, 5, []byte{40, 0, 0})); err == nil {
+		t.Error("Should fail with a truncated reply")
+	}
+}
@@ -0,0 +1,88 @@
+package domain
+
+import (
+	"github.com/pkg/errors"
+)
+
+func init() {
+	RegisterCodec(h02Codec{})
+}
+
+// h02Codec is the codec of the H02 protocol, spoken by the trackers
+// sending "*HQ,...#" frames. They send binary "$..." positions as well.
+type h02Codec struct{}
+
+func (h02Codec) Name() string {
+	return "h02"
+}
+
+func (h02Codec) Detect(prefix []byte) bool {
+	return DetectH02(prefix)
+}
+
+func (h02Codec) Split(data []byte, atEOF bool) (int, []byte, error) {
+	return SplitH02(data, atEOF)
+}
+
+func (h02Codec) Decode(frame []byte) (Packet, error) {
+	if len(frame) > 0 && frame[0] == '$' {
+		var msg GPSMessage
+		if err := msg.UnmarshalBinary(frame); err != nil {
+			return nil, err
+		}
+		return msg.Position(), nil
+	}
+
+	parts, err := h02Fields(frame)
+	if err != nil {
+		return nil, err
+	}
+	switch parts[2] {
+	case "V4":
+		reply := new(H02Reply)
+		if err := reply.UnmarshalText(frame); err != nil {
+			return nil, err
+		}
+		return reply, nil
+	case "NBR":
+		report := new(H02CellReport)
+		if err := report.UnmarshalText(frame); err != nil {
+			return nil, err
+		}
+		return report, nil
+	case "LINK", "XT":
+		heartbeat := new(H02Heartbeat)
+		if err := heartbeat.UnmarshalText(frame); err != nil {
+			return nil, err
+		}
+		return heartbeat, nil
+	default:
+		// V1, and the positions of firmwares that name them otherwise
+		var msg GPSMessage
+		if err := msg.UnmarshalText(frame); err != nil {
+			return nil, errors.Wrapf(err, "h02: unsupported message type %s", parts[2])
+		}
+		return msg.Position(), nil
+	}
+}
+
+func (h02Codec) Encode(p Packet) ([]byte, error) {
+	switch p := p.(type) {
+	case *Command:
+		cmd := H02Command{
+			DeviceID: p.DeviceID,
+			Command:  p.Name,
+			Args:     p.Args,
+			DateTime: p.DateTime,
+		}
+		return cmd.MarshalText()
+	default:
+		return nil, errors.Errorf("h02: cannot encode %T", p)
+	}
+}
+
+// ReplyKey returns the name of the command, which the devices reply
+// with, e.g. S71 in "*HQ,1400046168,V4,S71,...#".
+func (h02Codec) ReplyKey(c *Command) string {
+	return c.Name
+}
@@ -0,0 +1,166 @@
+package domain
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// h02Fields returns the comma separated fields of a H02 text frame,
+// between the "*" and the "#".
+func h02Fields(raw []byte) ([]string, error) {
+	beginning := bytes.IndexByte(raw, '*')
+	end := bytes.LastIndexByte(raw, '#')
+	if beginning == -1 || end < beginning {
+		return nil, errors.New("malformed message: no beginning or end")
+	}
+	parts := strings.Split(string(raw[beginning+1:end]), ",")
+	if len(parts) < 3 {
+		return nil, errors.Errorf("the raw data has insufficient data (raw: %s)", raw)
+	}
+	return parts, nil
+}
+
+// h02Ints parses each of the fields as an integer.
+func h02Ints(fields ...string) ([]int, error) {
+	ints := make([]int, len(fields))
+	for i, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error decoding field %d (raw: %s)", i, f)
+		}
+		ints[i] = n
+	}
+	return ints, nil
+}
+
+// Cell is a cell tower seen by a device.
+type Cell struct {
+	LAC  int `bson:"lac"`
+	CID  int `bson:"cid"`
+	RSSI int `bson:"rssi"`
+}
+
+// H02CellReport lists the cell towers a H02 device sees,
+// which is what it sends instead of its position when it has no GPS fix.
+// e.g. "*HQ,1400046168,NBR,055600,460,0,1,2,9360,4082,131,9360,4092,148,080813,FFFFFBFF#"
+type H02CellReport struct {
+	ID            string    `bson:"gps_id"`
+	DateTime      time.Time `bson:"datetime"`
+	MCC           int       `bson:"mcc"`
+	MNC           int       `bson:"mnc"`
+	TimingAdvance int       `bson:"ta"`
+	Cells         []Cell    `bson:"cells"`
+	Status        string    `bson:"status"`
+}
+
+func (r *H02CellReport) Device() string {
+	return r.ID
+}
+
+func (r *H02CellReport) UnmarshalText(raw []byte) error {
+	parts, err := h02Fields(raw)
+	if err != nil {
+		return err
+	}
+	if parts[2] != "NBR" {
+		return errors.Errorf("not a cell report (type: %s)", parts[2])
+	}
+	// id, NBR, time, mcc, mnc, ta, count, cells..., date, status
+	if len(parts) < 9 {
+		return errors.Errorf("the raw data has insufficient fields (raw: %s)", raw)
+	}
+	header, err := h02Ints(parts[3:8]...)
+	if err != nil {
+		return errors.Wrapf(err, "error decoding the cell report (raw: %s)", raw)
+	}
+	count := header[4]
+	// bounded first, so that a huge count can't overflow the number of fields
+	if count < 0 || count > len(parts) || len(parts) != 8+3*count+2 {
+		return errors.Errorf("the cell report should have %d cells (raw: %s)", count, raw)
+	}
+
+	r.ID = parts[1]
+	r.MCC, r.MNC, r.TimingAdvance = header[1], header[2], header[3]
+	r.Cells = make([]Cell, count)
+	for i := range r.Cells {
+		cell, err := h02Ints(parts[8+3*i : 8+3*i+3]...)
+		if err != nil {
+			return errors.Wrapf(err, "error decoding cell %d (raw: %s)", i, raw)
+		}
+		r.Cells[i] = Cell{LAC: cell[0], CID: cell[1], RSSI: cell[2]}
+	}
+
+	timePart, datePart := parts[3], parts[len(parts)-2]
+	r.DateTime, err = time.Parse(stupidDateTimeLayout, datePart+timePart)
+	if err != nil {
+		return errors.Wrapf(err, "error decoding time (raw: time: %s - date: %s)", timePart, datePart)
+	}
+	r.Status = parts[len(parts)-1]
+	return nil
+}
+
+func (r *H02CellReport) Insert(session *mgo.Session) error {
+	return errors.Wrap(session.DB("autobus").C("gps_cells").Insert(r), "error while inserting the cell report")
+}
+
+// H02Heartbeat is sent periodically by H02 devices to keep the connection alive.
+//
+// LINK heartbeats carry the state of the device:
+// e.g. "*HQ,1400046168,LINK,055600,20,8,67,0,0,080813,FFFFFBFF#"
+// (time, gsm signal, satellites, battery, steps, turnovers, date, status).
+// The layout of the others (e.g. XT) varies between firmwares,
+// so their fields are kept unparsed.
+type H02Heartbeat struct {
+	ID         string    `bson:"gps_id"`
+	Type       string    `bson:"type"`
+	DateTime   time.Time `bson:"datetime,omitempty"`
+	GSMSignal  int       `bson:"gsm_signal,omitempty"`
+	Satellites int       `bson:"satellites,omitempty"`
+	// Battery is a percentage
+	Battery int      `bson:"battery,omitempty"`
+	Status  string   `bson:"status,omitempty"`
+	Fields  []string `bson:"fields,omitempty"`
+}
+
+func (h *H02Heartbeat) Device() string {
+	return h.ID
+}
+
+func (h *H02Heartbeat) UnmarshalText(raw []byte) error {
+	parts, err := h02Fields(raw)
+	if err != nil {
+		return err
+	}
+	h.ID = parts[1]
+	h.Type = parts[2]
+	if h.Type != "LINK" {
+		h.Fields = parts[3:]
+		return nil
+	}
+
+	if len(parts) != 11 {
+		return errors.Errorf("the raw data has insufficient fields (raw: %s)", raw)
+	}
+	state, err := h02Ints(parts[4:7]...)
+	if err != nil {
+		return errors.Wrapf(err, "error decoding the heartbeat (raw: %s)", raw)
+	}
+	h.GSMSignal, h.Satellites, h.Battery = state[0], state[1], state[2]
+
+	timePart, datePart := parts[3], parts[9]
+	h.DateTime, err = time.Parse(stupidDateTimeLayout, datePart+timePart)
+	if err != nil {
+		return errors.Wrapf(err, "error decoding time (raw: time: %s - date: %s)", timePart, datePart)
+	}
+	h.Status = parts[10]
+	return nil
+}
+
+func (h *H02Heartbeat) Insert(session *mgo.Session) error {
+	return errors.Wrap(session.DB("autobus").C("gps_heartbeats").Insert(h), "error while inserting the heartbeat")
+}
@@ -0,0 +1,362 @@
+package domain
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	RegisterCodec(nmeaCodec{})
+}
+
+// nmeaCodec is the codec of plain NMEA 0183 receivers, streaming sentences
+// such as "$GPRMC,...*hh" line by line, usually through serial to TCP bridges.
+//
+// A frame is a cycle of sentences, from its first RMC or GGA up to the
+// other one: the consecutive sentences sharing the same UTC time (sentences
+// without one, like VTG, belong to the cycle they come in). This way RMC and
+// GGA are decoded together, into a single position, as soon as both came.
+// The other sentences, before the first of them or after the second, are
+// skipped: GSA and GSV bursts easily add up to kilobytes per cycle with
+// multi-constellation receivers. The catch is that the RMC of receivers
+// which don't send GGA is only complete once the next cycle starts, so
+// their positions are held back by one cycle.
+//
+// NMEA says nothing about who is sending it, so the devices are identified
+// by their connection: see Identify.
+type nmeaCodec struct{}
+
+func (nmeaCodec) Name() string {
+	return "nmea"
+}
+
+// Detect recognizes the beginning of a sentence, e.g. "$GPR".
+// Banners can't be detected.
+func (nmeaCodec) Detect(prefix []byte) bool {
+	return len(prefix) > 1 && prefix[0] == '$' && isUpper(prefix[1:])
+}
+
+// nmeaLine returns the first line in data, without the line terminator,
+// and where the next one starts. It returns -1 if the line is incomplete.
+func nmeaLine(data []byte, atEOF bool) (line []byte, next int) {
+	i := bytes.IndexByte(data, '\n')
+	if i == -1 {
+		if !atEOF || len(data) == 0 {
+			return nil, -1
+		}
+		return bytes.TrimRight(data, "\r"), len(data)
+	}
+	return bytes.TrimRight(data[:i], "\r"), i + 1
+}
+
+// nmeaType returns the type of the sentence, e.g. "RMC" for "$GPRMC,...".
+func nmeaType(sentence []byte) string {
+	if len(sentence) < 6 {
+		return ""
+	}
+	return string(sentence[3:6])
+}
+
+// nmeaTime returns the UTC time field of the sentence, if it has one.
+func nmeaTime(sentence []byte) string {
+	fields := bytes.SplitN(sentence, []byte(","), 3)
+	if len(fields) < 3 || len(fields[0]) < 6 {
+		return ""
+	}
+	switch nmeaType(fields[0]) {
+	case "RMC", "GGA", "GLL", "ZDA", "GNS", "GST":
+		return string(fields[1])
+	}
+	return ""
+}
+
+func (nmeaCodec) Split(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	// skip empty lines, and the sentences before the first RMC or GGA
+	for {
+		line, next := nmeaLine(data[advance:], atEOF)
+		if next == -1 {
+			return advance, nil, nil
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 && (line[0] != '$' || nmeaPositions(line)) {
+			break
+		}
+		advance += next
+	}
+
+	start := advance
+	if data[start] != '$' {
+		// a banner, or noise, on its own
+		line, next := nmeaLine(data[start:], atEOF)
+		return start + next, bytes.TrimSpace(line), nil
+	}
+
+	var cycle string
+	var rmc, gga bool
+	end := start
+	for end < len(data) {
+		line, next := nmeaLine(data[end:], atEOF)
+		if next == -1 {
+			break
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return end, bytes.TrimSpace(data[start:end]), nil
+		}
+		if t := nmeaTime(line); t != "" {
+			if cycle != "" && t != cycle {
+				return end, bytes.TrimSpace(data[start:end]), nil
+			}
+			cycle = t
+			switch nmeaType(line) {
+			case "RMC":
+				rmc = true
+			case "GGA":
+				gga = true
+			}
+		}
+		end += next
+		if rmc && gga {
+			return end, bytes.TrimSpace(data[start:end]), nil
+		}
+	}
+	if atEOF {
+		return len(data), bytes.TrimSpace(data[start:]), nil
+	}
+	// wait for the rest of the cycle
+	return start, nil, nil
+}
+
+// nmeaPositions reports whether the sentence is a RMC or a GGA, the ones
+// positions are decoded from.
+func nmeaPositions(sentence []byte) bool {
+	switch nmeaType(sentence) {
+	case "RMC", "GGA":
+		return true
+	}
+	return false
+}
+
+// nmeaSentence validates the checksum of the sentence, and returns its fields.
+// e.g. "$GPRMC,123519,A,...*6A" has the fields "GPRMC", "123519", "A", ...
+func nmeaSentence(sentence string) ([]string, error) {
+	star := strings.LastIndexByte(sentence, '*')
+	if !strings.HasPrefix(sentence, "$") || star == -1 || len(sentence) != star+3 {
+		return nil, errors.Errorf("malformed sentence, no checksum (raw: %s)", sentence)
+	}
+	expected, err := strconv.ParseUint(sentence[star+1:], 16, 8)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error decoding checksum (raw: %s)", sentence)
+	}
+	body := sentence[1:star]
+	if actual := nmeaChecksum(body); actual != byte(expected) {
+		return nil, errors.Errorf("checksum mismatch, expected %02X, have %02X (raw: %s)", expected, actual, sentence)
+	}
+	fields := strings.Split(body, ",")
+	if len(fields[0]) != 5 {
+		return nil, errors.Errorf("malformed sentence, unknown talker (raw: %s)", sentence)
+	}
+	return fields, nil
+}
+
+// nmeaChecksum XORs every byte between the "$" and the "*".
+func nmeaChecksum(body string) byte {
+	var sum byte
+	for i := 0; i < len(body); i++ {
+		sum ^= body[i]
+	}
+	return sum
+}
+
+// Decode decodes a cycle into a *Position, or a banner into a *NMEABanner.
+// The RMC sentence is the only one required. Sentences failing the
+// checksum are ignored, unless the RMC itself is broken.
+func (nmeaCodec) Decode(frame []byte) (Packet, error) {
+	if len(frame) == 0 || frame[0] != '$' {
+		return &NMEABanner{Text: string(frame)}, nil
+	}
+
+	var rmc, gga []string
+	var rmcErr error
+	for _, line := range strings.Split(string(frame), "\n") {
+		line = strings.TrimSpace(line)
+		fields, err := nmeaSentence(line)
+		if err != nil {
+			if strings.HasPrefix(line, "$") && len(line) > 6 && line[3:6] == "RMC" {
+				rmcErr = err
+			}
+			continue
+		}
+		switch fields[0][2:] {
+		case "RMC":
+			rmc = fields
+		case "GGA":
+			gga = fields
+		}
+	}
+	if rmc == nil {
+		if rmcErr != nil {
+			return nil, errors.Wrap(rmcErr, "nmea: invalid RMC sentence")
+		}
+		return nil, errors.Errorf("nmea: no RMC sentence (raw: %s)", frame)
+	}
+
+	p, err := decodeRMC(rmc)
+	if err != nil {
+		return nil, errors.Wrap(err, "nmea")
+	}
+	// a GGA without its fields is as good as a broken one
+	if len(gga) >= 10 && gga[1] == rmc[1] {
+		if p.Fix, err = decodeGGA(gga); err != nil {
+			return nil, errors.Wrap(err, "nmea")
+		}
+	}
+	return p, nil
+}
+
+// decodeRMC decodes the recommended minimum data:
+//
+//	$GPRMC,hhmmss.ss,status,ddmm.mm,N/S,dddmm.mm,E/W,speed,course,ddmmyy,...
+func decodeRMC(fields []string) (p *Position, err error) {
+	if len(fields) < 10 {
+		return nil, errors.Errorf("the RMC sentence has insufficient fields (raw: %s)", strings.Join(fields, ","))
+	}
+	p = &Position{
+		Codec: "nmea",
+		Type:  fields[0],
+		Valid: fields[2] == "A",
+	}
+
+	latitude, err := nmeaCoordinate(fields[3], fields[4], 2)
+	if err != nil {
+		return nil, err
+	}
+	longitude, err := nmeaCoordinate(fields[5], fields[6], 3)
+	if err != nil {
+		return nil, err
+	}
+	p.Loc = &Location{
+		Type:        "Point",
+		Coordinates: []float64{longitude, latitude},
+	}
+
+	if fields[7] != "" {
+		if p.Speed, err = strconv.ParseFloat(fields[7], 64); err != nil {
+			return nil, errors.Wrapf(err, "error decoding speed (raw: %s)", fields[7])
+		}
+	}
+	if fields[8] != "" {
+		course, err := strconv.ParseFloat(fields[8], 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error decoding course (raw: %s)", fields[8])
+		}
+		p.Direction = int64(course)
+	}
+
+	// fractional seconds are accepted when parsing, even if the layout doesn't have them
+	p.DateTime, err = time.Parse(stupidDateTimeLayout, fields[9]+fields[1])
+	if err != nil {
+		return nil, errors.Wrapf(err, "error decoding time (raw: time: %s - date: %s)", fields[1], fields[9])
+	}
+	return p, nil
+}
+
+// nmeaCoordinate decodes a coordinate in degrees and minutes, e.g. "4807.038" and "N".
+func nmeaCoordinate(raw, hemisphere string, degreeDigits int) (float64, error) {
+	if len(raw) < degreeDigits+2 {
+		return 0, errors.Errorf("no fix, or malformed coordinate (raw: %s)", raw)
+	}
+	degree, err := strconv.ParseFloat(raw[:degreeDigits], 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error decoding the degree (raw: %s)", raw)
+	}
+	minute, err := strconv.ParseFloat(raw[degreeDigits:], 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error decoding the minute (raw: %s)", raw)
+	}
+	coordinate := degree + minute/60
+	switch hemisphere {
+	case "N", "E":
+		return coordinate, nil
+	case "S", "W":
+		return -coordinate, nil
+	default:
+		return 0, errors.Errorf("unknown hemisphere %q", hemisphere)
+	}
+}
+
+// decodeGGA decodes the fix data:
+//
+//	$GPGGA,hhmmss.ss,ddmm.mm,N/S,dddmm.mm,E/W,quality,satellites,hdop,altitude,M,...
+func decodeGGA(fields []string) (*Fix, error) {
+	if len(fields) < 10 {
+		return nil, errors.Errorf("the GGA sentence has insufficient fields (raw: %s)", strings.Join(fields, ","))
+	}
+	var fix Fix
+	var err error
+	if fix.Quality, err = strconv.Atoi(fields[6]); err != nil {
+		return nil, errors.Wrapf(err, "error decoding fix quality (raw: %s)", fields[6])
+	}
+	if fields[7] != "" {
+		if fix.Satellites, err = strconv.Atoi(fields[7]); err != nil {
+			return nil, errors.Wrapf(err, "error decoding satellites (raw: %s)", fields[7])
+		}
+	}
+	if fields[8] != "" {
+		if fix.HDOP, err = strconv.ParseFloat(fields[8], 64); err != nil {
+			return nil, errors.Wrapf(err, "error decoding HDOP (raw: %s)", fields[8])
+		}
+	}
+	if fields[9] != "" {
+		if fix.Altitude, err = strconv.ParseFloat(fields[9], 64); err != nil {
+			return nil, errors.Wrapf(err, "error decoding altitude (raw: %s)", fields[9])
+		}
+	}
+	return &fix, nil
+}
+
+func (nmeaCodec) Encode(p Packet) ([]byte, error) {
+	return nil, errors.Errorf("nmea: cannot encode %T, receivers don't take commands", p)
+}
+
+// Identify returns the device ID in the banner, the first line a bridge sends
+// when connecting, e.g. "bus-42" in "ID:bus-42" when the banner is "ID:".
+func (nmeaCodec) Identify(first []byte, banner string) string {
+	fields := nmeaBannerFields(first, banner)
+	if len(fields) == 0 {
+		return ""
+	}
+	return string(fields[0])
+}
+
+// Secret returns the secret following the device ID in the banner,
+// e.g. "s3cret" in "ID:bus-42 s3cret" when the banner is "ID:".
+func (nmeaCodec) Secret(frame []byte, banner string) string {
+	fields := nmeaBannerFields(frame, banner)
+	if len(fields) < 2 {
+		return ""
+	}
+	return string(fields[1])
+}
+
+func nmeaBannerFields(frame []byte, banner string) [][]byte {
+	if banner == "" || !bytes.HasPrefix(frame, []byte(banner)) {
+		return nil
+	}
+	return bytes.Fields(frame[len(banner):])
+}
+
+// NMEABanner is a line that is not a sentence, such as the banner
+// identifying the device.
+type NMEABanner struct {
+	Text string
+}
+
+// Device returns an empty string: the banner is only meaningful
+// to the connection it was sent through.
+func (b *NMEABanner) Device() string {
+	return ""
+}
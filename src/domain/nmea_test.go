@@ -0,0 +1,188 @@
+package domain
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testRMC  = "$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*6A"
+	testGGA  = "$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*47"
+	testVTG  = "$GPVTG,084.4,T,,M,022.4,N,041.5,K*6C"
+	testRMC2 = "$GPRMC,123520,A,2330.489,S,04637.914,W,000.0,000.0,230394,,*17"
+	testGGA2 = "$GPGGA,123520,2330.489,S,04637.914,W,2,11,1.2,760.0,M,0.0,M,,*76"
+)
+
+func TestSplitNMEA(t *testing.T) {
+	codec, _ := LookupCodec("nmea")
+	stream := "ID:bus-42\r\n" + testRMC + "\r\n" + testGGA + "\r\n" + testVTG + "\r\n\r\n" + testGGA2 + "\r\n" + testRMC2 + "\r\n"
+	scanner := bufio.NewScanner(strings.NewReader(stream))
+	scanner.Split(codec.Split)
+	var frames []string
+	for scanner.Scan() {
+		frames = append(frames, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal("Should not fail scanning:", err)
+	}
+	expected := []string{
+		"ID:bus-42",
+		// the VTG after the pair is skipped
+		testRMC + "\r\n" + testGGA,
+		testGGA2 + "\r\n" + testRMC2,
+	}
+	if len(frames) != len(expected) {
+		t.Fatalf("Should have %d frames, has %d: %q", len(expected), len(frames), frames)
+	}
+	for i := range frames {
+		if frames[i] != expected[i] {
+			t.Errorf("Unexpected frame %d: wanted %q, have %q", i, expected[i], frames[i])
+		}
+	}
+}
+
+func TestSplitNMEALargeCycles(t *testing.T) {
+	codec, _ := LookupCodec("nmea")
+	// a multi-constellation receiver: the satellites in view
+	// take far more than the positions
+	var satellites []string
+	for _, talker := range []string{"GP", "GL", "GA", "BD"} {
+		satellites = append(satellites, "$"+talker+"GSA,A,3,04,05,,09,12,,,24,,,,,2.5,1.3,2.1*39")
+		for i := 1; i <= 5; i++ {
+			satellites = append(satellites, "$"+talker+"GSV,5,"+strconv.Itoa(i)+",20,01,40,083,46,02,17,308,41,12,07,344,39,14,22,228,45*75")
+		}
+	}
+	burst := strings.Join(satellites, "\r\n")
+	stream := testRMC + "\r\n" + testVTG + "\r\n" + testGGA + "\r\n" + burst + "\r\n" +
+		testGGA2 + "\r\n" + testRMC2 + "\r\n" + burst + "\r\n"
+	if len(burst) <= 1024 {
+		t.Fatalf("The cycles should be larger than the frames, they are %d bytes", len(burst))
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(stream))
+	// as much as the hub holds for a frame, by default
+	scanner.Buffer(make([]byte, 256), 1024)
+	scanner.Split(codec.Split)
+	var frames []string
+	for scanner.Scan() {
+		frames = append(frames, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal("Should not hold on to whole cycles:", err)
+	}
+	expected := []string{
+		testRMC + "\r\n" + testVTG + "\r\n" + testGGA,
+		testGGA2 + "\r\n" + testRMC2,
+	}
+	if len(frames) != len(expected) {
+		t.Fatalf("Should have %d frames, has %d: %q", len(expected), len(frames), frames)
+	}
+	for i := range frames {
+		if frames[i] != expected[i] {
+			t.Errorf("Unexpected frame %d: wanted %q, have %q", i, expected[i], frames[i])
+		}
+	}
+}
+
+func TestNMEACodec(t *testing.T) {
+	codec, ok := LookupCodec("nmea")
+	if !ok {
+		t.Fatal("Should have registered the nmea codec")
+	}
+	if detected, ok := DetectCodec([]byte("$GPR")); !ok || detected != codec {
+		t.Error("Should detect nmea sentences, detected:", detected)
+	}
+
+	packet, err := codec.Decode([]byte(testRMC + "\r\n" + testGGA + "\r\n" + testVTG))
+	if err != nil {
+		t.Fatal("Should not fail with a valid cycle:", err)
+	}
+	position, ok := packet.(*Position)
+	if !ok {
+		t.Fatalf("Should decode a position, decoded %T", packet)
+	}
+	expectedTime := time.Date(1994, 3, 23, 12, 35, 19, 0, time.UTC)
+	if position.Codec != "nmea" || !position.Valid || position.Speed != 22.4 || position.Direction != 84 || !position.DateTime.Equal(expectedTime) {
+		t.Errorf("Unexpected position: %+v", position)
+	}
+	expectedLatitude, expectedLongitude := 48+7.038/60, 11+31.0/60
+	if position.Loc.Coordinates[0] != expectedLongitude || position.Loc.Coordinates[1] != expectedLatitude {
+		t.Errorf("Unexpected location: %v", position.Loc.Coordinates)
+	}
+	if expected := (Fix{Quality: 1, Satellites: 8, HDOP: 0.9, Altitude: 545.4}); position.Fix == nil || *position.Fix != expected {
+		t.Errorf("Unexpected fix: wanted %+v, have %+v", expected, position.Fix)
+	}
+
+	packet, err = codec.Decode([]byte(testGGA2 + "\r\n" + testRMC2))
+	if err != nil {
+		t.Fatal("Should not fail with a valid cycle:", err)
+	}
+	position = packet.(*Position)
+	if position.Loc.Coordinates[0] >= 0 || position.Loc.Coordinates[1] >= 0 || position.Fix.Quality != 2 {
+		t.Errorf("Unexpected position: %+v %v %+v", position, position.Loc.Coordinates, position.Fix)
+	}
+
+	// a broken GGA doesn't take the position down with it
+	packet, err = codec.Decode([]byte(testRMC + "\r\n" + strings.Replace(testGGA, "*47", "*48", 1)))
+	if err != nil {
+		t.Fatal("Should not fail with a broken GGA:", err)
+	}
+	if position := packet.(*Position); position.Fix != nil {
+		t.Error("Should have ignored the broken GGA")
+	}
+
+	// so does a GGA without its fields
+	truncated := fmt.Sprintf("$GPGGA*%02X", nmeaChecksum("GPGGA"))
+	packet, err = codec.Decode([]byte(testRMC + "\r\n" + truncated))
+	if err != nil {
+		t.Fatal("Should not fail with a truncated GGA:", err)
+	}
+	if position := packet.(*Position); position.Fix != nil {
+		t.Error("Should have ignored the truncated GGA")
+	}
+
+	for _, invalid := range []string{
+		strings.Replace(testRMC, "*6A", "*6B", 1),
+		strings.Replace(testRMC, "*6A", "", 1),
+		testGGA,
+	} {
+		if _, err := codec.Decode([]byte(invalid)); err == nil {
+			t.Error("Should fail with an invalid cycle:", invalid)
+		}
+	}
+}
+
+func TestNMEAIdentify(t *testing.T) {
+	codec, _ := LookupCodec("nmea")
+	identifier, ok := codec.(Identifier)
+	if !ok {
+		t.Fatal("Should identify devices by their connection")
+	}
+	if id := identifier.Identify([]byte("ID:bus-42"), "ID:"); id != "bus-42" {
+		t.Error("Should identify the device by the banner, identified:", id)
+	}
+	if id := identifier.Identify([]byte(testRMC), "ID:"); id != "" {
+		t.Error("Should not identify the device without a banner, identified:", id)
+	}
+	authenticator, ok := codec.(Authenticator)
+	if !ok {
+		t.Fatal("Should take secrets in the banners")
+	}
+	if id, secret := identifier.Identify([]byte("ID:bus-42 s3cret"), "ID:"), authenticator.Secret([]byte("ID:bus-42 s3cret"), "ID:"); id != "bus-42" || secret != "s3cret" {
+		t.Errorf("Should tell the device from its secret, got %q and %q", id, secret)
+	}
+	if secret := authenticator.Secret([]byte("ID:bus-42"), "ID:"); secret != "" {
+		t.Error("Should take no secret from banners without one, got", secret)
+	}
+	packet, err := codec.Decode([]byte("ID:bus-42"))
+	if err != nil {
+		t.Fatal("Should decode banners:", err)
+	}
+	if _, ok := packet.(*NMEABanner); !ok {
+		t.Errorf("Should decode a banner, decoded %T", packet)
+	}
+}
@@ -0,0 +1,212 @@
+package domain
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	RegisterCodec(osmandCodec{})
+}
+
+// metres per second to knots, the unit of Position.Speed
+const knotsPerMps = 3600 / 1852.0
+
+// osmandCodec is the codec of the OsmAnd protocol, spoken over HTTP by
+// smartphone trackers (e.g. the Traccar client), such as
+// "/?id=123456&lat=-23.5&lon=-46.6&timestamp=1491822906&speed=10.5&bearing=90".
+//
+// A frame is the canonical, url encoded, query of a request:
+// the parameters sorted by name. Requests in the JSON variant are converted
+// to the same query by OsmAndJSON. The speed is in knots.
+type osmandCodec struct{}
+
+func (osmandCodec) Name() string {
+	return "osmand"
+}
+
+// Detect returns false, the protocol is spoken over HTTP only.
+func (osmandCodec) Detect(prefix []byte) bool {
+	return false
+}
+
+func (osmandCodec) Split(data []byte, atEOF bool) (int, []byte, error) {
+	return bufio.ScanLines(data, atEOF)
+}
+
+func (osmandCodec) Decode(frame []byte) (Packet, error) {
+	values, err := url.ParseQuery(string(frame))
+	if err != nil {
+		return nil, errors.Wrapf(err, "osmand: malformed query (raw: %s)", frame)
+	}
+	p := &Position{
+		Codec: "osmand",
+		Type:  "query",
+		ID:    values.Get("id"),
+		Valid: true,
+	}
+	if p.ID == "" {
+		p.ID = values.Get("deviceid")
+	}
+	if p.ID == "" {
+		return nil, errors.Errorf("osmand: missing the device ID (raw: %s)", frame)
+	}
+
+	latitude, longitude := values.Get("lat"), values.Get("lon")
+	if location := values.Get("location"); location != "" {
+		// "lat,lon"
+		coords := strings.Split(location, ",")
+		if len(coords) != 2 {
+			return nil, errors.Errorf("osmand: malformed location (raw: %s)", location)
+		}
+		latitude, longitude = coords[0], coords[1]
+	}
+	lat, err := osmandFloat("lat", latitude, true)
+	if err != nil {
+		return nil, err
+	}
+	lon, err := osmandFloat("lon", longitude, true)
+	if err != nil {
+		return nil, err
+	}
+	if lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return nil, errors.Errorf("osmand: coordinates out of range (lat: %f, lon: %f)", lat, lon)
+	}
+	p.Loc = &Location{
+		Type:        "Point",
+		Coordinates: []float64{lon, lat},
+	}
+
+	if p.DateTime, err = osmandTime(values.Get("timestamp")); err != nil {
+		return nil, err
+	}
+	if p.Speed, err = osmandFloat("speed", values.Get("speed"), false); err != nil {
+		return nil, err
+	}
+	bearing := values.Get("bearing")
+	if bearing == "" {
+		bearing = values.Get("heading")
+	}
+	direction, err := osmandFloat("bearing", bearing, false)
+	if err != nil {
+		return nil, err
+	}
+	p.Direction = int64(direction)
+	if valid := values.Get("valid"); valid != "" {
+		if p.Valid, err = strconv.ParseBool(valid); err != nil {
+			return nil, errors.Wrapf(err, "osmand: error decoding valid (raw: %s)", valid)
+		}
+	}
+
+	if values.Get("altitude") != "" || values.Get("hdop") != "" {
+		p.Fix = &Fix{}
+		if p.Valid {
+			p.Fix.Quality = 1
+		}
+		if p.Fix.Altitude, err = osmandFloat("altitude", values.Get("altitude"), false); err != nil {
+			return nil, err
+		}
+		if p.Fix.HDOP, err = osmandFloat("hdop", values.Get("hdop"), false); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func osmandFloat(name, raw string, required bool) (float64, error) {
+	if raw == "" {
+		if required {
+			return 0, errors.Errorf("osmand: missing %s", name)
+		}
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "osmand: error decoding %s (raw: %s)", name, raw)
+	}
+	return f, nil
+}
+
+// osmandTime parses the timestamp, which is in seconds or milliseconds
+// since the epoch, or a date (e.g. "2017-04-10T11:15:06Z").
+func osmandTime(raw string) (time.Time, error) {
+	if raw == "" {
+		return time.Time{}, errors.New("osmand: missing timestamp")
+	}
+	if n, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		if n > 1e12 {
+			return time.Unix(0, n*int64(time.Millisecond)).UTC(), nil
+		}
+		return time.Unix(n, 0).UTC(), nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05"} {
+		if t, err := time.Parse(layout, raw); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, errors.Errorf("osmand: error decoding timestamp (raw: %s)", raw)
+}
+
+func (osmandCodec) Encode(p Packet) ([]byte, error) {
+	return nil, errors.Errorf("osmand: cannot encode %T, phones don't take commands", p)
+}
+
+// osmandJSON is the JSON variant of the protocol, e.g.
+//
+//	{"device_id": "123456", "location": {"timestamp": "2017-04-10T11:15:06Z",
+//	"coords": {"latitude": -23.5, "longitude": -46.6, "speed": 5.4, "heading": 90}}}
+//
+// The speed is in metres per second. Unknown speeds and headings are negative.
+type osmandJSON struct {
+	DeviceID string `json:"device_id"`
+	Location struct {
+		Timestamp string `json:"timestamp"`
+		Coords    struct {
+			Latitude  *float64 `json:"latitude"`
+			Longitude *float64 `json:"longitude"`
+			Speed     *float64 `json:"speed"`
+			Heading   *float64 `json:"heading"`
+			Altitude  *float64 `json:"altitude"`
+		} `json:"coords"`
+	} `json:"location"`
+}
+
+// OsmAndJSON converts a request in the JSON variant of the OsmAnd protocol
+// into the query it is the equivalent of.
+func OsmAndJSON(body []byte) (url.Values, error) {
+	var req osmandJSON
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, errors.Wrap(err, "osmand: malformed JSON")
+	}
+	values := url.Values{}
+	set := func(name string, f *float64, scale float64) {
+		if f != nil {
+			values.Set(name, strconv.FormatFloat(*f*scale, 'f', -1, 64))
+		}
+	}
+	if req.DeviceID != "" {
+		values.Set("id", req.DeviceID)
+	}
+	if req.Location.Timestamp != "" {
+		values.Set("timestamp", req.Location.Timestamp)
+	}
+	coords := req.Location.Coords
+	if coords.Speed != nil && *coords.Speed < 0 {
+		coords.Speed = nil
+	}
+	if coords.Heading != nil && *coords.Heading < 0 {
+		coords.Heading = nil
+	}
+	set("lat", coords.Latitude, 1)
+	set("lon", coords.Longitude, 1)
+	set("speed", coords.Speed, knotsPerMps)
+	set("bearing", coords.Heading, 1)
+	set("altitude", coords.Altitude, 1)
+	return values, nil
+}
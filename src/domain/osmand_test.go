@@ -0,0 +1,67 @@
+package domain
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOsmAndCodec(t *testing.T) {
+	codec, ok := LookupCodec("osmand")
+	if !ok {
+		t.Fatal("Should have registered the osmand codec")
+	}
+
+	packet, err := codec.Decode([]byte("bearing=90&id=123456&lat=-23.5&lon=-46.6&speed=10.5&timestamp=1491822906"))
+	if err != nil {
+		t.Fatal("Should not fail with a valid query:", err)
+	}
+	position, ok := packet.(*Position)
+	if !ok {
+		t.Fatalf("Should decode a position, decoded %T", packet)
+	}
+	expectedTime := time.Date(2017, 4, 10, 11, 15, 6, 0, time.UTC)
+	if position.Device() != "123456" || !position.Valid || position.Speed != 10.5 || position.Direction != 90 || !position.DateTime.Equal(expectedTime) {
+		t.Errorf("Unexpected position: %+v", position)
+	}
+	if position.Loc.Coordinates[0] != -46.6 || position.Loc.Coordinates[1] != -23.5 {
+		t.Errorf("Unexpected location: %v", position.Loc.Coordinates)
+	}
+
+	packet, err = codec.Decode([]byte("deviceid=123456&location=-23.5%2C-46.6&timestamp=2017-04-10T11%3A15%3A06Z&altitude=760&valid=false"))
+	if err != nil {
+		t.Fatal("Should not fail with a valid query:", err)
+	}
+	position = packet.(*Position)
+	if position.Valid || position.Fix == nil || position.Fix.Altitude != 760 || !position.DateTime.Equal(expectedTime) {
+		t.Errorf("Unexpected position: %+v", position)
+	}
+
+	for _, invalid := range []string{
+		"lat=-23.5&lon=-46.6&timestamp=1491822906",
+		"id=123456&lon=-46.6&timestamp=1491822906",
+		"id=123456&lat=-123.5&lon=-46.6&timestamp=1491822906",
+		"id=123456&lat=-23.5&lon=-46.6",
+		"id=123456&lat=-23.5&lon=-46.6&timestamp=yesterday",
+		"id=123456&lat=-23.5&lon=-46.6&timestamp=1491822906&speed=fast",
+	} {
+		if _, err := codec.Decode([]byte(invalid)); err == nil {
+			t.Error("Should fail with an invalid query:", invalid)
+		}
+	}
+}
+
+func TestOsmAndJSON(t *testing.T) {
+	values, err := OsmAndJSON([]byte(`{"device_id": "123456", "location": {"timestamp": "2017-04-10T11:15:06Z",
+		"coords": {"latitude": -23.5, "longitude": -46.6, "speed": 1.852, "heading": -1}}}`))
+	if err != nil {
+		t.Fatal("Should not fail with valid JSON:", err)
+	}
+	expected := "id=123456&lat=-23.5&lon=-46.6&speed=3.6&timestamp=2017-04-10T11%3A15%3A06Z"
+	if values.Encode() != expected {
+		t.Errorf("Unexpected query: wanted %s, have %s", expected, values.Encode())
+	}
+
+	if _, err := OsmAndJSON([]byte("{")); err == nil {
+		t.Error("Should fail with malformed JSON")
+	}
+}
@@ -0,0 +1,76 @@
+package domain
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// Position is a position report of a device, regardless of the codec it came from.
+// It is what is stored in the database, and what autobus-web serves.
+type Position struct {
+	Codec       string    `bson:"codec"`
+	MessageHead string    `bson:"head,omitempty"`
+	ID          string    `bson:"gps_id"`
+	Type        string    `bson:"type"`
+	Valid       bool      `bson:"valid"`
+	Loc         *Location `bson:"loc"`
+	DateTime    time.Time `bson:"datetime"`
+	Speed       float64   `bson:"speed"`
+	Direction   int64     `bson:"direction"`
+	Status      string    `bson:"status"`
+	// State is the decoded Status, when the codec knows how to.
+	State *VehicleState `bson:"state,omitempty"`
+	// Fix is the quality of the fix, for the codecs reporting it.
+	Fix *Fix `bson:"fix,omitempty"`
+	// Ingestion is where and when autobus-core received the position.
+	Ingestion *Ingestion `bson:"ingestion,omitempty"`
+}
+
+// Ingestion describes how a frame reached autobus-core (see Envelope).
+type Ingestion struct {
+	ReceivedAt   time.Time `bson:"received_at"`
+	ConnectionID uint64    `bson:"connection_id"`
+	RemoteAddr   string    `bson:"remote_addr"`
+	Listener     string    `bson:"listener"`
+	InstanceID   string    `bson:"instance_id"`
+}
+
+// Fix describes the quality of a GPS fix.
+type Fix struct {
+	// Quality is 0 when there is no fix, 1 for GPS, 2 for DGPS, and so on.
+	Quality    int     `bson:"quality"`
+	Satellites int     `bson:"satellites"`
+	HDOP       float64 `bson:"hdop"`
+	// Altitude is in meters, above the mean sea level.
+	Altitude float64 `bson:"altitude"`
+}
+
+func (p *Position) Device() string {
+	return p.ID
+}
+
+func (p *Position) Insert(session *mgo.Session) error {
+	transient := session.DB("autobus").C("gps_data_transient")
+	persisted := session.DB("autobus").C("gps_data")
+	if err := transient.Insert(p); err != nil {
+		return errors.Wrap(err, "error while inserting to a transient collection")
+	}
+	if err := persisted.Insert(p); err != nil {
+		return errors.Wrap(err, "error while inserting to a persisted collection")
+	}
+	return nil
+}
+
+// Command is a command sent to a device. Each codec encodes it in its own way.
+type Command struct {
+	DeviceID string
+	Name     string
+	Args     []string
+	DateTime time.Time
+}
+
+func (c *Command) Device() string {
+	return c.DeviceID
+}
@@ -0,0 +1,97 @@
+package domain
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// VehicleState is the state of the vehicle, as reported by its device.
+type VehicleState struct {
+	SOS        bool `bson:"sos" json:"sos"`
+	Ignition   bool `bson:"ignition" json:"ignition"`
+	PowerCut   bool `bson:"power_cut" json:"power_cut"`
+	LowBattery bool `bson:"low_battery" json:"low_battery"`
+	DoorOpen   bool `bson:"door_open" json:"door_open"`
+	Overspeed  bool `bson:"overspeed" json:"overspeed"`
+	Vibration  bool `bson:"vibration" json:"vibration"`
+	Geofence   bool `bson:"geofence" json:"geofence"`
+	Tamper     bool `bson:"tamper" json:"tamper"`
+}
+
+// H02 status bits. They are active low: a bit is 0 when its flag is on.
+const (
+	h02Vibration  = 0
+	h02SOS        = 1
+	h02Overspeed  = 2
+	h02Geofence   = 3
+	h02Ignition   = 10
+	h02DoorOpen   = 16
+	h02LowBattery = 17
+	h02Tamper     = 18
+	h02PowerCut   = 19
+)
+
+// DecodeH02Status decodes the status word of H02 messages (e.g. "FFFFFBFF").
+func DecodeH02Status(status string) (*VehicleState, error) {
+	bits, err := strconv.ParseUint(status, 16, 32)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error decoding status (raw: %s)", status)
+	}
+	on := func(bit uint) bool {
+		return bits&(1<<bit) == 0
+	}
+	return &VehicleState{
+		SOS:        on(h02SOS),
+		Ignition:   on(h02Ignition),
+		PowerCut:   on(h02PowerCut),
+		LowBattery: on(h02LowBattery),
+		DoorOpen:   on(h02DoorOpen),
+		Overspeed:  on(h02Overspeed),
+		Vibration:  on(h02Vibration),
+		Geofence:   on(h02Geofence),
+		Tamper:     on(h02Tamper),
+	}, nil
+}
+
+// alarmNames names the alarms returned by VehicleState.alarms, in the same order.
+var alarmNames = []string{"sos", "power_cut", "low_battery", "overspeed", "vibration", "geofence", "tamper"}
+
+// alarms returns the flags that are alarms, as opposed to
+// the ones that merely describe the vehicle (e.g. ignition).
+func (s *VehicleState) alarms() []bool {
+	if s == nil {
+		return make([]bool, len(alarmNames))
+	}
+	return []bool{s.SOS, s.PowerCut, s.LowBattery, s.Overspeed, s.Vibration, s.Geofence, s.Tamper}
+}
+
+// AlarmChange is an alarm going on or off.
+type AlarmChange struct {
+	Name   string
+	Active bool
+}
+
+// AlarmChanges returns the alarms that went on or off since the previous state.
+// When the previous state is unknown (nil), every alarm that is on is returned.
+func (s *VehicleState) AlarmChanges(previous *VehicleState) []AlarmChange {
+	var changes []AlarmChange
+	before := previous.alarms()
+	for i, active := range s.alarms() {
+		if active != before[i] {
+			changes = append(changes, AlarmChange{Name: alarmNames[i], Active: active})
+		}
+	}
+	return changes
+}
+
+// Alarm is published when an alarm of a device goes on or off.
+type Alarm struct {
+	DeviceID string    `json:"device_id"`
+	Codec    string    `json:"codec"`
+	Name     string    `json:"name"`
+	Active   bool      `json:"active"`
+	DateTime time.Time `json:"datetime"`
+	Loc      *Location `json:"location,omitempty"`
+}
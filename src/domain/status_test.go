@@ -0,0 +1,52 @@
+package domain
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeH02Status(t *testing.T) {
+	state, err := DecodeH02Status("FFFFFBFF")
+	if err != nil {
+		t.Fatal("Should decode a valid status:", err)
+	}
+	if expected := (VehicleState{Ignition: true}); *state != expected {
+		t.Errorf("Unexpected state: wanted %+v, have %+v", expected, *state)
+	}
+
+	state, err = DecodeH02Status("FFF7FBFD")
+	if err != nil {
+		t.Fatal("Should decode a valid status:", err)
+	}
+	if expected := (VehicleState{SOS: true, Ignition: true, PowerCut: true}); *state != expected {
+		t.Errorf("Unexpected state: wanted %+v, have %+v", expected, *state)
+	}
+
+	if _, err := DecodeH02Status("NOTHEX"); err == nil {
+		t.Error("Should fail with an invalid status")
+	}
+}
+
+func TestAlarmChanges(t *testing.T) {
+	idle := &VehicleState{Ignition: true}
+	panicking := &VehicleState{Ignition: true, SOS: true}
+	tests := []struct {
+		name              string
+		previous, current *VehicleState
+		want              []AlarmChange
+	}{
+		{"Unknown and idle", nil, idle, nil},
+		{"Unknown and panicking", nil, panicking, []AlarmChange{{"sos", true}}},
+		{"Raised", idle, panicking, []AlarmChange{{"sos", true}}},
+		{"Still on", panicking, panicking, nil},
+		{"Cleared", panicking, &VehicleState{Overspeed: true}, []AlarmChange{{"sos", false}, {"overspeed", true}}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(tt *testing.T) {
+			if changes := test.current.AlarmChanges(test.previous); !reflect.DeepEqual(changes, test.want) {
+				tt.Errorf("Unexpected changes: wanted %v, have %v", test.want, changes)
+			}
+		})
+	}
+}
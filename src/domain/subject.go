@@ -0,0 +1,49 @@
+package domain
+
+import "strings"
+
+// SubjectUpdate is the root of the NATS subjects the frames received by
+// autobus-core are published to: gps.update.<codec>.<deviceID>, or
+// gps.update.<codec> while the device is not identified.
+// Older cores published every h02 frame to gps.update itself.
+//
+// Device IDs never hold dots, nor wildcards, so they are a single token.
+const SubjectUpdate = "gps.update"
+
+// UpdateSubject returns the subject the frames of the device are published to.
+func UpdateSubject(codec, deviceID string) string {
+	subject := SubjectUpdate + "." + codec
+	if deviceID != "" {
+		subject += "." + deviceID
+	}
+	return subject
+}
+
+// ParseUpdateSubject returns the codec and device of a subject returned by
+// UpdateSubject. The device is empty when the core did not know it yet.
+func ParseUpdateSubject(subject string) (codec, deviceID string) {
+	if subject == SubjectUpdate {
+		return "h02", ""
+	}
+	parts := strings.SplitN(strings.TrimPrefix(subject, SubjectUpdate+"."), ".", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return parts[0], ""
+}
+
+// UpdateSubscriptions returns the subjects to subscribe to, to receive
+// the frames of the given codec and device. An empty codec or device
+// stands for any of them.
+func UpdateSubscriptions(codec, deviceID string) []string {
+	switch {
+	case codec == "" && deviceID == "":
+		return []string{SubjectUpdate, SubjectUpdate + ".>"}
+	case deviceID == "":
+		return []string{UpdateSubject(codec, ""), UpdateSubject(codec, "*")}
+	case codec == "":
+		return []string{UpdateSubject("*", deviceID)}
+	default:
+		return []string{UpdateSubject(codec, deviceID)}
+	}
+}
@@ -0,0 +1,44 @@
+package domain
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUpdateSubjects(t *testing.T) {
+	testCases := []struct {
+		codec, deviceID, subject string
+	}{
+		{"h02", "1400046168", "gps.update.h02.1400046168"},
+		{"gt06", "", "gps.update.gt06"},
+		{"nmea", "10-0-0-5", "gps.update.nmea.10-0-0-5"},
+	}
+	for _, tc := range testCases {
+		if subject := UpdateSubject(tc.codec, tc.deviceID); subject != tc.subject {
+			t.Errorf("Expected %s, got %s", tc.subject, subject)
+		}
+		if codec, deviceID := ParseUpdateSubject(tc.subject); codec != tc.codec || deviceID != tc.deviceID {
+			t.Errorf("Expected %s and %s from %s, got %s and %s", tc.codec, tc.deviceID, tc.subject, codec, deviceID)
+		}
+	}
+	if codec, deviceID := ParseUpdateSubject("gps.update"); codec != "h02" || deviceID != "" {
+		t.Errorf("Should take the legacy subject as h02, got %s and %s", codec, deviceID)
+	}
+}
+
+func TestUpdateSubscriptions(t *testing.T) {
+	testCases := []struct {
+		codec, deviceID string
+		subjects        []string
+	}{
+		{"", "", []string{"gps.update", "gps.update.>"}},
+		{"h02", "", []string{"gps.update.h02", "gps.update.h02.*"}},
+		{"", "1400046168", []string{"gps.update.*.1400046168"}},
+		{"h02", "1400046168", []string{"gps.update.h02.1400046168"}},
+	}
+	for _, tc := range testCases {
+		if subjects := UpdateSubscriptions(tc.codec, tc.deviceID); !reflect.DeepEqual(subjects, tc.subjects) {
+			t.Errorf("Expected %v for %q and %q, got %v", tc.subjects, tc.codec, tc.deviceID, subjects)
+		}
+	}
+}
@@ -26,6 +26,11 @@ func createCappedCollection(session *mgo.Session) error {
 	return nil
 }
 
+// inserter is implemented by the packets that are stored, each in its own collection.
+type inserter interface {
+	Insert(*mgo.Session) error
+}
+
 var Version string
 
 func main() {
@@ -64,22 +69,69 @@ func main() {
 	}
 
 	logger.Println("Asynchronously waiting for messages...")
-	for i := 0; i < horizontalConcurrency; i++ {
-		go nc.QueueSubscribe("gps.update", "queue.web.database", func(m *nats.Msg) {
-			log.Println("Got message:", m.Data, "length:", len(m.Data))
-
-			var parsed domain.GPSMessage
-			if err := parsed.UnmarshalText(m.Data); err != nil {
-				logger.Println("[ERROR] error while parsing the gps message: ", err)
-				return
+	handle := func(m *nats.Msg) {
+		// a broken message must not take the subscription down with it
+		defer func() {
+			if v := recover(); v != nil {
+				logger.Println("[ERROR] dropping the message on", m.Subject, "which could not be handled:", v)
 			}
-
-			logger.Println("Inserting in the database... parsed:", parsed)
-			if err := parsed.Insert(session); err != nil {
-				logger.Println("[ERROR] error while inserting gps data to the database: ", err)
+		}()
+
+		envelope, err := domain.OpenEnvelope(m.Data)
+		if err != nil {
+			logger.Println("[ERROR] error while opening the envelope:", err)
+			return
+		}
+		codecName, deviceID := domain.ParseUpdateSubject(m.Subject)
+		if envelope.Codec != "" {
+			codecName = envelope.Codec
+		}
+		if envelope.DeviceID != "" {
+			deviceID = envelope.DeviceID
+		}
+		codec, ok := domain.LookupCodec(codecName)
+		if !ok {
+			logger.Println("[ERROR] unknown codec:", codecName)
+			return
+		}
+		packet, err := codec.Decode(envelope.Frame)
+		if err != nil {
+			logger.Println("[ERROR] error while parsing the gps message: ", err)
+			return
+		}
+		parsed, ok := packet.(*domain.Position)
+		if !ok {
+			// replies, heartbeats, cell reports...
+			other, ok := packet.(inserter)
+			if !ok {
+				logger.Printf("[WARN] ignoring %T from %s, it is not stored", packet, deviceID)
 				return
 			}
-		})
+			if err := other.Insert(session); err != nil {
+				logger.Println("[ERROR] error while inserting to the database: ", err)
+			}
+			return
+		}
+		if parsed.ID == "" {
+			// some codecs (e.g. gt06) only identify the device when it connects
+			parsed.ID = deviceID
+		}
+		parsed.Ingestion = envelope.Ingestion()
+		if parsed.ID == "" {
+			logger.Println("[ERROR] dropping position from an unknown device:", parsed)
+			return
+		}
+
+		logger.Println("Inserting in the database... parsed:", parsed)
+		if err := parsed.Insert(session); err != nil {
+			logger.Println("[ERROR] error while inserting gps data to the database: ", err)
+			return
+		}
+	}
+	for i := 0; i < horizontalConcurrency; i++ {
+		for _, subject := range domain.UpdateSubscriptions("", "") {
+			go nc.QueueSubscribe(subject, "queue.web.database", handle)
+		}
 	}
 
 	sig := make(chan os.Signal, 1)
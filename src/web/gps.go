@@ -17,6 +17,39 @@ type GPSData struct {
 	Speed       float64       `json:"speed"`
 	Direction   int64         `json:"direction"`
 	Status      string        `json:"status"`
+	State       *VehicleState `json:"state,omitempty" bson:"state,omitempty"`
+	Fix         *Fix          `json:"fix,omitempty" bson:"fix,omitempty"`
+	Ingestion   *Ingestion    `json:"ingestion,omitempty" bson:"ingestion,omitempty"`
+}
+
+// Ingestion is where and when the core received the data, see domain.Ingestion.
+type Ingestion struct {
+	ReceivedAt   time.Time `json:"received_at" bson:"received_at"`
+	ConnectionID uint64    `json:"connection_id" bson:"connection_id"`
+	RemoteAddr   string    `json:"remote_addr" bson:"remote_addr"`
+	Listener     string    `json:"listener" bson:"listener"`
+	InstanceID   string    `json:"instance_id" bson:"instance_id"`
+}
+
+// Fix is the quality of the GPS fix, see domain.Fix.
+type Fix struct {
+	Quality    int     `json:"quality" bson:"quality"`
+	Satellites int     `json:"satellites" bson:"satellites"`
+	HDOP       float64 `json:"hdop" bson:"hdop"`
+	Altitude   float64 `json:"altitude" bson:"altitude"`
+}
+
+// VehicleState is the decoded status of the device, see domain.VehicleState.
+type VehicleState struct {
+	SOS        bool `json:"sos" bson:"sos"`
+	Ignition   bool `json:"ignition" bson:"ignition"`
+	PowerCut   bool `json:"power_cut" bson:"power_cut"`
+	LowBattery bool `json:"low_battery" bson:"low_battery"`
+	DoorOpen   bool `json:"door_open" bson:"door_open"`
+	Overspeed  bool `json:"overspeed" bson:"overspeed"`
+	Vibration  bool `json:"vibration" bson:"vibration"`
+	Geofence   bool `json:"geofence" bson:"geofence"`
+	Tamper     bool `json:"tamper" bson:"tamper"`
 }
 
 type Location struct {